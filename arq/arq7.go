@@ -0,0 +1,534 @@
+/*
+arqinator: arq/arq7.go
+Implements reading Arq 6 and Arq 7 backup sets, folders, backup records, trees and blobs.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+/*
+References:
+-	https://www.arqbackup.com/documentation/arq7/English.lproj/dataFormat.html
+
+An Arq 6/7 backup set looks like:
+
+	<backup set UUID>/backupconfig.json
+	<backup set UUID>/encryptedkeyset.dat
+	<backup set UUID>/backupfolders/<folder UUID>/backupfolder.json
+	<backup set UUID>/backupfolders/<folder UUID>/backuprecords/<5 digits>/<digits>.backuprecord
+	<backup set UUID>/treepacks/<2 hex>/<pack UUID>.pack
+	<backup set UUID>/blobpacks/<2 hex>/<pack UUID>.pack
+	<backup set UUID>/largeblobpacks/<2 hex>/<pack UUID>.pack
+	<backup set UUID>/standardobjects/<blob identifier>
+
+Backup folders map onto ArqBuckets, and the most recent backup record of a folder plays the role of the
+head commit. Objects are ARQO-encrypted if the backup set is encrypted, and blobs are located by a
+BlobLoc rather than by searching pack indexes.
+*/
+
+package arq
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/asimihsan/arqinator/arq/types"
+	"github.com/asimihsan/arqinator/connector"
+	"github.com/asimihsan/arqinator/crypto"
+)
+
+const (
+	ARQ7_BACKUP_RECORD_SUFFIX = ".backuprecord"
+)
+
+type arq7BackupConfig struct {
+	BackupName   string `json:"backupName"`
+	ComputerName string `json:"computerName"`
+	IsEncrypted  bool   `json:"isEncrypted"`
+}
+
+type arq7BackupFolder struct {
+	UUID      string `json:"uuid"`
+	LocalPath string `json:"localPath"`
+	Name      string `json:"name"`
+}
+
+/*
+The JSON form of a node, only used for the root node of a backup record. Nodes within trees are binary,
+see arq_types.ReadArq7Node.
+*/
+type arq7Node struct {
+	IsTree               bool                 `json:"isTree"`
+	TreeBlobLoc          *arq_types.BlobLoc   `json:"treeBlobLoc"`
+	DataBlobLocs         []*arq_types.BlobLoc `json:"dataBlobLocs"`
+	ItemSize             uint64               `json:"itemSize"`
+	ModificationTimeSec  int64                `json:"modificationTime_sec"`
+	ModificationTimeNsec int64                `json:"modificationTime_nsec"`
+	ChangeTimeSec        int64                `json:"changeTime_sec"`
+	ChangeTimeNsec       int64                `json:"changeTime_nsec"`
+	CreationTimeSec      int64                `json:"creationTime_sec"`
+	CreationTimeNsec     int64                `json:"creationTime_nsec"`
+	Mode                 uint32               `json:"mac_st_mode"`
+	Uid                  int32                `json:"mac_st_uid"`
+	Gid                  int32                `json:"mac_st_gid"`
+}
+
+func (n arq7Node) toNode() *arq_types.Node {
+	return &arq_types.Node{
+		IsTree:               &arq_types.Boolean{IsPresent: true, Data: n.IsTree},
+		TreeBlobLoc:          n.TreeBlobLoc,
+		DataBlobLocs:         n.DataBlobLocs,
+		UncompressedDataSize: n.ItemSize,
+		MtimeSec:             n.ModificationTimeSec,
+		MtimeNsec:            n.ModificationTimeNsec,
+		CtimeSec:             n.ChangeTimeSec,
+		CtimeNsec:            n.ChangeTimeNsec,
+		CreateTimeSec:        n.CreationTimeSec,
+		CreateTimeNsec:       n.CreationTimeNsec,
+		Mode:                 os.FileMode(n.Mode),
+		Uid:                  n.Uid,
+		Gid:                  n.Gid,
+	}
+}
+
+type arq7BackupRecord struct {
+	LocalPath    string   `json:"localPath"`
+	CreationDate float64  `json:"creationDate"`
+	IsComplete   bool     `json:"isComplete"`
+	Node         arq7Node `json:"node"`
+
+	// The digits of the backup record's directory and name, which aren't part of the JSON
+	id string
+}
+
+func newArq7BackupSet(ctx context.Context, connection connector.Connection, password []byte, uuid string) (*ArqBackupSet, error) {
+	var err error
+	abs := ArqBackupSet{
+		Connection: connection,
+		UUID:       uuid,
+		Format:     BACKUP_FORMAT_ARQ7,
+	}
+
+	var config arq7BackupConfig
+	if err = abs.readArq7JSON(ctx, path.Join(uuid, "backupconfig.json"), false, &config); err != nil {
+		log.Debugln("Failed during newArq7BackupSet reading backupconfig.json: ", err)
+		return nil, newArqBackupSetError(uuid, BACKUP_SET_STATUS_UNPARSABLE, err)
+	}
+	if config.IsEncrypted {
+		keySet, err := abs.getEncryptedKeySet(ctx, password)
+		if err != nil {
+			log.Debugln("Failed during newArq7BackupSet getEncryptedKeySet: ", err)
+			return nil, newArqBackupSetError(uuid, BACKUP_SET_STATUS_UNPARSABLE, err)
+		}
+		abs.BlobDecrypter = crypto.VersionedDecrypter{V3: keySet}
+		abs.BucketDecrypter = abs.BlobDecrypter
+		abs.BlobSHA1Salt = keySet.BlobSHA1Salt
+	}
+	abs.ComputerInfo = &ArqComputerInfo{ComputerName: config.ComputerName}
+
+	if abs.Buckets, err = abs.getArq7Buckets(ctx); err != nil {
+		log.Debugln("Failed during newArq7BackupSet getArq7Buckets: ", err)
+		return nil, newArqBackupSetError(uuid, BACKUP_SET_STATUS_UNPARSABLE, err)
+	}
+	return &abs, nil
+}
+
+func (abs *ArqBackupSet) getEncryptedKeySet(ctx context.Context, password []byte) (*crypto.EncryptionV3, error) {
+	filepath, err := abs.getVerifiedObject(ctx, path.Join(abs.UUID, "encryptedkeyset.dat"))
+	if err != nil {
+		log.Debugln("Failed to get encryptedkeyset.dat", err)
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		log.Debugln("Failed to read encryptedkeyset.dat from file: ", err)
+		return nil, err
+	}
+	keySet, err := crypto.NewEncryptedKeySet(password, data)
+	if err != nil {
+		log.Debugf("Failed to decrypt encryptedkeyset.dat for backup set %s: %s", abs.UUID, err)
+		return nil, err
+	}
+	return keySet, nil
+}
+
+/*
+Decrypt data if it's an ARQO object. Unencrypted backup sets store plaintext.
+*/
+func (abs *ArqBackupSet) decryptArq7(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(crypto.ARQO_HEADER)) {
+		return data, nil
+	}
+	if abs.BlobDecrypter == nil {
+		return nil, errors.New(fmt.Sprintf("Backup set %s isn't encrypted but has an encrypted object", abs.UUID))
+	}
+	return abs.BlobDecrypter.Decrypt(data)
+}
+
+func (abs *ArqBackupSet) readArq7JSON(ctx context.Context, key string, isCompressed bool, v interface{}) error {
+	filepath, err := abs.getVerifiedObject(ctx, key)
+	if err != nil {
+		log.Debugf("readArq7JSON failed to get %s: %s", key, err)
+		return err
+	}
+	data, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		log.Debugf("readArq7JSON failed to read %s: %s", filepath, err)
+		return err
+	}
+	if data, err = abs.decryptArq7(data); err != nil {
+		log.Debugf("readArq7JSON failed to decrypt %s: %s", key, err)
+		return err
+	}
+	if isCompressed {
+		if data, err = decompressArq7LZ4(data); err != nil {
+			log.Debugf("readArq7JSON failed to decompress %s: %s", key, err)
+			return err
+		}
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		err2 := errors.New(fmt.Sprintf("Failed to parse %s as JSON: %s", key, err))
+		log.Debugf("%s", err2)
+		return err2
+	}
+	return nil
+}
+
+func (abs *ArqBackupSet) getArq7Buckets(ctx context.Context) ([]*ArqBucket, error) {
+	objects, err := abs.Connection.ListObjectsAsFolders(ctx, abs.UUID+"/backupfolders/")
+	if err != nil {
+		log.Debugln("Failed to get backup folders for ArqBackupSet: ", err)
+		return nil, err
+	}
+	buckets := make([]*ArqBucket, 0)
+	for _, object := range objects {
+		folderUUID := path.Base(object.GetPath())
+		var folder arq7BackupFolder
+		key := path.Join(abs.UUID, "backupfolders", folderUUID, "backupfolder.json")
+		if err := abs.readArq7JSON(ctx, key, false, &folder); err != nil {
+			log.Debugln("Failed to get ArqBucket for object: ", object)
+			continue
+		}
+		buckets = append(buckets, &ArqBucket{
+			Object:       object,
+			UUID:         folderUUID,
+			LocalPath:    folder.LocalPath,
+			ArqBackupSet: abs,
+		})
+	}
+	return buckets, nil
+}
+
+/*
+Backup records are stored under backuprecords/<first 5 digits>/<remaining digits>.backuprecord, where the
+digits are the creation time, so the latest one is the highest number in the highest directory.
+*/
+func (ab *ArqBucket) getArq7BackupRecord(ctx context.Context) (*arq7BackupRecord, error) {
+	if ab.arq7BackupRecord != nil {
+		return ab.arq7BackupRecord, nil
+	}
+	directoryNames, err := ab.listArq7BackupRecordDirectories(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(directoryNames) - 1; i >= 0; i-- {
+		names, err := ab.listArq7BackupRecordNames(ctx, directoryNames[i])
+		if err != nil {
+			return nil, err
+		}
+		if len(names) == 0 {
+			continue
+		}
+		record, err := ab.readArq7BackupRecord(ctx, directoryNames[i], names[len(names)-1])
+		if err != nil {
+			return nil, err
+		}
+		if !record.IsComplete {
+			log.Warnf("Latest backup record for %s is incomplete, some files may be missing", ab.LocalPath)
+		}
+		ab.arq7BackupRecord = record
+		return ab.arq7BackupRecord, nil
+	}
+	return nil, errors.New(fmt.Sprintf("No backup records found for folder %s", ab.UUID))
+}
+
+func (ab *ArqBucket) getArq7BackupRecordsPrefix() string {
+	return path.Join(ab.ArqBackupSet.UUID, "backupfolders", ab.UUID, "backuprecords") + "/"
+}
+
+/*
+Numerically sorted names of the directories of backup records.
+*/
+func (ab *ArqBucket) listArq7BackupRecordDirectories(ctx context.Context) ([]string, error) {
+	directories, err := ab.ArqBackupSet.Connection.ListObjectsAsFolders(ctx, ab.getArq7BackupRecordsPrefix())
+	if err != nil {
+		log.Debugf("Failed to list backup record directories for %s: %s", ab, err)
+		return nil, err
+	}
+	directoryNames := make([]string, 0, len(directories))
+	for _, directory := range directories {
+		directoryNames = append(directoryNames, path.Base(directory.GetPath()))
+	}
+	sortNumerically(directoryNames)
+	return directoryNames, nil
+}
+
+/*
+Numerically sorted names of the backup records in a directory, without their suffix.
+*/
+func (ab *ArqBucket) listArq7BackupRecordNames(ctx context.Context, directoryName string) ([]string, error) {
+	objects, err := ab.ArqBackupSet.Connection.ListObjectsAsAll(ctx, ab.getArq7BackupRecordsPrefix()+directoryName+"/")
+	if err != nil {
+		log.Debugf("Failed to list backup records in %s: %s", directoryName, err)
+		return nil, err
+	}
+	names := make([]string, 0, len(objects))
+	for _, object := range objects {
+		if strings.HasSuffix(object.GetPath(), ARQ7_BACKUP_RECORD_SUFFIX) {
+			names = append(names, strings.TrimSuffix(path.Base(object.GetPath()), ARQ7_BACKUP_RECORD_SUFFIX))
+		}
+	}
+	sortNumerically(names)
+	return names, nil
+}
+
+func (ab *ArqBucket) readArq7BackupRecord(ctx context.Context, directoryName string, name string) (*arq7BackupRecord, error) {
+	key := ab.getArq7BackupRecordsPrefix() + directoryName + "/" + name + ARQ7_BACKUP_RECORD_SUFFIX
+	var record arq7BackupRecord
+	if err := ab.ArqBackupSet.readArq7JSON(ctx, key, true, &record); err != nil {
+		log.Debugf("Failed to read backup record %s: %s", key, err)
+		return nil, err
+	}
+	record.id = directoryName + name
+	return &record, nil
+}
+
+func sortNumerically(names []string) {
+	sort.Slice(names, func(i, j int) bool {
+		a, errA := strconv.ParseUint(names[i], 10, 64)
+		b, errB := strconv.ParseUint(names[j], 10, 64)
+		if errA != nil || errB != nil {
+			return names[i] < names[j]
+		}
+		return a < b
+	})
+}
+
+/*
+Return the decrypted and decompressed contents of a blob. Large packs are read with ranged requests if
+the connection supports them, everything else is cached whole because packs are shared by many blobs.
+*/
+func (abs *ArqBackupSet) readArq7Blob(ctx context.Context, blobLoc *arq_types.BlobLoc) ([]byte, error) {
+	key := strings.TrimPrefix(blobLoc.RelativePath, "/")
+	if !strings.HasPrefix(key, abs.UUID+"/") {
+		key = path.Join(abs.UUID, key)
+	}
+	var data []byte
+	rangeConnection, isRangeConnection := abs.Connection.(connector.RangeConnection)
+	if blobLoc.IsPacked && blobLoc.IsLargePack && isRangeConnection {
+		r, err := rangeConnection.GetRange(ctx, key, int64(blobLoc.Offset), int64(blobLoc.Length))
+		if err != nil {
+			log.Debugf("readArq7Blob failed to get range of %s: %s", key, err)
+			return nil, err
+		}
+		defer r.Close()
+		if data, err = ioutil.ReadAll(r); err != nil {
+			return nil, err
+		}
+	} else {
+		// a pack is too big to checksum for every blob read from it, a corrupt blob fails to decrypt or
+		// decompress instead
+		getObject := abs.Connection.CachedGet
+		if !blobLoc.IsPacked {
+			getObject = abs.getVerifiedObject
+		}
+		filepath, err := getObject(ctx, key)
+		if err != nil {
+			log.Debugf("readArq7Blob failed to get %s: %s", key, err)
+			return nil, err
+		}
+		if !blobLoc.IsPacked {
+			if data, err = ioutil.ReadFile(filepath); err != nil {
+				return nil, err
+			}
+		} else {
+			f, err := os.Open(filepath)
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			data = make([]byte, blobLoc.Length)
+			if _, err = f.ReadAt(data, int64(blobLoc.Offset)); err != nil {
+				log.Debugf("readArq7Blob failed to read %s from pack %s: %s", blobLoc, filepath, err)
+				return nil, err
+			}
+		}
+	}
+	if uint64(len(data)) != blobLoc.Length && blobLoc.IsPacked {
+		return nil, errors.New(fmt.Sprintf("readArq7Blob got %d bytes for %s", len(data), blobLoc))
+	}
+
+	data, err := abs.decryptArq7(data)
+	if err != nil {
+		log.Debugf("readArq7Blob failed to decrypt %s: %s", blobLoc, err)
+		return nil, err
+	}
+	switch blobLoc.CompressionType {
+	case arq_types.COMPRESSION_TYPE_NONE:
+		return data, nil
+	case arq_types.COMPRESSION_TYPE_GZIP:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	case arq_types.COMPRESSION_TYPE_LZ4:
+		return decompressArq7LZ4(data)
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown compression type %d for %s", blobLoc.CompressionType, blobLoc))
+	}
+}
+
+/*
+Read the tree that node points at. Arq 7 trees don't carry their own metadata, so copy it from the node.
+*/
+func (abs *ArqBackupSet) readArq7Tree(ctx context.Context, node *arq_types.Node) (*arq_types.Tree, error) {
+	if node.TreeBlobLoc == nil {
+		return nil, errors.New(fmt.Sprintf("Node %s has no tree", node.Name))
+	}
+	data, err := abs.readArq7Blob(ctx, node.TreeBlobLoc)
+	if err != nil {
+		log.Debugf("readArq7Tree failed to read tree blob: %s", err)
+		return nil, err
+	}
+	tree, err := arq_types.ReadArq7Tree(bytes.NewBuffer(data))
+	if err != nil {
+		log.Debugf("readArq7Tree failed to parse tree: %s", err)
+		return nil, err
+	}
+	tree.Mode = node.Mode
+	tree.Uid = node.Uid
+	tree.Gid = node.Gid
+	tree.MtimeSec = node.MtimeSec
+	tree.MtimeNsec = node.MtimeNsec
+	tree.CtimeSec = node.CtimeSec
+	tree.CtimeNsec = node.CtimeNsec
+	tree.CreateTimeSec = node.CreateTimeSec
+	tree.CreateTimeNsec = node.CreateTimeNsec
+	return tree, nil
+}
+
+func findArq7Node(ctx context.Context, backupSet *ArqBackupSet, bucket *ArqBucket, targetPath string) (*arq_types.Tree, *arq_types.Node, error) {
+	record, err := bucket.getArq7BackupRecord(ctx)
+	if err != nil {
+		log.Debugf("findArq7Node failed to get backup record: %s", err)
+		return nil, nil, err
+	}
+	rootPath := record.LocalPath
+	if rootPath == "" {
+		rootPath = bucket.LocalPath
+	}
+	if !strings.HasPrefix(targetPath, rootPath) {
+		err := errors.New(fmt.Sprintf("Target path %s is not located within backup record path %s", targetPath, rootPath))
+		log.Errorf("%s", err)
+		return nil, nil, err
+	}
+	tree, err := backupSet.readArq7Tree(ctx, record.Node.toNode())
+	if err != nil {
+		return nil, nil, err
+	}
+	relativePath := strings.Trim(path.Clean("/"+strings.TrimPrefix(targetPath, rootPath)), "/")
+	if relativePath == "" {
+		return tree, nil, nil
+	}
+
+	var currentNode *arq_types.Node
+	elements := strings.Split(relativePath, "/")
+	for i, element := range elements {
+		currentNode = nil
+		for _, node := range tree.Nodes {
+			if node.Name.Equal(element) {
+				currentNode = node
+			}
+		}
+		if currentNode == nil {
+			err := errors.New(fmt.Sprintf("Failed to find targetPath: %s", targetPath))
+			log.Debugf("%s", err)
+			return nil, nil, err
+		}
+		if !currentNode.IsTree.IsTrue() {
+			if i != len(elements)-1 {
+				err := errors.New(fmt.Sprintf("Failed to find targetPath: %s, %s is a file", targetPath, element))
+				log.Debugf("%s", err)
+				return nil, nil, err
+			}
+			return nil, currentNode, nil
+		}
+		if tree, err = backupSet.readArq7Tree(ctx, currentNode); err != nil {
+			return nil, nil, err
+		}
+	}
+	return tree, currentNode, nil
+}
+
+/*
+Reads a file whose chunks are Arq 7 blobs.
+*/
+type BlobLocsReader struct {
+	*chunkReader
+	ctx       context.Context
+	blobLocs  []*arq_types.BlobLoc
+	backupSet *ArqBackupSet
+}
+
+func getReaderForBlobLocs(ctx context.Context, blobLocs []*arq_types.BlobLoc, size int64, backupSet *ArqBackupSet) *BlobLocsReader {
+	r := &BlobLocsReader{
+		ctx:       ctx,
+		blobLocs:  blobLocs,
+		backupSet: backupSet,
+	}
+	r.chunkReader = newChunkReader(r, size)
+	return r
+}
+
+func (r *BlobLocsReader) chunkCount() int {
+	return len(r.blobLocs)
+}
+
+func (r *BlobLocsReader) chunkID(i int) string {
+	return r.blobLocs[i].BlobIdentifier
+}
+
+func (r *BlobLocsReader) readChunk(i int) ([]byte, error) {
+	contents, err := r.backupSet.readArq7Blob(r.ctx, r.blobLocs[i])
+	if err != nil {
+		err2 := errors.New(fmt.Sprintf("Couldn't read blob %s: %s", r.blobLocs[i], err))
+		log.Debugf("%s", err2)
+		return nil, err2
+	}
+	return contents, nil
+}
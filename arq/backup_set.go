@@ -20,17 +20,22 @@ Copyright 2015 Asim Ihsan
 package arq
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"io/ioutil"
 	"os"
+	"path"
 	"regexp"
 	"runtime"
+	"sync"
 
 	"github.com/mattn/go-plist"
 
 	"github.com/asimihsan/arqinator/connector"
 	"github.com/asimihsan/arqinator/crypto"
+	"github.com/asimihsan/arqinator/progress"
 	"strings"
 )
 
@@ -38,76 +43,286 @@ var (
 	UUID_REGEXP = regexp.MustCompile("[a-zA-Z0-9-]{32,}")
 )
 
+/*
+Arq 4 and 5 share a storage layout of commits, trees and pack indexes. Arq 6 and 7 use a different layout
+of JSON backup records and BlobLocs, see arq7.go.
+*/
+type BackupFormat string
+
+const (
+	BACKUP_FORMAT_ARQ5 BackupFormat = "arq5"
+	BACKUP_FORMAT_ARQ7 BackupFormat = "arq7"
+)
+
+/*
+Whether a backup set could be read, as reported by GetAllArqBackupSets.
+*/
+type BackupSetStatus string
+
+const (
+	BACKUP_SET_STATUS_DECRYPTED            BackupSetStatus = "decrypted"
+	BACKUP_SET_STATUS_WRONG_PASSWORD       BackupSetStatus = "wrong password"
+	BACKUP_SET_STATUS_MISSING_SALT         BackupSetStatus = "missing salt"
+	BACKUP_SET_STATUS_MISSING_COMPUTERINFO BackupSetStatus = "missing computerinfo"
+	BACKUP_SET_STATUS_UNPARSABLE           BackupSetStatus = "unparsable"
+)
+
+/*
+Why a backup set couldn't be read. A wrong password is told apart from a damaged backup set by the
+crypto package's WrongPasswordError, so Status is upgraded to BACKUP_SET_STATUS_WRONG_PASSWORD whenever
+Err is one.
+*/
+type ArqBackupSetError struct {
+	UUID   string
+	Status BackupSetStatus
+	Err    error
+}
+
+func newArqBackupSetError(uuid string, status BackupSetStatus, err error) *ArqBackupSetError {
+	if crypto.IsWrongPassword(err) {
+		status = BACKUP_SET_STATUS_WRONG_PASSWORD
+	}
+	return &ArqBackupSetError{UUID: uuid, Status: status, Err: err}
+}
+
+func (e *ArqBackupSetError) Error() string {
+	return fmt.Sprintf("backup set %s: %s: %s", e.UUID, e.Status, e.Err)
+}
+
+/*
+One UUID-shaped prefix in the account. BackupSet is nil unless Status is BACKUP_SET_STATUS_DECRYPTED,
+otherwise Err says why.
+*/
+type ArqBackupSetResult struct {
+	UUID      string
+	Status    BackupSetStatus
+	BackupSet *ArqBackupSet
+	Err       *ArqBackupSetError
+}
+
 type ArqBackupSet struct {
 	Connection      connector.Connection
 	UUID            string
+	Format          BackupFormat
 	ComputerInfo    *ArqComputerInfo
 	Buckets         []*ArqBucket
-	BlobDecrypter   *crypto.CryptoState
-	BucketDecrypter *crypto.CryptoState
+	BlobDecrypter   crypto.Decrypter
+	BucketDecrypter crypto.Decrypter
+
+	// Arq 5 prepends this to data before computing its SHA1 blob key. nil for Arq 4.
+	BlobSHA1Salt []byte
+
+	// Pack indexes read so far, by pack set prefix
+	packSets      map[string]*packSetIndexes
+	packSetsMutex sync.Mutex
 }
 
-func GetArqBackupSets(connection connector.Connection, password []byte) ([]*ArqBackupSet, error) {
-	prefix := ""
-	objects, err := connection.ListObjectsAsFolders(prefix)
+/*
+Marker files and folders found at the top of a backup set, which identify its storage format. Object
+stores like S3 only list folders, whereas SFTP and WebDAV also list files, so check for both.
+*/
+var backupFormatMarkers = map[string]BackupFormat{
+	"backupconfig.json": BACKUP_FORMAT_ARQ7,
+	"backupfolders":     BACKUP_FORMAT_ARQ7,
+	"encryptionv3.dat":  BACKUP_FORMAT_ARQ5,
+	"salt":              BACKUP_FORMAT_ARQ5,
+	"computerinfo":      BACKUP_FORMAT_ARQ5,
+	"bucketdata":        BACKUP_FORMAT_ARQ5,
+	"buckets":           BACKUP_FORMAT_ARQ5,
+	"packsets":          BACKUP_FORMAT_ARQ5,
+}
+
+/*
+Probe the top of a backup set for the markers of each storage format. Arq 7 markers win, as a computer
+that was upgraded from Arq 5 to Arq 7 keeps its old folders alongside the new ones.
+*/
+func DetectBackupFormat(ctx context.Context, connection connector.Connection, uuid string) (BackupFormat, error) {
+	objects, err := connection.ListObjectsAsFolders(ctx, uuid+"/")
+	if err != nil {
+		log.Debugf("DetectBackupFormat failed to list %s: %s", uuid, err)
+		return "", err
+	}
+	var detected BackupFormat
+	for _, object := range objects {
+		format, ok := backupFormatMarkers[path.Base(object.GetPath())]
+		if !ok {
+			continue
+		}
+		if format == BACKUP_FORMAT_ARQ7 {
+			return format, nil
+		}
+		detected = format
+	}
+	if detected == "" {
+		return "", errors.New(fmt.Sprintf("DetectBackupFormat found no format markers under %s", uuid))
+	}
+	return detected, nil
+}
+
+/*
+Human readable Arq version for a backup set's format. Arq 5 backup sets have encryptionv3.dat master keys,
+and hence a blob key salt; Arq 4 backup sets don't.
+*/
+func (abs *ArqBackupSet) FormatVersion() string {
+	switch {
+	case abs.Format == BACKUP_FORMAT_ARQ7:
+		return "Arq 6/7"
+	case abs.BlobSHA1Salt != nil:
+		return "Arq 5"
+	default:
+		return "Arq 4"
+	}
+}
+
+/*
+Returns only the backup sets that could be decrypted with passwords. Use GetAllArqBackupSets to find
+out why the others couldn't.
+*/
+func GetArqBackupSets(ctx context.Context, connection connector.Connection, passwords *Passwords) ([]*ArqBackupSet, error) {
+	results, err := GetAllArqBackupSets(ctx, connection, passwords)
 	if err != nil {
-		log.Debugln("Failed to get buckets for GetArqBackupSets: ", err)
 		return nil, err
 	}
 	arqBackupSets := make([]*ArqBackupSet, 0)
+	for _, result := range results {
+		if result.Status != BACKUP_SET_STATUS_DECRYPTED {
+			log.Debugf("Error during GetArqBackupSets: %s", result.Err)
+			continue
+		}
+		arqBackupSets = append(arqBackupSets, result.BackupSet)
+	}
+	return arqBackupSets, nil
+}
+
+func GetAllArqBackupSets(ctx context.Context, connection connector.Connection, passwords *Passwords) ([]*ArqBackupSetResult, error) {
+	prefix := ""
+	objects, err := connection.ListObjectsAsFolders(ctx, prefix)
+	if err != nil {
+		log.Debugln("Failed to get buckets for GetAllArqBackupSets: ", err)
+		return nil, err
+	}
+	results := make([]*ArqBackupSetResult, 0)
 	for _, object := range objects {
 		if !UUID_REGEXP.MatchString(object.GetPath()) {
 			log.Debugf("folder %s is not UUID, can't be backup set, so skipping", object.GetPath())
 			continue
 		}
-		arqBackupSet, err := NewArqBackupSet(connection, password, object.GetPath())
+		result := &ArqBackupSetResult{UUID: object.GetPath()}
+		results = append(results, result)
+
+		format, err := DetectBackupFormat(ctx, connection, object.GetPath())
 		if err != nil {
-			log.Debugf("Error during GetArqBackupSets for object %s: %s", object, err)
+			log.Debugf("Error during GetAllArqBackupSets for object %s: %s", object, err)
+			result.Err = newArqBackupSetError(object.GetPath(), BACKUP_SET_STATUS_UNPARSABLE, err)
+			result.Status = result.Err.Status
 			continue
 		}
-		arqBackupSets = append(arqBackupSets, arqBackupSet)
+		log.Debugf("GetAllArqBackupSets detected format %s for %s", format, object.GetPath())
+		computerName := peekComputerName(ctx, connection, object.GetPath(), format)
+		// A wrong Arq 4 password passes the padding check now and then, and then fails to parse rather than
+		// being reported as wrong, so try every candidate whatever the error.
+		var arqBackupSet *ArqBackupSet
+		var firstErr error
+		for i, password := range passwords.passwordsFor(object.GetPath(), computerName) {
+			if format == BACKUP_FORMAT_ARQ7 {
+				arqBackupSet, err = newArq7BackupSet(ctx, connection, password, object.GetPath())
+			} else {
+				arqBackupSet, err = NewArqBackupSet(ctx, connection, password, object.GetPath())
+			}
+			if err == nil {
+				break
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			if ctx.Err() != nil {
+				break
+			}
+			log.Debugf("GetAllArqBackupSets password %d failed for %s: %s", i, object.GetPath(), err)
+		}
+		if err != nil {
+			err = firstErr
+			log.Debugf("Error during GetAllArqBackupSets for object %s: %s", object, err)
+			backupSetErr, ok := err.(*ArqBackupSetError)
+			if !ok {
+				backupSetErr = newArqBackupSetError(object.GetPath(), BACKUP_SET_STATUS_UNPARSABLE, err)
+			}
+			result.Err = backupSetErr
+			result.Status = backupSetErr.Status
+			continue
+		}
+		result.Status = BACKUP_SET_STATUS_DECRYPTED
+		result.BackupSet = arqBackupSet
 	}
-	return arqBackupSets, nil
+	// a cancelled backup set would otherwise look unparsable
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
 }
 
-func NewArqBackupSet(connection connector.Connection, password []byte, uuid string) (*ArqBackupSet, error) {
+func NewArqBackupSet(ctx context.Context, connection connector.Connection, password []byte, uuid string) (*ArqBackupSet, error) {
 	var err error
 	abs := ArqBackupSet{
-		Connection:   connection,
-		UUID:         uuid,
+		Connection: connection,
+		UUID:       uuid,
+		Format:     BACKUP_FORMAT_ARQ5,
 	}
 
-	// Regular objects (commits, trees, blobs) use a random "salt" stored in backup
-	var salt []byte
-	if salt, err = abs.getSalt(); err != nil {
-		log.Debugln("Failed during NewArqBackupSet getSalt: ", err)
-		return nil, err
+	// Arq 5 objects are encrypted with master keys stored in encryptionv3.dat. Backup sets upgraded from
+	// Arq 4 may also still have objects encrypted the old way.
+	blobDecrypter := crypto.VersionedDecrypter{}
+	bucketDecrypter := crypto.VersionedDecrypter{}
+	encryptionV3, err := abs.getEncryptionV3(ctx, password)
+	if err != nil {
+		log.Debugln("Failed during NewArqBackupSet getEncryptionV3: ", err)
+		return nil, newArqBackupSetError(uuid, BACKUP_SET_STATUS_UNPARSABLE, err)
 	}
-	if abs.BlobDecrypter, err = crypto.NewCryptoState(password, salt); err != nil {
-		log.Debugln("Failed during NewArqBackupSet NewCryptoState for BlobDecrypter: ", err)
-		return nil, err
+	if encryptionV3 != nil {
+		blobDecrypter.V3 = encryptionV3
+		bucketDecrypter.V3 = encryptionV3
+		abs.BlobSHA1Salt = encryptionV3.BlobSHA1Salt
 	}
 
-	// Arq Buckets (the folders) use a fixed salt. See arq_restore/Bucket.m.
-	if abs.BucketDecrypter, err = crypto.NewCryptoState(password, []byte("BucketPL")); err != nil {
-		log.Debugln("Failed during NewArqBackupSet NewCryptoState for BucketDecrypter: ", err)
-		return nil, err
+	// Regular objects (commits, trees, blobs) use a random "salt" stored in backup
+	var salt []byte
+	if salt, err = abs.getSalt(ctx); err != nil {
+		if encryptionV3 == nil || !os.IsNotExist(err) {
+			log.Debugln("Failed during NewArqBackupSet getSalt: ", err)
+			return nil, newArqBackupSetError(uuid, BACKUP_SET_STATUS_MISSING_SALT, err)
+		}
+		log.Debugf("Backup set %s has encryptionv3.dat but no salt, assuming no Arq 4 objects", uuid)
+	} else {
+		if blobDecrypter.Legacy, err = crypto.NewCryptoState(password, salt); err != nil {
+			log.Debugln("Failed during NewArqBackupSet NewCryptoState for BlobDecrypter: ", err)
+			return nil, err
+		}
+
+		// Arq Buckets (the folders) use a fixed salt. See arq_restore/Bucket.m.
+		if bucketDecrypter.Legacy, err = crypto.NewCryptoState(password, []byte("BucketPL")); err != nil {
+			log.Debugln("Failed during NewArqBackupSet NewCryptoState for BucketDecrypter: ", err)
+			return nil, err
+		}
 	}
+	abs.BlobDecrypter = blobDecrypter
+	abs.BucketDecrypter = bucketDecrypter
 
-	if abs.ComputerInfo, err = abs.getComputerInfo(); err != nil {
+	if abs.ComputerInfo, err = abs.getComputerInfo(ctx); err != nil {
 		log.Debugln("Failed during NewArqBackupSet getComputerInfo: ", err)
 		return nil, err
 	}
 
-	if abs.Buckets, err = abs.getBuckets(); err != nil {
+	// The buckets are the first objects decrypted with the password, so if it's wrong this is where an Arq 4
+	// backup set fails.
+	if abs.Buckets, err = abs.getBuckets(ctx); err != nil {
 		log.Debugln("Failed during NewArqBackupSet getBuckets: ", err)
-		return nil, err
+		return nil, newArqBackupSetError(uuid, BACKUP_SET_STATUS_UNPARSABLE, err)
 	}
 
 	return &abs, nil
 }
 
-func (abs ArqBackupSet) String() string {
+func (abs *ArqBackupSet) String() string {
 	return fmt.Sprintf("{ArqBackupSet: Connection=%s, UUID=%s, ComputerInfo=%s, Buckets=%s}",
 		abs.Connection, abs.UUID, abs.ComputerInfo, abs.Buckets)
 }
@@ -121,9 +336,81 @@ func (aci ArqComputerInfo) String() string {
 	return fmt.Sprintf("{ArqComputerInfo: UserName=%s, ComputerName=%s}", aci.UserName, aci.ComputerName)
 }
 
-func (abs *ArqBackupSet) getSalt() ([]byte, error) {
+/*
+CachedGet key, and download it again if the cached copy no longer matches the checksum it was downloaded
+with. For objects that, unlike packs, have no structure of their own to validate. Cache files without a
+checksum can't be verified and are used as they are.
+*/
+func (abs *ArqBackupSet) getVerifiedObject(ctx context.Context, key string) (string, error) {
+	cacheFilepath, err := abs.Connection.CachedGet(ctx, key)
+	if err != nil {
+		return cacheFilepath, err
+	}
+	if err = connector.VerifyCacheFile(cacheFilepath); err == nil || os.IsNotExist(err) {
+		return cacheFilepath, nil
+	} else if err != connector.ErrorCacheChecksumMismatch {
+		log.Debugf("getVerifiedObject failed to verify %s: %s", key, err)
+		return cacheFilepath, err
+	}
+	log.Warnf("Cached copy of %s is corrupt, downloading it again: %s", key, err)
+	isValid := func(cacheFilepath string) (bool, error) {
+		err := connector.VerifyCacheFile(cacheFilepath)
+		return err == nil, err
+	}
+	if err = abs.removeInvalidCacheFile(ctx, key, cacheFilepath, isValid); err != nil {
+		return cacheFilepath, err
+	}
+	return abs.Connection.CachedGet(ctx, key)
+}
+
+/*
+Delete the cached copy of key, so that it's downloaded again, if it's still invalid once no other
+process is downloading it. Another process that found it invalid too may already have replaced it.
+*/
+func (abs *ArqBackupSet) removeInvalidCacheFile(ctx context.Context, key string, cacheFilepath string,
+	isValid func(cacheFilepath string) (bool, error)) error {
+	unlock, err := connector.LockCacheFile(ctx, abs.Connection.GetCacheDirectory(), key)
+	if err != nil {
+		log.Debugf("removeInvalidCacheFile failed to lock %s: %s", key, err)
+		return err
+	}
+	defer unlock()
+	if valid, _ := isValid(cacheFilepath); valid {
+		return nil
+	}
+	return connector.RemoveCacheFile(cacheFilepath)
+}
+
+/*
+Returns nil if the backup set has no encryptionv3.dat, i.e. it was created by Arq 4. Any other failure to
+download it is returned, rather than decrypting with the wrong scheme.
+*/
+func (abs *ArqBackupSet) getEncryptionV3(ctx context.Context, password []byte) (*crypto.EncryptionV3, error) {
+	key := abs.UUID + "/encryptionv3.dat"
+	filepath, err := abs.getVerifiedObject(ctx, key)
+	if os.IsNotExist(err) {
+		log.Debugf("No encryptionv3.dat for backup set %s, assuming Arq 4: %s", abs.UUID, err)
+		return nil, nil
+	} else if err != nil {
+		log.Debugf("Failed to get encryptionv3.dat for backup set %s: %s", abs.UUID, err)
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		log.Debugln("Failed to read encryptionv3.dat from file: ", err)
+		return nil, err
+	}
+	encryptionV3, err := crypto.NewEncryptionV3(password, data)
+	if err != nil {
+		log.Debugf("Failed to decrypt encryptionv3.dat for backup set %s: %s", abs.UUID, err)
+		return nil, err
+	}
+	return encryptionV3, nil
+}
+
+func (abs *ArqBackupSet) getSalt(ctx context.Context) ([]byte, error) {
 	key := abs.UUID + "/salt"
-	filepath, err := abs.Connection.CachedGet(key)
+	filepath, err := abs.getVerifiedObject(ctx, key)
 	if err != nil {
 		log.Debugln("Failed to get salt", err)
 		return nil, err
@@ -136,68 +423,97 @@ func (abs *ArqBackupSet) getSalt() ([]byte, error) {
 	return salt, err
 }
 
-func (abs *ArqBackupSet) getComputerInfo() (*ArqComputerInfo, error) {
+func (abs *ArqBackupSet) getComputerInfo(ctx context.Context) (*ArqComputerInfo, error) {
 	key := abs.UUID + "/computerinfo"
-	filepath, err := abs.Connection.CachedGet(key)
+	filepath, err := abs.getVerifiedObject(ctx, key)
 	if err != nil {
 		log.Debugln("Failed to get computerinfo", err)
-		return nil, err
+		return nil, newArqBackupSetError(abs.UUID, BACKUP_SET_STATUS_MISSING_COMPUTERINFO, err)
 	}
 	r, err := os.Open(filepath)
 	if err != nil {
 		log.Debugln("Failed to open computerinfo on disk")
-		return nil, err
+		return nil, newArqBackupSetError(abs.UUID, BACKUP_SET_STATUS_MISSING_COMPUTERINFO, err)
 	}
 	defer r.Close()
 	v, err := plist.Read(r)
 	if err != nil {
 		log.Debugln("Could not decode computerInfo", err)
-		return nil, err
+		return nil, newArqBackupSetError(abs.UUID, BACKUP_SET_STATUS_UNPARSABLE, err)
+	}
+	tree, ok := v.(plist.Dict)
+	if !ok {
+		return nil, newArqBackupSetError(abs.UUID, BACKUP_SET_STATUS_UNPARSABLE,
+			errors.New("computerinfo isn't a plist dictionary"))
 	}
-	tree := v.(plist.Dict)
+	userName, _ := tree["userName"].(string)
+	computerName, _ := tree["computerName"].(string)
 	return &ArqComputerInfo{
-		UserName:     tree["userName"].(string),
-		ComputerName: tree["computerName"].(string),
+		UserName:     userName,
+		ComputerName: computerName,
 	}, nil
 }
 
-func (abs *ArqBackupSet) CacheTreePackSets() error {
+func (abs *ArqBackupSet) CacheTreePackSets(ctx context.Context) error {
 	log.Debugln("CacheTreePackSets entry for ArqBackupSet: ", abs)
 	defer log.Debugln("CacheTreePackSets exit for ArqBackupSet: ", abs)
+	if abs.Format == BACKUP_FORMAT_ARQ7 {
+		// Arq 7 BlobLocs say exactly where each blob is, so there are no pack indexes to cache.
+		return nil
+	}
 	for i := range abs.Buckets {
-		abs.cacheTreePackSet(abs.Buckets[i])
+		abs.cacheTreePackSet(ctx, abs.Buckets[i])
 	}
-	return nil
+	return ctx.Err()
 }
 
-func (abs *ArqBackupSet) CacheBlobPackSets() error {
+func (abs *ArqBackupSet) CacheBlobPackSets(ctx context.Context) error {
 	log.Debugln("CacheBlobPackSets entry for ArqBackupSet: ", abs)
 	defer log.Debugln("CacheBlobPackSets exit for ArqBackupSet: ", abs)
+	if abs.Format == BACKUP_FORMAT_ARQ7 {
+		// Arq 7 BlobLocs say exactly where each blob is, so there are no pack indexes to cache.
+		return nil
+	}
 	for i := range abs.Buckets {
-		abs.cacheBlobPackSet(abs.Buckets[i])
+		abs.cacheBlobPackSet(ctx, abs.Buckets[i])
 	}
-	return nil
+	return ctx.Err()
 }
 
-func (abs *ArqBackupSet) cacheBlobPackSet(ab *ArqBucket) error {
+func (abs *ArqBackupSet) cacheBlobPackSet(ctx context.Context, ab *ArqBucket) error {
+	if abs.Format == BACKUP_FORMAT_ARQ7 {
+		return nil
+	}
 	prefix := GetPathToBucketPackSetBlobs(abs, ab)
-	return abs.cachePackSet(ab, prefix)
+	return abs.cachePackSet(ctx, ab, prefix)
 }
 
-func (abs *ArqBackupSet) cacheTreePackSet(ab *ArqBucket) error {
+func (abs *ArqBackupSet) cacheTreePackSet(ctx context.Context, ab *ArqBucket) error {
+	if abs.Format == BACKUP_FORMAT_ARQ7 {
+		return nil
+	}
 	prefix := GetPathToBucketPackSetTrees(abs, ab)
-	return abs.cachePackSet(ab, prefix)
+	return abs.cachePackSet(ctx, ab, prefix)
 }
 
-func (abs *ArqBackupSet) cachePackSet(ab *ArqBucket, prefix string) error {
-	s3Objs, err := abs.Connection.ListObjectsAsAll(prefix)
+/*
+Download the pack indexes under prefix to the cache. If ctx is done the workers stop after their current
+download, which the connector removes from the cache, and ctx.Err() is returned. Indexes that were
+already downloaded stay cached, so the next call carries on from there.
+*/
+func (abs *ArqBackupSet) cachePackSet(ctx context.Context, ab *ArqBucket, prefix string) error {
+	s3Objs, err := abs.Connection.ListObjectsAsAll(ctx, prefix)
 	if err != nil {
 		log.Debugln("Failed to cacheTreePackSet for bucket: ", ab)
 		log.Debugln(err)
 		return err
 	}
+	tracker := progress.Current()
 	inputs := make(chan connector.Object, len(s3Objs))
 	for i := range s3Objs {
+		if strings.HasSuffix(s3Objs[i].GetPath(), ".index") {
+			tracker.Plan(1, s3Objs[i].GetSize())
+		}
 		inputs <- s3Objs[i]
 	}
 	close(inputs)
@@ -213,53 +529,95 @@ func (abs *ArqBackupSet) cachePackSet(ab *ArqBucket, prefix string) error {
 					continue
 				}
 				log.Debugln("cachePackSet will cache: ", inputObject.GetPath())
-
-				// here we request that the connector either download the file to the cache or ensure
-				// that the cached copy already exists. the connector promises to try to download the
-				// file, but cannot guarantee the file will be uncorrupted. it's up to us to verify
-				// that.
-				cacheFilepath, err := abs.Connection.CachedGet(inputObject.GetPath())
-				if err != nil {
-					log.Debugln("cachePackSet failed first time to get object: ", inputObject)
-					log.Debugln(err)
-				}
-
-				isValid, err := IsValidPackFile(cacheFilepath)
-				if !isValid {
-					log.Debugf("cachePackSet invalid pack file %s first time, will delete and retry. err: %s", cacheFilepath, err)
-					if err := os.Remove(cacheFilepath); err != nil {
-						log.Panicf("cachePackSet failed to delete pack file %s after detecting corruption. err: ", cacheFilepath, err)
-					}
-					cacheFilepath, err = abs.Connection.CachedGet(inputObject.GetPath())
-					if err != nil {
-						log.Debugf("cachePackSet failed second time to get object: ", inputObject)
-						log.Debugln(err)
-					}
-					isValid, err := IsValidPackFile(cacheFilepath)
-					if !isValid {
-						msg := fmt.Sprintf("cachePackSet invalid pack file %s second time, will not retry. err: %s", cacheFilepath, err)
-						log.Panicln(msg)
+				if _, err := abs.cachePackIndex(ctx, inputObject.GetPath()); err != nil {
+					if ctx.Err() != nil {
+						return
 					}
+					log.Panicln(err)
 				}
+				tracker.Complete(1, inputObject.GetSize())
 			}
 		}()
 	}
 	for i := 0; i < cap(c); i++ {
 		<-c
 	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	abs.setPackSetCached(prefix)
 	return nil
 }
 
-func (abs *ArqBackupSet) getBuckets() ([]*ArqBucket, error) {
+/*
+Download the pack index key to the cache, if it isn't already, and return its cache file. The connector
+can't tell whether what it downloaded is a valid index, so an invalid one is deleted and downloaded once
+more before giving up.
+*/
+func (abs *ArqBackupSet) cachePackIndex(ctx context.Context, key string) (string, error) {
+	cacheFilepath, err := abs.Connection.CachedGet(ctx, key)
+	if ctx.Err() != nil {
+		return cacheFilepath, ctx.Err()
+	}
+	if err != nil {
+		log.Debugf("cachePackIndex failed first time to get %s: %s", key, err)
+	}
+	isValid, err := IsValidPackFile(cacheFilepath)
+	if isValid {
+		return cacheFilepath, nil
+	}
+	log.Debugf("cachePackIndex invalid pack file %s first time, will delete and retry. err: %s", cacheFilepath, err)
+	if err := abs.removeInvalidCacheFile(ctx, key, cacheFilepath, IsValidPackFile); err != nil {
+		log.Debugf("cachePackIndex failed to delete pack file %s after detecting corruption: %s", cacheFilepath, err)
+		return cacheFilepath, err
+	}
+	cacheFilepath, err = abs.Connection.CachedGet(ctx, key)
+	if ctx.Err() != nil {
+		return cacheFilepath, ctx.Err()
+	}
+	if err != nil {
+		log.Debugf("cachePackIndex failed second time to get %s: %s", key, err)
+	}
+	if isValid, err = IsValidPackFile(cacheFilepath); !isValid {
+		return cacheFilepath, errors.New(fmt.Sprintf("cachePackIndex invalid pack file %s second time, will not retry. err: %s",
+			cacheFilepath, err))
+	}
+	return cacheFilepath, nil
+}
+
+/*
+Download the pack indexes keys in parallel, and return their cache files in the same order.
+*/
+func (abs *ArqBackupSet) cachePackIndexes(ctx context.Context, keys []string) ([]string, error) {
+	cacheFilepaths := make([]string, len(keys))
+	errs := make([]error, len(keys))
+	var wg sync.WaitGroup
+	for i := range keys {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cacheFilepaths[i], errs[i] = abs.cachePackIndex(ctx, keys[i])
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cacheFilepaths, nil
+}
+
+func (abs *ArqBackupSet) getBuckets(ctx context.Context) ([]*ArqBucket, error) {
 	prefix := abs.UUID + "/buckets"
-	objects, err := abs.Connection.ListObjectsAsAll(prefix)
+	objects, err := abs.Connection.ListObjectsAsAll(ctx, prefix)
 	if err != nil {
 		log.Debugln("Failed to get buckets for ArqBackupSet: ", err)
 		return nil, err
 	}
 	buckets := make([]*ArqBucket, 0)
 	for _, object := range objects {
-		bucket, err := NewArqBucket(object, abs)
+		bucket, err := NewArqBucket(ctx, object, abs)
 		if err != nil {
 			log.Debugln("Failed to get ArqBucket for object: ", object)
 			log.Debugln(err)
@@ -21,6 +21,7 @@ package arq
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -39,6 +40,9 @@ type ArqBucket struct {
 	LocalPath    string
 	ArqBackupSet *ArqBackupSet
 	HeadSHA1     [20]byte
+
+	// Only for Arq 7, the latest backup record, loaded on first use
+	arq7BackupRecord *arq7BackupRecord
 }
 
 func (ab ArqBucket) String() string {
@@ -46,8 +50,8 @@ func (ab ArqBucket) String() string {
 		ab.UUID, ab.LocalPath, ab.Object, hex.EncodeToString(ab.HeadSHA1[:]))
 }
 
-func (ab *ArqBucket) parsePlist() error {
-	filepath, err := ab.ArqBackupSet.Connection.CachedGet(ab.Object.GetPath())
+func (ab *ArqBucket) parsePlist(ctx context.Context) error {
+	filepath, err := ab.ArqBackupSet.getVerifiedObject(ctx, ab.Object.GetPath())
 	if err != nil {
 		log.Debugln("Failed during NewArqBucket for s3Obj: ", ab.Object)
 		log.Debugln(err)
@@ -60,9 +64,9 @@ func (ab *ArqBucket) parsePlist() error {
 	}
 	bucket_decrypted, err := ab.ArqBackupSet.BucketDecrypter.Decrypt(bucket_encrypted)
 	if err != nil {
-		err2 := errors.New(fmt.Sprintf("Failed to decrypt bucket: %s", err))
-		log.Debugf("%s", err2)
-		return err2
+		// Not wrapped, so that a crypto.WrongPasswordError can be reported as such.
+		log.Debugf("Failed to decrypt bucket: %s", err)
+		return err
 	}
 	bucket_data, err := plist.Read(bytes.NewReader(bucket_decrypted))
 	if err != nil {
@@ -86,10 +90,10 @@ func assignSHA1(source []byte, destination *[20]byte) error {
 	return nil
 }
 
-func (ab *ArqBucket) updateHeadSHA1() error {
+func (ab *ArqBucket) updateHeadSHA1(ctx context.Context) error {
 	key := path.Join(ab.ArqBackupSet.UUID, "bucketdata", ab.UUID,
 		"refs", "heads", "master")
-	filepath, err := ab.ArqBackupSet.Connection.Get(key)
+	filepath, err := ab.ArqBackupSet.Connection.Get(ctx, key)
 	if err != nil {
 		log.Debugf("Failed during ArqBucket (%s) updateHeadSHA1 get: %s",
 			ab, err)
@@ -115,15 +119,14 @@ func (ab *ArqBucket) updateHeadSHA1() error {
 	return nil
 }
 
-func NewArqBucket(object connector.Object, abs *ArqBackupSet) (*ArqBucket, error) {
+func NewArqBucket(ctx context.Context, object connector.Object, abs *ArqBackupSet) (*ArqBucket, error) {
 	bucket := ArqBucket{Object: object, ArqBackupSet: abs}
 	bucket.UUID = path.Base(object.GetPath())
-	err := bucket.parsePlist()
+	err := bucket.parsePlist(ctx)
 	if err != nil {
-		err2 := errors.New(fmt.Sprintf("Failed during NewArqBucket: %s", err))
-		log.Debugf("%s", err2)
-		return nil, err2
+		log.Debugf("Failed during NewArqBucket: %s", err)
+		return nil, err
 	}
-	bucket.updateHeadSHA1()
+	bucket.updateHeadSHA1(ctx)
 	return &bucket, nil
 }
@@ -0,0 +1,43 @@
+/*
+arqinator: arq/cache.go
+Implements deciding which cached files can be evicted when the cache is over its size limit.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package arq
+
+import (
+	"path"
+	"strings"
+)
+
+/*
+Whether the cached copy of key can be evicted to keep the cache under its size limit. Blob packs and
+objects are usually read once, by a restore. Pack indexes, which are found by listing the cache
+directory rather than by CachedGet, tree packs, and backup set metadata are needed to browse a backup
+and are kept.
+*/
+func IsEvictableCacheKey(key string) bool {
+	key = "/" + strings.Replace(key, "\\", "/", -1)
+	switch {
+	case strings.HasSuffix(key, ".index"):
+		return false
+	case strings.HasSuffix(key, ".pack"):
+		// Arq 5 tree packs are in packsets/<bucket UUID>-trees, Arq 7 ones in treepacks/<2 hex>
+		return !strings.HasSuffix(path.Dir(key), "-trees") && !strings.Contains(key, "/treepacks/")
+	}
+	return strings.Contains(key, "/objects/") || strings.Contains(key, "/standardobjects/")
+}
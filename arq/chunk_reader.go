@@ -0,0 +1,243 @@
+/*
+arqinator: arq/chunk_reader.go
+Implements random access to file contents stored as a list of chunks.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package arq
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+/*
+Reads the contents of a file node, from any offset.
+*/
+type NodeReader interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+}
+
+/*
+The chunks of a file. A chunk's ID must identify its contents, as lengths are remembered by ID.
+*/
+type chunkSource interface {
+	chunkCount() int
+	chunkID(i int) string
+	readChunk(i int) ([]byte, error)
+}
+
+const (
+	// How many chunk lengths to remember, around 10MB of them
+	CHUNK_LENGTHS_CACHE_SIZE = 65536
+)
+
+var (
+	// Plaintext lengths of chunks, keyed by chunk ID. Arq doesn't store these, so they're learned by
+	// reading chunks, and kept so that other readers of the same chunks can skip over them. Only the
+	// CHUNK_LENGTHS_CACHE_SIZE most recently used are kept, the others are forgotten and read again
+	// if needed.
+	chunkLengths      = make(map[string]*list.Element)
+	chunkLengthsOrder = list.New() // of *chunkLength, most recently used first
+	chunkLengthsMutex sync.Mutex
+)
+
+type chunkLength struct {
+	id     string
+	length int64
+}
+
+func getChunkLength(id string) (int64, bool) {
+	chunkLengthsMutex.Lock()
+	defer chunkLengthsMutex.Unlock()
+	element, ok := chunkLengths[id]
+	if !ok {
+		return 0, false
+	}
+	chunkLengthsOrder.MoveToFront(element)
+	return element.Value.(*chunkLength).length, true
+}
+
+func setChunkLength(id string, length int64) {
+	chunkLengthsMutex.Lock()
+	defer chunkLengthsMutex.Unlock()
+	if element, ok := chunkLengths[id]; ok {
+		element.Value.(*chunkLength).length = length
+		chunkLengthsOrder.MoveToFront(element)
+		return
+	}
+	chunkLengths[id] = chunkLengthsOrder.PushFront(&chunkLength{id: id, length: length})
+	for chunkLengthsOrder.Len() > CHUNK_LENGTHS_CACHE_SIZE {
+		oldest := chunkLengthsOrder.Back()
+		chunkLengthsOrder.Remove(oldest)
+		delete(chunkLengths, oldest.Value.(*chunkLength).id)
+	}
+}
+
+/*
+Finds the chunks covering an offset, and reads only those. Finding a chunk needs the lengths of the
+chunks before it, so the first read past chunks whose lengths aren't known yet reads them too. The last
+chunk read is kept, so reading sequentially reads each chunk once.
+
+Safe for concurrent use, but calls take turns, so concurrent ReadAts are no faster than one after
+another.
+*/
+type chunkReader struct {
+	source chunkSource
+	size   int64
+
+	// Held by ReadAt, Read and Seek
+	mutex sync.Mutex
+
+	// ends[i] is the offset after chunk i, for the chunks whose lengths are known so far
+	ends []int64
+
+	currentIndex int
+	current      []byte
+	position     int64
+}
+
+func newChunkReader(source chunkSource, size int64) *chunkReader {
+	return &chunkReader{
+		source:       source,
+		size:         size,
+		ends:         make([]int64, 0, source.chunkCount()),
+		currentIndex: -1,
+	}
+}
+
+func (r *chunkReader) getChunk(i int) ([]byte, error) {
+	if i == r.currentIndex {
+		return r.current, nil
+	}
+	contents, err := r.source.readChunk(i)
+	if err != nil {
+		return nil, err
+	}
+	length := int64(len(contents))
+	id := r.source.chunkID(i)
+	if knownLength, ok := getChunkLength(id); ok && knownLength != length {
+		err := errors.New(fmt.Sprintf("chunk %s has length %d, expected %d", id, length, knownLength))
+		log.Debugf("%s", err)
+		return nil, err
+	}
+	setChunkLength(id, length)
+	if i == len(r.ends) {
+		r.appendEnd(length)
+	}
+	r.currentIndex = i
+	r.current = contents
+	return contents, nil
+}
+
+func (r *chunkReader) appendEnd(length int64) {
+	var start int64
+	if len(r.ends) > 0 {
+		start = r.ends[len(r.ends)-1]
+	}
+	r.ends = append(r.ends, start+length)
+}
+
+/*
+Returns the index of the chunk containing offset, and where that chunk starts. The index is the number
+of chunks if offset is past the end.
+*/
+func (r *chunkReader) findChunk(offset int64) (int, int64, error) {
+	for len(r.ends) < r.source.chunkCount() && (len(r.ends) == 0 || r.ends[len(r.ends)-1] <= offset) {
+		i := len(r.ends)
+		if length, ok := getChunkLength(r.source.chunkID(i)); ok {
+			r.appendEnd(length)
+		} else if _, err := r.getChunk(i); err != nil {
+			return 0, 0, err
+		}
+	}
+	i := sort.Search(len(r.ends), func(i int) bool {
+		return r.ends[i] > offset
+	})
+	if i == 0 {
+		return 0, 0, nil
+	}
+	return i, r.ends[i-1], nil
+}
+
+func (r *chunkReader) ReadAt(p []byte, offset int64) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.readAt(p, offset)
+}
+
+func (r *chunkReader) readAt(p []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	n := 0
+	for n < len(p) {
+		i, start, err := r.findChunk(offset + int64(n))
+		if err != nil {
+			return n, err
+		}
+		if i >= r.source.chunkCount() {
+			return n, io.EOF
+		}
+		contents, err := r.getChunk(i)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], contents[offset+int64(n)-start:])
+	}
+	return n, nil
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	n, err := r.readAt(p, r.position)
+	r.position += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+/*
+Seeking from the end uses the size of the node, which Arq stores.
+*/
+func (r *chunkReader) Seek(offset int64, whence int) (int64, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.position
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New(fmt.Sprintf("invalid whence %d", whence))
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.position = offset
+	return offset, nil
+}
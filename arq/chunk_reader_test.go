@@ -0,0 +1,96 @@
+/*
+arqinator: arq/chunk_reader_test.go
+Tests random access to chunked file contents and the cache of chunk lengths.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package arq
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type testChunkSource struct {
+	prefix string
+	chunks []string
+}
+
+func (s *testChunkSource) chunkCount() int {
+	return len(s.chunks)
+}
+
+func (s *testChunkSource) chunkID(i int) string {
+	return fmt.Sprintf("%s-%d", s.prefix, i)
+}
+
+func (s *testChunkSource) readChunk(i int) ([]byte, error) {
+	return []byte(s.chunks[i]), nil
+}
+
+/*
+Run with -race.
+*/
+func TestChunkReaderConcurrentReadAt(t *testing.T) {
+	source := &testChunkSource{prefix: t.Name(), chunks: []string{"abc", "defg", "h", "ijklm"}}
+	contents := strings.Join(source.chunks, "")
+	r := newChunkReader(source, int64(len(contents)))
+	var wg sync.WaitGroup
+	errs := make(chan error, len(contents))
+	for offset := 0; offset < len(contents)-2; offset++ {
+		wg.Add(1)
+		go func(offset int) {
+			defer wg.Done()
+			p := make([]byte, 3)
+			if _, err := r.ReadAt(p, int64(offset)); err != nil || string(p) != contents[offset:offset+3] {
+				errs <- fmt.Errorf("ReadAt(%d) expected %s, got %s, %v", offset, contents[offset:offset+3], p, err)
+			}
+		}(offset)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestChunkLengthsAreBounded(t *testing.T) {
+	for i := 0; i < CHUNK_LENGTHS_CACHE_SIZE+10; i++ {
+		setChunkLength(fmt.Sprintf("%s-%d", t.Name(), i), int64(i))
+		if i%1000 == 999 {
+			// Keep the first one in use
+			getChunkLength(fmt.Sprintf("%s-%d", t.Name(), 0))
+		}
+	}
+	chunkLengthsMutex.Lock()
+	count := len(chunkLengths)
+	chunkLengthsMutex.Unlock()
+	if count != CHUNK_LENGTHS_CACHE_SIZE {
+		t.Errorf("Expected %d chunk lengths, got %d", CHUNK_LENGTHS_CACHE_SIZE, count)
+	}
+	if _, ok := getChunkLength(fmt.Sprintf("%s-%d", t.Name(), 1)); ok {
+		t.Errorf("Expected the least recently used chunk length to be forgotten")
+	}
+	if length, ok := getChunkLength(fmt.Sprintf("%s-%d", t.Name(), 0)); !ok || length != 0 {
+		t.Errorf("Expected a recently used chunk length to be kept, got %d, %t", length, ok)
+	}
+	if length, ok := getChunkLength(fmt.Sprintf("%s-%d", t.Name(), CHUNK_LENGTHS_CACHE_SIZE+9)); !ok ||
+		length != CHUNK_LENGTHS_CACHE_SIZE+9 {
+		t.Errorf("Expected the latest chunk length to be kept, got %d, %t", length, ok)
+	}
+}
@@ -0,0 +1,185 @@
+/*
+arqinator: arq/history.go
+Implements listing the past backups of a folder.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+/*
+Arq 4 and 5 record each backup of a folder as a commit pointing at its parent, like git. Arq 7 instead
+writes a backup record per backup, named by its creation time.
+*/
+
+package arq
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/asimihsan/arqinator/arq/types"
+)
+
+/*
+One backup of a folder, either an Arq 4/5 commit or an Arq 7 backup record.
+*/
+type ArqCommit struct {
+	// The hex SHA1 of an Arq 4/5 commit, or the creation time digits of an Arq 7 backup record.
+	ID           string
+	CreationDate time.Time
+	Path         string
+	IsComplete   bool
+
+	// Arq 4/5 commits point at their tree and parent by SHA1, Arq 7 backup records have a root node.
+	treeSHA1   *[20]byte
+	parentSHA1 *[20]byte
+	rootNode   *arq_types.Node
+}
+
+func (c ArqCommit) String() string {
+	return fmt.Sprintf("{ArqCommit: ID=%s, CreationDate=%s, Path=%s, IsComplete=%t}",
+		c.ID, c.CreationDate, c.Path, c.IsComplete)
+}
+
+/*
+The latest backup of a folder.
+*/
+func GetHeadCommit(ctx context.Context, cacheDirectory string, backupSet *ArqBackupSet, bucket *ArqBucket) (*ArqCommit, error) {
+	if backupSet.Format == BACKUP_FORMAT_ARQ7 {
+		record, err := bucket.getArq7BackupRecord(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return newArq7Commit(bucket, record), nil
+	}
+	apsi, _ := NewPackSetIndex(cacheDirectory, backupSet, bucket)
+	return getArq5Commit(ctx, apsi, backupSet, bucket, bucket.HeadSHA1)
+}
+
+/*
+List the backups of a folder, newest first. Arq deletes old commits when it thins out backups, so the
+history of an Arq 4/5 folder ends at the first commit that can't be found.
+*/
+func ListCommits(ctx context.Context, cacheDirectory string, backupSet *ArqBackupSet, bucket *ArqBucket) ([]*ArqCommit, error) {
+	if backupSet.Format == BACKUP_FORMAT_ARQ7 {
+		return listArq7Commits(ctx, bucket)
+	}
+	apsi, _ := NewPackSetIndex(cacheDirectory, backupSet, bucket)
+	commits := make([]*ArqCommit, 0)
+	seen := make(map[[20]byte]bool)
+	SHA1 := bucket.HeadSHA1
+	for !seen[SHA1] {
+		seen[SHA1] = true
+		commit, err := getArq5Commit(ctx, apsi, backupSet, bucket, SHA1)
+		if err != nil {
+			if len(commits) == 0 {
+				return nil, err
+			}
+			log.Debugf("ListCommits stopping at missing commit %s: %s", hex.EncodeToString(SHA1[:]), err)
+			break
+		}
+		commits = append(commits, commit)
+		if commit.parentSHA1 == nil {
+			break
+		}
+		SHA1 = *commit.parentSHA1
+	}
+	return commits, nil
+}
+
+func getArq5Commit(ctx context.Context, apsi *ArqPackSetIndex, backupSet *ArqBackupSet, bucket *ArqBucket, SHA1 [20]byte) (*ArqCommit, error) {
+	commit, err := apsi.GetPackFileAsCommit(ctx, backupSet, bucket, SHA1)
+	if err == nil && commit == nil {
+		err = errors.New("commit couldn't be parsed")
+	}
+	if err != nil {
+		err2 := errors.New(fmt.Sprintf("Failed to get commit %s of %s: %s", hex.EncodeToString(SHA1[:]), bucket.LocalPath, err))
+		log.Debugf("%s", err2)
+		return nil, err2
+	}
+	arqCommit := &ArqCommit{
+		ID:   hex.EncodeToString(SHA1[:]),
+		Path: commit.Path,
+	}
+	if commit.TreeBlobKey != nil {
+		arqCommit.treeSHA1 = commit.TreeBlobKey.SHA1
+	}
+	if len(commit.ParentCommits) > 0 {
+		arqCommit.parentSHA1 = commit.ParentCommits[0].SHA1
+	}
+	if commit.CreationDate != nil {
+		arqCommit.CreationDate = commit.CreationDate.Data
+	}
+	// IsComplete is only recorded by Arq 5, earlier commits are assumed to be complete.
+	arqCommit.IsComplete = commit.IsComplete == nil || !commit.IsComplete.IsPresent || commit.IsComplete.Data
+	return arqCommit, nil
+}
+
+func listArq7Commits(ctx context.Context, bucket *ArqBucket) ([]*ArqCommit, error) {
+	directoryNames, err := bucket.listArq7BackupRecordDirectories(ctx)
+	if err != nil {
+		return nil, err
+	}
+	commits := make([]*ArqCommit, 0)
+	for i := len(directoryNames) - 1; i >= 0; i-- {
+		names, err := bucket.listArq7BackupRecordNames(ctx, directoryNames[i])
+		if err != nil {
+			return nil, err
+		}
+		for j := len(names) - 1; j >= 0; j-- {
+			record, err := bucket.readArq7BackupRecord(ctx, directoryNames[i], names[j])
+			if err != nil {
+				log.Debugf("listArq7Commits skipping unreadable backup record %s%s: %s", directoryNames[i], names[j], err)
+				continue
+			}
+			commits = append(commits, newArq7Commit(bucket, record))
+		}
+	}
+	return commits, nil
+}
+
+func newArq7Commit(bucket *ArqBucket, record *arq7BackupRecord) *ArqCommit {
+	seconds, fraction := math.Modf(record.CreationDate)
+	commit := &ArqCommit{
+		ID:           record.id,
+		CreationDate: time.Unix(int64(seconds), int64(fraction*float64(time.Second))),
+		Path:         record.LocalPath,
+		IsComplete:   record.IsComplete,
+		rootNode:     record.Node.toNode(),
+	}
+	if commit.Path == "" {
+		commit.Path = bucket.LocalPath
+	}
+	return commit
+}
+
+/*
+Return the tree at the top of the folder as it was backed up by commit.
+*/
+func GetCommitTree(ctx context.Context, cacheDirectory string, backupSet *ArqBackupSet, bucket *ArqBucket, commit *ArqCommit) (*arq_types.Tree, error) {
+	if commit.rootNode != nil {
+		return backupSet.readArq7Tree(ctx, commit.rootNode)
+	}
+	if commit.treeSHA1 == nil {
+		return nil, errors.New(fmt.Sprintf("Commit %s has no tree", commit.ID))
+	}
+	apsi, _ := NewPackSetIndex(cacheDirectory, backupSet, bucket)
+	return apsi.GetPackFileAsTree(ctx, backupSet, bucket, *commit.treeSHA1)
+}
@@ -0,0 +1,119 @@
+/*
+arqinator: arq/lz4.go
+Implements decompression of the LZ4 blocks used by Arq 7.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+/*
+References:
+-	https://github.com/lz4/lz4/blob/dev/doc/lz4_Block_format.md
+
+Arq 7 stores an LZ4 block prefixed by the big-endian 4-byte length of the uncompressed data, rather than
+using the LZ4 frame format.
+*/
+
+package arq
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	LZ4_MIN_MATCH = 4
+
+	// Each byte of a block produces at most 255 bytes, so a larger uncompressed size means the length
+	// prefix is corrupt.
+	LZ4_MAX_COMPRESSION_RATIO = 255
+)
+
+func decompressArq7LZ4(data []byte) ([]byte, error) {
+	if len(data) < 4 {
+		return nil, errors.New("LZ4 data is too short to have a length prefix")
+	}
+	uncompressedSize := binary.BigEndian.Uint32(data[:4])
+	return decompressLZ4Block(data[4:], int(uncompressedSize))
+}
+
+func decompressLZ4Block(src []byte, uncompressedSize int) ([]byte, error) {
+	if uncompressedSize > LZ4_MAX_COMPRESSION_RATIO*len(src) {
+		return nil, errors.New(fmt.Sprintf("LZ4 block of %d bytes can't decompress to %d bytes",
+			len(src), uncompressedSize))
+	}
+	dst := make([]byte, 0, uncompressedSize)
+	i := 0
+	readLength := func(length int) (int, error) {
+		for {
+			if i >= len(src) {
+				return 0, errors.New("LZ4 block truncated while reading a length")
+			}
+			b := src[i]
+			i++
+			length += int(b)
+			if b != 255 {
+				return length, nil
+			}
+		}
+	}
+	for i < len(src) {
+		token := src[i]
+		i++
+
+		literalLength := int(token >> 4)
+		if literalLength == 15 {
+			var err error
+			if literalLength, err = readLength(literalLength); err != nil {
+				return nil, err
+			}
+		}
+		if i+literalLength > len(src) {
+			return nil, errors.New("LZ4 block truncated during literals")
+		}
+		dst = append(dst, src[i:i+literalLength]...)
+		i += literalLength
+		if i == len(src) {
+			// the last sequence only has literals
+			break
+		}
+
+		if i+2 > len(src) {
+			return nil, errors.New("LZ4 block truncated during match offset")
+		}
+		offset := int(src[i]) | int(src[i+1])<<8
+		i += 2
+		if offset == 0 || offset > len(dst) {
+			return nil, errors.New(fmt.Sprintf("LZ4 block has invalid match offset %d", offset))
+		}
+		matchLength := int(token & 0x0f)
+		if matchLength == 15 {
+			var err error
+			if matchLength, err = readLength(matchLength); err != nil {
+				return nil, err
+			}
+		}
+		matchLength += LZ4_MIN_MATCH
+		// matches may overlap the bytes they produce, so copy one byte at a time
+		start := len(dst) - offset
+		for j := 0; j < matchLength; j++ {
+			dst = append(dst, dst[start+j])
+		}
+	}
+	if len(dst) != uncompressedSize {
+		return nil, errors.New(fmt.Sprintf("LZ4 block decompressed to %d bytes, expected %d", len(dst), uncompressedSize))
+	}
+	return dst, nil
+}
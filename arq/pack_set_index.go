@@ -21,6 +21,7 @@ package arq
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -29,6 +30,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"runtime"
 	"unsafe"
 
 	"compress/gzip"
@@ -36,6 +38,7 @@ import (
 	"github.com/asimihsan/arqinator/arq/types"
 	"io/ioutil"
 	"strings"
+	"sync"
 )
 
 type ArqPackSetIndex struct {
@@ -66,9 +69,12 @@ func (apsi ArqPackSetIndex) String() string {
 		apsi.CacheDirectory, apsi.ArqBucket)
 }
 
-func FindNode(cacheDirectory string, backupSet *ArqBackupSet, bucket *ArqBucket, targetPath string) (*arq_types.Tree, *arq_types.Node, error) {
+func FindNode(ctx context.Context, cacheDirectory string, backupSet *ArqBackupSet, bucket *ArqBucket, targetPath string) (*arq_types.Tree, *arq_types.Node, error) {
+	if backupSet.Format == BACKUP_FORMAT_ARQ7 {
+		return findArq7Node(ctx, backupSet, bucket, targetPath)
+	}
 	apsi, _ := NewPackSetIndex(cacheDirectory, backupSet, bucket)
-	commit, err := apsi.GetPackFileAsCommit(backupSet, bucket, bucket.HeadSHA1)
+	commit, err := apsi.GetPackFileAsCommit(ctx, backupSet, bucket, bucket.HeadSHA1)
 	if err != nil {
 		err := errors.New(fmt.Sprintf("failed to get commit: %s", err))
 		log.Debugf("%s", err)
@@ -97,7 +103,7 @@ func FindNode(cacheDirectory string, backupSet *ArqBackupSet, bucket *ArqBucket,
 		nextPathElement = strings.Split(nextPathElement, "/")[0]
 		log.Debugf("FindNode nextPathElement: %s", nextPathElement)
 
-		tree, err = apsi.GetPackFileAsTree(backupSet, bucket, *currentHash)
+		tree, err = apsi.GetPackFileAsTree(ctx, backupSet, bucket, *currentHash)
 		if err != nil {
 			log.Debugf("failed to get tree: %s", err)
 		}
@@ -124,8 +130,8 @@ func FindNode(cacheDirectory string, backupSet *ArqBackupSet, bucket *ArqBucket,
 	}
 }
 
-func (apsi *ArqPackSetIndex) GetPackFileAsCommit(backupSet *ArqBackupSet, bucket *ArqBucket, SHA1 [20]byte) (*arq_types.Commit, error) {
-	pf, err := apsi.GetTreePackFile(backupSet, bucket, bucket.HeadSHA1)
+func (apsi *ArqPackSetIndex) GetPackFileAsCommit(ctx context.Context, backupSet *ArqBackupSet, bucket *ArqBucket, SHA1 [20]byte) (*arq_types.Commit, error) {
+	pf, err := apsi.GetTreePackFile(ctx, backupSet, bucket, SHA1)
 	if err != nil {
 		log.Debugf("GetPackFileAsCommit failed during apsi.GetPackFile: ", err)
 		return nil, err
@@ -137,9 +143,9 @@ func (apsi *ArqPackSetIndex) GetPackFileAsCommit(backupSet *ArqBackupSet, bucket
 	return commit, nil
 }
 
-func (apsi *ArqPackSetIndex) GetPackFileAsTree(backupSet *ArqBackupSet, bucket *ArqBucket, SHA1 [20]byte) (*arq_types.Tree, error) {
+func (apsi *ArqPackSetIndex) GetPackFileAsTree(ctx context.Context, backupSet *ArqBackupSet, bucket *ArqBucket, SHA1 [20]byte) (*arq_types.Tree, error) {
 	log.Debugf("get tree_packfile...")
-	tree_packfile, err := apsi.GetTreePackFile(backupSet, bucket, SHA1)
+	tree_packfile, err := apsi.GetTreePackFile(ctx, backupSet, bucket, SHA1)
 	if err != nil {
 		log.Debugf("failed to get tree blob: %s", err)
 		return nil, err
@@ -170,6 +176,19 @@ type PackIndexObject struct {
 	_      uint32
 }
 
+/*
+How many objects in the index have SHA1s whose first byte is less than first, and how many have a first
+byte of at most first. Fanout[i] counts the objects with a first byte of at most i, so nothing comes
+before 0.
+*/
+func (header *PackIndex) fanoutBounds(first byte) (int, int) {
+	var numberLessThan int
+	if first > 0 {
+		numberLessThan = int(header.Fanout[first-1])
+	}
+	return numberLessThan, int(header.Fanout[first])
+}
+
 func (pio PackIndexObject) String() string {
 	return fmt.Sprintf("{PackIndexObject: Offset=%d, Length=%d, SHA1=%x}",
 		pio.Offset, pio.Length, pio.SHA1)
@@ -223,8 +242,7 @@ func testEq(a [20]byte, b [20]byte) bool {
 
 				p := bytes.NewBuffer(mmap)
 				binary.Read(p, binary.BigEndian, &header)
-				numberLessThanPrefix := int(header.Fanout[targetSHA1[0]-1])
-				numberEqualAndLessThenPrefix := int(header.Fanout[targetSHA1[0]])
+				numberLessThanPrefix, numberEqualAndLessThenPrefix := header.fanoutBounds(targetSHA1[0])
 				p.Next(numberLessThanPrefix * int(unsafe.Sizeof(pio)))
 
 				numberOfObjects := numberEqualAndLessThenPrefix - numberLessThanPrefix
@@ -254,37 +272,227 @@ func splitExt(path string) (root, ext string) {
 	return
 }
 
-// TODO copy/paste of GetBlobPackFile, refactor
-func (apsi *ArqPackSetIndex) GetTreePackFile(abs *ArqBackupSet, ab *ArqBucket, targetSHA1 [20]byte) ([]byte, error) {
-	indexes, err := apsi.ListTreeIndexes()
+/*
+The pack indexes of a pack set that have been read into memory, kept by the backup set so that lookups
+don't read them from the cache directory again.
+*/
+type packSetIndexes struct {
+	mutex sync.Mutex
+	// Each index, by cache file path
+	indexes map[string]*parsedPackIndex
+	// Whether indexes holds every index of the pack set, so a SHA1 that isn't in them isn't in the pack set
+	isComplete bool
+	// Whether every index of the pack set is in the cache directory, so it needn't be listed again
+	isCached bool
+}
+
+/*
+The in-memory indexes of the pack set under prefix.
+*/
+func (abs *ArqBackupSet) getPackSetIndexes(prefix string) *packSetIndexes {
+	abs.packSetsMutex.Lock()
+	defer abs.packSetsMutex.Unlock()
+	if abs.packSets == nil {
+		abs.packSets = make(map[string]*packSetIndexes)
+	}
+	packSet, ok := abs.packSets[prefix]
+	if !ok {
+		packSet = &packSetIndexes{indexes: make(map[string]*parsedPackIndex)}
+		abs.packSets[prefix] = packSet
+	}
+	return packSet
+}
+
+/*
+Record that every index of the pack set under prefix is in the cache directory.
+*/
+func (abs *ArqBackupSet) setPackSetCached(prefix string) {
+	packSet := abs.getPackSetIndexes(prefix)
+	packSet.mutex.Lock()
+	defer packSet.mutex.Unlock()
+	packSet.isCached = true
+}
+
+/*
+Record that every index of the pack set has been read, and so is in the cache directory too.
+*/
+func (packSet *packSetIndexes) setComplete() {
+	packSet.mutex.Lock()
+	defer packSet.mutex.Unlock()
+	packSet.isCached = true
+	packSet.isComplete = true
+}
+
+/*
+Search the indexes read so far for targetSHA1, returning the object and the index it's in, or nil if
+none of them have it.
+*/
+func (packSet *packSetIndexes) search(targetSHA1 [20]byte) (*PackIndexObject, string) {
+	packSet.mutex.Lock()
+	defer packSet.mutex.Unlock()
+	for index, parsed := range packSet.indexes {
+		if pio := parsed.search(targetSHA1); pio != nil {
+			return pio, index
+		}
+	}
+	return nil, ""
+}
+
+/*
+Read the cache files indexes into memory, unless they already are.
+*/
+func (packSet *packSetIndexes) load(indexes []string) error {
+	for _, index := range indexes {
+		packSet.mutex.Lock()
+		_, ok := packSet.indexes[index]
+		packSet.mutex.Unlock()
+		if ok {
+			continue
+		}
+		parsed, err := parsePackIndex(index)
+		if err != nil {
+			return err
+		}
+		packSet.mutex.Lock()
+		packSet.indexes[index] = parsed
+		packSet.mutex.Unlock()
+	}
+	return nil
+}
+
+/*
+A pack index read into memory.
+*/
+type parsedPackIndex struct {
+	header  PackIndex
+	objects []PackIndexObject
+}
+
+/*
+Read the pack index file index into memory.
+*/
+func parsePackIndex(index string) (*parsedPackIndex, error) {
+	contents, err := ioutil.ReadFile(index)
 	if err != nil {
-		log.Debugf("ArqPackSetIndex %s failed in GetPackFile to listIndexes: %s", err)
+		log.Debugf("parsePackIndex failed to read index %s: %s", index, err)
+		return nil, err
+	}
+	p := bytes.NewReader(contents)
+	parsed := &parsedPackIndex{}
+	if err := binary.Read(p, binary.BigEndian, &parsed.header); err != nil {
+		log.Debugf("parsePackIndex failed to read header of index %s: %s", index, err)
+		return nil, err
+	}
+	parsed.objects = make([]PackIndexObject, parsed.header.Fanout[len(parsed.header.Fanout)-1])
+	if p.Len() < len(parsed.objects)*int(unsafe.Sizeof(PackIndexObject{})) {
+		err := errors.New(fmt.Sprintf("pack index %s is truncated, expected %d objects", index, len(parsed.objects)))
+		log.Debugf("%s", err)
+		return nil, err
+	}
+	if err := binary.Read(p, binary.BigEndian, parsed.objects); err != nil {
+		log.Debugf("parsePackIndex failed to read objects of index %s: %s", index, err)
 		return nil, err
 	}
-	var packIndexObjectResult *PackIndexObject
-	var indexResult string
+	return parsed, nil
+}
+
+/*
+Search the pack index for targetSHA1, returning nil if it isn't there.
+*/
+func (parsed *parsedPackIndex) search(targetSHA1 [20]byte) *PackIndexObject {
+	numberLessThanPrefix, numberEqualAndLessThenPrefix := parsed.header.fanoutBounds(targetSHA1[0])
+	for i := numberLessThanPrefix; i < numberEqualAndLessThenPrefix; i++ {
+		if testEq(parsed.objects[i].SHA1, targetSHA1) {
+			pio := parsed.objects[i]
+			return &pio
+		}
+	}
+	return nil
+}
+
+/*
+Find targetSHA1 in the pack set under prefix, returning nil if it isn't there. Indexes are kept in
+memory once read, and searched first, so once the index with targetSHA1 is read finding it needs no
+requests. Otherwise the pack set is listed, and the indexes that aren't cached yet are downloaded a batch
+at a time and searched until targetSHA1 turns up, rather than downloading the whole pack set up front.
+Once every index has been read, or the whole pack set was cached by Folder.CacheBlobs or
+Folder.CacheTrees, a SHA1 that isn't in them is known not to be in the pack set without listing it again.
+*/
+func (apsi *ArqPackSetIndex) findPackIndexObject(ctx context.Context, prefix string, targetSHA1 [20]byte) (*PackIndexObject, string, error) {
+	abs := apsi.ArqBackupSet
+	packSet := abs.getPackSetIndexes(prefix)
+	if pio, index := packSet.search(targetSHA1); pio != nil {
+		return pio, index, nil
+	}
+	packSet.mutex.Lock()
+	isComplete, isCached := packSet.isComplete, packSet.isCached
+	packSet.mutex.Unlock()
+	if isComplete {
+		return nil, "", nil
+	}
+
+	indexes, err := apsi.listIndexes(path.Join(apsi.CacheDirectory, prefix))
+	if err != nil {
+		return nil, "", err
+	}
+	if err := packSet.load(indexes); err != nil {
+		return nil, "", err
+	}
+	if pio, index := packSet.search(targetSHA1); pio != nil {
+		return pio, index, nil
+	}
+	if isCached {
+		packSet.setComplete()
+		return nil, "", nil
+	}
+
+	objects, err := abs.Connection.ListObjectsAsAll(ctx, prefix)
+	if err != nil {
+		log.Debugf("findPackIndexObject failed to list pack set %s: %s", prefix, err)
+		return nil, "", err
+	}
+	isLoaded := make(map[string]bool, len(indexes))
 	for _, index := range indexes {
-		indexContents, err := ioutil.ReadFile(index)
+		isLoaded[filepath.Base(index)] = true
+	}
+	missing := make([]string, 0)
+	for _, object := range objects {
+		key := object.GetPath()
+		if strings.HasSuffix(key, ".index") && !isLoaded[path.Base(key)] {
+			missing = append(missing, key)
+		}
+	}
+	log.Debugf("findPackIndexObject %s not in cached indexes of %s, %d more to search",
+		hex.EncodeToString(targetSHA1[:]), prefix, len(missing))
+	batchSize := runtime.GOMAXPROCS(0) * 2
+	for len(missing) > 0 {
+		batch := missing
+		if len(batch) > batchSize {
+			batch = batch[:batchSize]
+		}
+		missing = missing[len(batch):]
+		downloaded, err := abs.cachePackIndexes(ctx, batch)
 		if err != nil {
-			log.Panicln(fmt.Sprintf("Could not read index file %s into memory. err: %s", index, err))
+			log.Debugf("findPackIndexObject failed to download indexes of %s: %s", prefix, err)
+			return nil, "", err
 		}
-		p := bytes.NewBuffer(indexContents)
-		var header PackIndex
-		binary.Read(p, binary.BigEndian, &header)
-		numberLessThanPrefix := int(header.Fanout[targetSHA1[0]-1])
-		numberEqualAndLessThenPrefix := int(header.Fanout[targetSHA1[0]])
-		var pio PackIndexObject
-		p.Next(numberLessThanPrefix * int(unsafe.Sizeof(pio)))
-
-		numberOfObjects := numberEqualAndLessThenPrefix - numberLessThanPrefix
-		for i := 0; i < numberOfObjects; i++ {
-			pio, _ := readIntoPackIndexObject(p)
-			if testEq(pio.SHA1, targetSHA1) {
-				packIndexObjectResult = pio
-				indexResult = index
-				break
-			}
+		if err := packSet.load(downloaded); err != nil {
+			return nil, "", err
 		}
+		if pio, index := packSet.search(targetSHA1); pio != nil {
+			return pio, index, nil
+		}
+	}
+	packSet.setComplete()
+	return nil, "", nil
+}
+
+// TODO copy/paste of GetBlobPackFile, refactor
+func (apsi *ArqPackSetIndex) GetTreePackFile(ctx context.Context, abs *ArqBackupSet, ab *ArqBucket, targetSHA1 [20]byte) ([]byte, error) {
+	packIndexObjectResult, indexResult, err := apsi.findPackIndexObject(ctx, GetPathToBucketPackSetTrees(abs, ab), targetSHA1)
+	if err != nil {
+		log.Debugf("ArqPackSetIndex %s failed in GetTreePackFile to find targetSHA1: %s", apsi, err)
+		return nil, err
 	}
 	log.Debugf("GetTreePackFile packIndexObjectResult: %s, indexResult: %s", packIndexObjectResult, indexResult)
 	if packIndexObjectResult == nil {
@@ -296,7 +504,7 @@ func (apsi *ArqPackSetIndex) GetTreePackFile(abs *ArqBackupSet, ab *ArqBucket, t
 	packName, _ := splitExt(filepath.Base(indexResult))
 	log.Debugf("GetTreePackFile packName: %s", packName)
 
-	pfo, err := GetObjectFromTreePackFile(abs, ab, packIndexObjectResult, packName)
+	pfo, err := GetObjectFromTreePackFile(ctx, abs, ab, packIndexObjectResult, packName)
 	if err != nil {
 		log.Debugf("GetPackFile failed to GetObjectFromTreePackFile: %s", err)
 		return nil, err
@@ -325,37 +533,12 @@ func (apsi *ArqPackSetIndex) GetTreePackFile(abs *ArqBackupSet, ab *ArqBucket, t
 	return b.Bytes(), nil
 }
 
-func (apsi *ArqPackSetIndex) GetBlobPackFile(abs *ArqBackupSet, ab *ArqBucket, targetSHA1 [20]byte) ([]byte, error) {
-	indexes, err := apsi.ListBlobIndexes()
+func (apsi *ArqPackSetIndex) GetBlobPackFile(ctx context.Context, abs *ArqBackupSet, ab *ArqBucket, targetSHA1 [20]byte) ([]byte, error) {
+	packIndexObjectResult, indexResult, err := apsi.findPackIndexObject(ctx, GetPathToBucketPackSetBlobs(abs, ab), targetSHA1)
 	if err != nil {
-		log.Debugf("ArqPackSetIndex %s failed in GetBlobPackFile to listIndexes: %s", err)
+		log.Debugf("ArqPackSetIndex %s failed in GetBlobPackFile to find targetSHA1: %s", apsi, err)
 		return nil, err
 	}
-	var packIndexObjectResult *PackIndexObject
-	var indexResult string
-	for _, index := range indexes {
-		indexContents, err := ioutil.ReadFile(index)
-		if err != nil {
-			log.Panicln(fmt.Sprintf("Could not read index file %s into memory. err: %s", index, err))
-		}
-		p := bytes.NewBuffer(indexContents)
-		var header PackIndex
-		binary.Read(p, binary.BigEndian, &header)
-		numberLessThanPrefix := int(header.Fanout[targetSHA1[0]-1])
-		numberEqualAndLessThenPrefix := int(header.Fanout[targetSHA1[0]])
-		var pio PackIndexObject
-		p.Next(numberLessThanPrefix * int(unsafe.Sizeof(pio)))
-
-		numberOfObjects := numberEqualAndLessThenPrefix - numberLessThanPrefix
-		for i := 0; i < numberOfObjects; i++ {
-			pio, _ := readIntoPackIndexObject(p)
-			if testEq(pio.SHA1, targetSHA1) {
-				packIndexObjectResult = pio
-				indexResult = index
-				break
-			}
-		}
-	}
 	if packIndexObjectResult == nil {
 		err = errors.New(fmt.Sprintf("GetBlobPackFile failed to find targetSHA1 %s",
 			hex.EncodeToString(targetSHA1[:])))
@@ -364,7 +547,7 @@ func (apsi *ArqPackSetIndex) GetBlobPackFile(abs *ArqBackupSet, ab *ArqBucket, t
 	}
 	packName, _ := splitExt(filepath.Base(indexResult))
 
-	pfo, err := GetObjectFromBlobPackFile(abs, ab, packIndexObjectResult, packName)
+	pfo, err := GetObjectFromBlobPackFile(ctx, abs, ab, packIndexObjectResult, packName)
 	if err != nil {
 		log.Debugf("GetBlobPackFile failed to GetObjectFromBlobPackFile: %s", err)
 		return nil, err
@@ -442,31 +625,31 @@ func NewPackFileObject(buf []byte) (*PackFileObject, error) {
 	return &pfo, nil
 }
 
-func GetObjectFromTreePackFile(abs *ArqBackupSet, ab *ArqBucket, pio *PackIndexObject, packName string) (*PackFileObject, error) {
+func GetObjectFromTreePackFile(ctx context.Context, abs *ArqBackupSet, ab *ArqBucket, pio *PackIndexObject, packName string) (*PackFileObject, error) {
 	key := path.Join(abs.UUID, "packsets",
 		fmt.Sprintf("%s-trees", ab.UUID), fmt.Sprintf("%s.pack", packName))
-	return GetObjectFromPackFile(key, abs, ab, pio, packName)
+	return GetObjectFromPackFile(ctx, key, abs, ab, pio, packName)
 }
 
-func GetObjectFromBlobPackFile(abs *ArqBackupSet, ab *ArqBucket, pio *PackIndexObject, packName string) (*PackFileObject, error) {
+func GetObjectFromBlobPackFile(ctx context.Context, abs *ArqBackupSet, ab *ArqBucket, pio *PackIndexObject, packName string) (*PackFileObject, error) {
 	key := path.Join(abs.UUID, "packsets",
 		fmt.Sprintf("%s-blobs", ab.UUID), fmt.Sprintf("%s.pack", packName))
-	return GetObjectFromPackFile(key, abs, ab, pio, packName)
+	return GetObjectFromPackFile(ctx, key, abs, ab, pio, packName)
 }
 
-func GetObjectFromPackFile(key string, abs *ArqBackupSet, ab *ArqBucket, pio *PackIndexObject, packName string) (*PackFileObject, error) {
-	packFilepath, err := abs.Connection.CachedGet(key)
+func GetObjectFromPackFile(ctx context.Context, key string, abs *ArqBackupSet, ab *ArqBucket, pio *PackIndexObject, packName string) (*PackFileObject, error) {
+	packFilepath, err := abs.Connection.CachedGet(ctx, key)
 	if err != nil {
 		log.Debugf("GetObjectFromPackFile failed first time to get key %s: %s", key, err)
 	}
 	isValid, err := IsValidPackFile(packFilepath)
 	if (!isValid) {
 		log.Debugf("GetObjectFromPackFile invalid pack file %s first time, will retry. err: %s", packFilepath, err)
-		if err := os.Remove(packFilepath); err != nil {
+		if err := abs.removeInvalidCacheFile(ctx, key, packFilepath, IsValidPackFile); err != nil {
 			log.Debugf("GetObjectFromPackFile failed to delete pack file %s after detecting corruption. err: ", packFilepath, err)
 			return nil, err
 		}
-		packFilepath, err := abs.Connection.CachedGet(key)
+		packFilepath, err := abs.Connection.CachedGet(ctx, key)
 		if err != nil {
 			log.Debugf("GetObjectFromPackFile failed second time to get key %s: %s", key, err)
 		}
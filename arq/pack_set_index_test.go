@@ -0,0 +1,230 @@
+/*
+arqinator: arq/pack_set_index_test.go
+Tests finding objects in pack index files, and that a pack set is listed and read only once.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package arq
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/asimihsan/arqinator/connector"
+)
+
+/*
+A pack index of objects whose SHA1s are all zero but for their first and last bytes, which must be in
+order, followed by the SHA1 of its contents.
+*/
+func newTestPackIndex(firstBytes []byte) []byte {
+	var header PackIndex
+	for _, first := range firstBytes {
+		for i := int(first); i < len(header.Fanout); i++ {
+			header.Fanout[i]++
+		}
+	}
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, &header)
+	for i, first := range firstBytes {
+		pio := PackIndexObject{Offset: uint64(i * 100), Length: 100}
+		pio.SHA1[0] = first
+		pio.SHA1[19] = byte(i)
+		binary.Write(&b, binary.BigEndian, &pio)
+	}
+	checksum := sha1.Sum(b.Bytes())
+	b.Write(checksum[:])
+	return b.Bytes()
+}
+
+func newTestSHA1(first byte, last byte) [20]byte {
+	var targetSHA1 [20]byte
+	targetSHA1[0] = first
+	targetSHA1[19] = last
+	return targetSHA1
+}
+
+/*
+Serves pack indexes from memory, downloading them to cacheDirectory, and counts its calls.
+*/
+type packSetConnection struct {
+	cacheDirectory string
+	objects        map[string][]byte
+	mutex          sync.Mutex
+	calls          int
+}
+
+type packSetObject struct {
+	key  string
+	size int64
+}
+
+func (o packSetObject) GetPath() string { return o.key }
+func (o packSetObject) GetSize() int64  { return o.size }
+
+func (c *packSetConnection) call() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.calls++
+}
+
+func (c *packSetConnection) getCalls() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.calls
+}
+
+func (c *packSetConnection) String() string            { return "packset" }
+func (c *packSetConnection) GetCacheDirectory() string { return c.cacheDirectory }
+func (c *packSetConnection) Close() error              { return nil }
+
+func (c *packSetConnection) ListObjectsAsFolders(ctx context.Context, prefix string) ([]connector.Object, error) {
+	c.call()
+	return nil, nil
+}
+
+func (c *packSetConnection) ListObjectsAsAll(ctx context.Context, prefix string) ([]connector.Object, error) {
+	c.call()
+	objects := make([]connector.Object, 0)
+	for key, contents := range c.objects {
+		if path.Dir(key) == prefix {
+			objects = append(objects, packSetObject{key, int64(len(contents))})
+		}
+	}
+	return objects, nil
+}
+
+func (c *packSetConnection) Get(ctx context.Context, key string) (string, error) {
+	c.call()
+	contents, ok := c.objects[key]
+	if !ok {
+		return "", &os.PathError{Op: "get", Path: key, Err: os.ErrNotExist}
+	}
+	cacheFilepath := filepath.Join(c.cacheDirectory, key)
+	if err := os.MkdirAll(filepath.Dir(cacheFilepath), 0755); err != nil {
+		return "", err
+	}
+	return cacheFilepath, ioutil.WriteFile(cacheFilepath, contents, 0644)
+}
+
+func (c *packSetConnection) CachedGet(ctx context.Context, key string) (string, error) {
+	return c.Get(ctx, key)
+}
+
+func (c *packSetConnection) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error) {
+	c.call()
+	return nil, &os.PathError{Op: "get", Path: key, Err: os.ErrNotExist}
+}
+
+/*
+A backup set whose blob pack set has two indexes, of objects starting 0x01 and 0x02.
+*/
+func newTestPackSet(t *testing.T) (*ArqPackSetIndex, *packSetConnection, string) {
+	conn := &packSetConnection{cacheDirectory: t.TempDir(), objects: make(map[string][]byte)}
+	abs := &ArqBackupSet{Connection: conn, UUID: TEST_BACKUP_SET_UUID, Format: BACKUP_FORMAT_ARQ5}
+	ab := &ArqBucket{UUID: "bucket", ArqBackupSet: abs}
+	prefix := GetPathToBucketPackSetBlobs(abs, ab)
+	conn.objects[path.Join(prefix, "a.index")] = newTestPackIndex([]byte{0x01})
+	conn.objects[path.Join(prefix, "b.index")] = newTestPackIndex([]byte{0x02})
+	conn.objects[path.Join(prefix, "b.pack")] = []byte("pack")
+	apsi, err := NewPackSetIndex(conn.cacheDirectory, abs, ab)
+	if err != nil {
+		t.Fatalf("NewPackSetIndex failed: %s", err)
+	}
+	return apsi, conn, prefix
+}
+
+func TestSearchPackIndexes(t *testing.T) {
+	firstBytes := []byte{0x00, 0x00, 0x01, 0x7f, 0xff, 0xff}
+	index := filepath.Join(t.TempDir(), "pack.index")
+	if err := ioutil.WriteFile(index, newTestPackIndex(firstBytes), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+	parsed, err := parsePackIndex(index)
+	if err != nil {
+		t.Fatalf("parsePackIndex failed: %s", err)
+	}
+	for i, first := range firstBytes {
+		targetSHA1 := newTestSHA1(first, byte(i))
+		if pio := parsed.search(targetSHA1); pio == nil || pio.Offset != uint64(i*100) {
+			t.Errorf("Expected to find %x at offset %d, got %v", targetSHA1, i*100, pio)
+		}
+	}
+
+	for _, first := range []byte{0x00, 0x02, 0xff} {
+		targetSHA1 := newTestSHA1(first, 0xee)
+		if pio := parsed.search(targetSHA1); pio != nil {
+			t.Errorf("Expected not to find %x, got %v", targetSHA1, pio)
+		}
+	}
+}
+
+func TestFindPackIndexObjectListsPackSetOnce(t *testing.T) {
+	apsi, conn, prefix := newTestPackSet(t)
+	ctx := context.Background()
+	pio, index, err := apsi.findPackIndexObject(ctx, prefix, newTestSHA1(0x02, 0))
+	if err != nil || pio == nil || filepath.Base(index) != "b.index" {
+		t.Fatalf("Expected to find the object in b.index, got %v, %s, %v", pio, index, err)
+	}
+	if pio, _, err := apsi.findPackIndexObject(ctx, prefix, newTestSHA1(0x03, 0)); pio != nil || err != nil {
+		t.Fatalf("Expected a miss, got %v, %v", pio, err)
+	}
+
+	// Every index has been read, so neither a hit nor a miss needs the connection
+	calls := conn.getCalls()
+	apsi, err = NewPackSetIndex(apsi.CacheDirectory, apsi.ArqBackupSet, apsi.ArqBucket)
+	if err != nil {
+		t.Fatalf("NewPackSetIndex failed: %s", err)
+	}
+	if pio, _, err := apsi.findPackIndexObject(ctx, prefix, newTestSHA1(0x01, 0)); pio == nil || err != nil {
+		t.Errorf("Expected to find the object in a.index, got %v, %v", pio, err)
+	}
+	if pio, _, err := apsi.findPackIndexObject(ctx, prefix, newTestSHA1(0x03, 0)); pio != nil || err != nil {
+		t.Errorf("Expected a miss, got %v, %v", pio, err)
+	}
+	if conn.getCalls() != calls {
+		t.Errorf("Expected no more connection calls, got %d", conn.getCalls()-calls)
+	}
+}
+
+func TestFindPackIndexObjectAfterCachingPackSet(t *testing.T) {
+	apsi, conn, prefix := newTestPackSet(t)
+	ctx := context.Background()
+	if err := apsi.ArqBackupSet.cacheBlobPackSet(ctx, apsi.ArqBucket); err != nil {
+		t.Fatalf("cacheBlobPackSet failed: %s", err)
+	}
+
+	// The pack set is fully cached, so a miss reads the cached indexes but doesn't list it
+	calls := conn.getCalls()
+	if pio, _, err := apsi.findPackIndexObject(ctx, prefix, newTestSHA1(0x03, 0)); pio != nil || err != nil {
+		t.Errorf("Expected a miss, got %v, %v", pio, err)
+	}
+	if pio, _, err := apsi.findPackIndexObject(ctx, prefix, newTestSHA1(0x02, 0)); pio == nil || err != nil {
+		t.Errorf("Expected to find the object in b.index, got %v, %v", pio, err)
+	}
+	if conn.getCalls() != calls {
+		t.Errorf("Expected no more connection calls, got %d", conn.getCalls()-calls)
+	}
+}
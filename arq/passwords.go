@@ -0,0 +1,144 @@
+/*
+arqinator: arq/passwords.go
+Implements choosing encryption passwords for backup sets that use different ones.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+/*
+A password file has one entry per line. Blank lines and lines starting with '#' are ignored.
+
+	# Tried in turn against every backup set that isn't mapped below.
+	candidate-password
+	# Maps a backup set UUID or computer name to its password.
+	Alice's MacBook Pro = alices-password
+	AAAAAAAA-BBBB-CCCC-DDDD-EEEEEEEEEEEE = bobs-password
+
+Only the first " = " on a line separates a name from a password, so a candidate password can't
+contain " = "; map it to its backup set instead.
+*/
+
+package arq
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/asimihsan/arqinator/connector"
+)
+
+const (
+	PASSWORD_FILE_SEPARATOR = " = "
+)
+
+type Passwords struct {
+	// Keyed by backup set UUID or computer name.
+	mapped     map[string][]byte
+	candidates [][]byte
+}
+
+func NewPasswords() *Passwords {
+	return &Passwords{mapped: make(map[string][]byte)}
+}
+
+/*
+Add a password for the backup set with this UUID or computer name. An empty name adds a candidate
+password instead, which is tried against every backup set that isn't mapped.
+*/
+func (p *Passwords) Add(name string, password []byte) {
+	if name == "" {
+		p.candidates = append(p.candidates, password)
+		return
+	}
+	p.mapped[name] = password
+}
+
+func (p *Passwords) AddFile(filepath string) error {
+	f, err := os.Open(filepath)
+	if err != nil {
+		log.Debugf("AddFile failed to open password file %s: %s", filepath, err)
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		name := ""
+		password := line
+		if i := strings.Index(line, PASSWORD_FILE_SEPARATOR); i != -1 {
+			name = strings.TrimSpace(line[:i])
+			password = line[i+len(PASSWORD_FILE_SEPARATOR):]
+			if name == "" {
+				return errors.New(fmt.Sprintf("Password file %s line %d has an empty name", filepath, lineNumber))
+			}
+		}
+		p.Add(name, []byte(password))
+	}
+	if err := scanner.Err(); err != nil {
+		log.Debugf("AddFile failed to read password file %s: %s", filepath, err)
+		return err
+	}
+	return nil
+}
+
+/*
+Passwords to try for a backup set, in order. A password mapped to the UUID wins over one mapped to the
+computer name, and only unmapped backup sets get the candidates.
+*/
+func (p *Passwords) passwordsFor(uuid string, computerName string) [][]byte {
+	if password, ok := p.mapped[uuid]; ok {
+		return [][]byte{password}
+	}
+	if password, ok := p.mapped[computerName]; ok && computerName != "" {
+		return [][]byte{password}
+	}
+	if len(p.candidates) == 0 {
+		// Unencrypted Arq 7 backup sets don't need one.
+		return [][]byte{nil}
+	}
+	return p.candidates
+}
+
+/*
+The computer name of a backup set, which both computerinfo and backupconfig.json store unencrypted.
+Returns "" if it can't be read; the error is reported when the backup set itself is read.
+*/
+func peekComputerName(ctx context.Context, connection connector.Connection, uuid string, format BackupFormat) string {
+	abs := ArqBackupSet{Connection: connection, UUID: uuid, Format: format}
+	if format == BACKUP_FORMAT_ARQ7 {
+		var config arq7BackupConfig
+		if err := abs.readArq7JSON(ctx, path.Join(uuid, "backupconfig.json"), false, &config); err != nil {
+			return ""
+		}
+		return config.ComputerName
+	}
+	computerInfo, err := abs.getComputerInfo(ctx)
+	if err != nil {
+		return ""
+	}
+	return computerInfo.ComputerName
+}
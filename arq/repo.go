@@ -23,16 +23,24 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/asimihsan/arqinator/arq/types"
+	"github.com/asimihsan/arqinator/progress"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"time"
+)
+
+const (
+	// Appended to the names of files while they're being restored
+	RESTORE_PARTIAL_SUFFIX = ".arqinator-partial"
 )
 
 var (
@@ -73,28 +81,82 @@ func getWriterForFile(destinationPath string, mode os.FileMode, size int64) (*os
 	return f, w, nil
 }
 
-func DownloadNode(node *arq_types.Node, cacheDirectory string, backupSet *ArqBackupSet,
+/*
+Whether the file at finalPath is node as restored by an earlier restore, i.e. it has the node's size
+and the modification time restoring sets. Some file systems only keep whole seconds.
+*/
+func isRestored(finalPath string, node *arq_types.Node) bool {
+	fileInfo, err := os.Lstat(finalPath)
+	if err != nil || !fileInfo.Mode().IsRegular() || fileInfo.Size() != int64(node.UncompressedDataSize) {
+		return false
+	}
+	mtime := time.Unix(node.MtimeSec, node.MtimeNsec)
+	if fileInfo.ModTime().Nanosecond() == 0 {
+		mtime = mtime.Truncate(time.Second)
+	}
+	return fileInfo.ModTime().Equal(mtime)
+}
+
+/*
+Restore a file. It's written under a temporary name, given the node's modification time and renamed when
+complete, so a file with the final name, the right size and that modification time was restored by an
+earlier restore, perhaps one that was interrupted, and is skipped. If ctx is done the temporary file is
+removed and ctx.Err() returned.
+*/
+func DownloadNode(ctx context.Context, node *arq_types.Node, cacheDirectory string, backupSet *ArqBackupSet,
 	bucket *ArqBucket, sourcePath string, destinationPath string) error {
 	log.Debugf("DownloadNode entry. sourcePath: %s, destinationPath: %s, node: %s", sourcePath, destinationPath, node)
-	apsi, _ := NewPackSetIndex(cacheDirectory, backupSet, bucket)
-	f, w, err := getWriterForFile(destinationPath, node.Mode, int64(node.UncompressedDataSize))
+	size := int64(node.UncompressedDataSize)
+	tracker := progress.Current()
+	finalPath := maybeConvertToWindowsPath(destinationPath)
+	if isRestored(finalPath, node) {
+		log.Debugf("DownloadNode skipping %s, already restored", destinationPath)
+		tracker.Complete(1, size)
+		return nil
+	}
+	partialPath := destinationPath + RESTORE_PARTIAL_SUFFIX
+	f, w, err := getWriterForFile(partialPath, node.Mode, size)
 	if err != nil {
 		log.Errorf("Failed during DownloadNode getWriterForFile for node %s: %s", node, err)
 		return err
 	}
-	defer f.Close()
-	defer w.Flush()
-	r, err := getReaderForBlobKeys(node.DataBlobKeys, apsi, backupSet, bucket)
+	r, err := GetNodeReader(ctx, cacheDirectory, backupSet, bucket, node)
+	if err == nil {
+		_, err = io.Copy(progress.NewCompletingWriter(w, tracker), r)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		mtime := time.Unix(node.MtimeSec, node.MtimeNsec)
+		err = os.Chtimes(maybeConvertToWindowsPath(partialPath), mtime, mtime)
+	}
+	if err == nil {
+		err = os.Rename(maybeConvertToWindowsPath(partialPath), finalPath)
+	}
+	tracker.Complete(1, 0)
 	if err != nil {
-		log.Errorf("Failed during DownloadNode GetReaderForBlobKeys for node %s: %s", node, err)
+		os.Remove(maybeConvertToWindowsPath(partialPath))
+		if ctx.Err() != nil {
+			log.Debugf("DownloadNode cancelled for %s", destinationPath)
+			return ctx.Err()
+		}
+		log.Errorf("Failed during DownloadNode copy for node %s: %s", node, err)
 		return err
 	}
-	io.Copy(w, r)
 	log.Debugf("DownloadNode exit. destinationPath: %s, node: %s", destinationPath, node)
 	return nil
 }
 
-func DownloadTree(tree *arq_types.Tree, cacheDirectory string, backupSet *ArqBackupSet,
+/*
+Restore a directory. Errors restoring what's in it are logged and skipped, unless ctx is done, in which
+case ctx.Err() is returned straight away. Restoring to the same destinationPath again carries on where
+an interrupted restore stopped, see DownloadNode.
+*/
+func DownloadTree(ctx context.Context, tree *arq_types.Tree, cacheDirectory string, backupSet *ArqBackupSet,
 	bucket *ArqBucket, sourcePath string, destinationPath string) error {
 	log.Debugf("DownloadTree entry. sourcePath: %s, destinationPath: %s, tree: %s", sourcePath, destinationPath, tree)
 
@@ -107,7 +169,7 @@ func DownloadTree(tree *arq_types.Tree, cacheDirectory string, backupSet *ArqBac
 	}
 
 	directoryToCreate := maybeConvertToWindowsPath(destinationPath)
-	if err := os.Mkdir(directoryToCreate, tree.Mode); err != nil {
+	if err := os.Mkdir(directoryToCreate, tree.Mode); err != nil && !os.IsExist(err) {
 		log.Errorf("DownloadTree failed during MkdirAll %s: %s", directoryToCreate, err)
 	}
 	if tree.Mode == os.FileMode(int(0)) {
@@ -116,90 +178,133 @@ func DownloadTree(tree *arq_types.Tree, cacheDirectory string, backupSet *ArqBac
 			log.Errorf("Failed to set permissions of tree %s: %s", tree, err)
 		}
 	}
+	var files int64
 	for _, node := range tree.Nodes {
-		subSourcePath := path.Join(sourcePath, string(node.Name.Data))
-		subDestinationPath := path.Join(destinationPath, string(node.Name.Data))
-		subTree, subNode, err := FindNode(cacheDirectory, backupSet, bucket, subSourcePath)
-		if err != nil {
-			log.Errorf("DownloadTree failed FindNode: %s", err)
+		if !node.IsTree.IsTrue() {
+			files++
+		}
+	}
+	progress.Current().Plan(files, 0)
+	// Descend through the nodes of this tree rather than looking each path up from the head commit, so that
+	// trees of older commits can be downloaded too.
+	for _, node := range tree.Nodes {
+		if err := ctx.Err(); err != nil {
 			return err
 		}
-		if subNode == nil || subNode.IsTree.IsTrue() {
-			err = DownloadTree(subTree, cacheDirectory, backupSet, bucket, subSourcePath, subDestinationPath)
+		subSourcePath := path.Join(sourcePath, string(node.Name.Data))
+		subDestinationPath := path.Join(destinationPath, string(node.Name.Data))
+		var err error
+		if node.IsTree.IsTrue() {
+			var subTree *arq_types.Tree
+			if subTree, err = GetNodeTree(ctx, cacheDirectory, backupSet, bucket, node); err != nil {
+				log.Debugf("DownloadTree failed GetNodeTree for %s: %s", subSourcePath, err)
+			}
+			err = DownloadTree(ctx, subTree, cacheDirectory, backupSet, bucket, subSourcePath, subDestinationPath)
 		} else {
-			err = DownloadNode(subNode, cacheDirectory, backupSet, bucket, subSourcePath, subDestinationPath)
+			err = DownloadNode(ctx, node, cacheDirectory, backupSet, bucket, subSourcePath, subDestinationPath)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
 		if err != nil {
-			log.Errorf("DownloadTree failed during subNode %s: %s. Will continue!", subNode, err)
+			log.Errorf("DownloadTree failed during subNode %s: %s. Will continue!", node, err)
 		}
 	}
 	log.Debugf("DownloadTree exit. destinationPath: %s, tree: %s", destinationPath, tree)
 	return nil
 }
 
+/*
+Return the tree of a directory node.
+*/
+func GetNodeTree(ctx context.Context, cacheDirectory string, backupSet *ArqBackupSet, bucket *ArqBucket, node *arq_types.Node) (*arq_types.Tree, error) {
+	if backupSet.Format == BACKUP_FORMAT_ARQ7 {
+		return backupSet.readArq7Tree(ctx, node)
+	}
+	apsi, _ := NewPackSetIndex(cacheDirectory, backupSet, bucket)
+	return apsi.GetPackFileAsTree(ctx, backupSet, bucket, *node.DataBlobKeys[0].SHA1)
+}
+
+/*
+Return a reader of the contents of a file node.
+*/
+func GetNodeReader(ctx context.Context, cacheDirectory string, backupSet *ArqBackupSet, bucket *ArqBucket, node *arq_types.Node) (NodeReader, error) {
+	size := int64(node.UncompressedDataSize)
+	if backupSet.Format == BACKUP_FORMAT_ARQ7 {
+		return getReaderForBlobLocs(ctx, node.DataBlobLocs, size, backupSet), nil
+	}
+	apsi, _ := NewPackSetIndex(cacheDirectory, backupSet, bucket)
+	r, err := getReaderForBlobKeys(ctx, node.DataBlobKeys, size, apsi, backupSet, bucket)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+/*
+Reads a file whose chunks are blobs in pack files or objects. Reads stop once ctx is done.
+*/
 type BlobKeysReader struct {
-	blobKeys            []*arq_types.BlobKey
-	apsi                *ArqPackSetIndex
-	backupSet           *ArqBackupSet
-	bucket              *ArqBucket
-	currentBlobKeyIndex int
-	currentDataReader   io.Reader
+	*chunkReader
+	ctx       context.Context
+	blobKeys  []*arq_types.BlobKey
+	apsi      *ArqPackSetIndex
+	backupSet *ArqBackupSet
+	bucket    *ArqBucket
 }
 
-func getReaderForBlobKeys(blobKeys []*arq_types.BlobKey, apsi *ArqPackSetIndex, backupSet *ArqBackupSet,
+func getReaderForBlobKeys(ctx context.Context, blobKeys []*arq_types.BlobKey, size int64, apsi *ArqPackSetIndex, backupSet *ArqBackupSet,
 	bucket *ArqBucket) (*BlobKeysReader, error) {
-	return &BlobKeysReader{
-		blobKeys:            blobKeys,
-		apsi:                apsi,
-		backupSet:           backupSet,
-		bucket:              bucket,
-		currentBlobKeyIndex: 0,
-	}, nil
+	r := &BlobKeysReader{
+		ctx:       ctx,
+		blobKeys:  blobKeys,
+		apsi:      apsi,
+		backupSet: backupSet,
+		bucket:    bucket,
+	}
+	r.chunkReader = newChunkReader(r, size)
+	return r, nil
 }
 
-func (r *BlobKeysReader) Read(p []byte) (int, error) {
-	if r.currentDataReader != nil {
-		return r.readChunk(p)
-	}
-	if r.currentBlobKeyIndex >= len(r.blobKeys) {
-		return 0, io.EOF
-	}
-	blobKey := r.blobKeys[r.currentBlobKeyIndex]
+func (r *BlobKeysReader) chunkCount() int {
+	return len(r.blobKeys)
+}
+
+func (r *BlobKeysReader) chunkID(i int) string {
+	return hex.EncodeToString((*r.blobKeys[i].SHA1)[:])
+}
+
+func (r *BlobKeysReader) readChunk(i int) ([]byte, error) {
+	blobKey := r.blobKeys[i]
 	log.Debugf("node dataBlobKey: %s", blobKey)
-	var contents []byte
-	contents, err := r.apsi.GetBlobPackFile(r.backupSet, r.bucket, *blobKey.SHA1)
+	contents, err := r.apsi.GetBlobPackFile(r.ctx, r.backupSet, r.bucket, *blobKey.SHA1)
 	if err != nil {
+		if r.ctx.Err() != nil {
+			return nil, r.ctx.Err()
+		}
 		log.Debugf("Couldn't find data in packfile, look at objects.")
-		contents, err = GetDataBlobKeyContentsFromObjects(*blobKey.SHA1, r.bucket)
+		contents, err = GetDataBlobKeyContentsFromObjects(r.ctx, *blobKey.SHA1, r.bucket)
 		if err != nil {
+			if r.ctx.Err() != nil {
+				return nil, r.ctx.Err()
+			}
 			err2 := errors.New(fmt.Sprintf("Couldn't find SHA %s in packfile or objects!",
 				hex.EncodeToString((*blobKey.SHA1)[:])))
 			log.Debugf("%s", err2)
-			return 0, err2
+			return nil, err2
 		}
 	}
 	log.Debugf("len(contents): %d", len(contents))
-	r.currentDataReader = bytes.NewReader(contents)
-	return r.readChunk(p)
-}
-
-func (r *BlobKeysReader) readChunk(p []byte) (int, error) {
-	n, err := r.currentDataReader.Read(p)
-	if err == io.EOF {
-		r.currentDataReader = nil
-		r.currentBlobKeyIndex++
-		err = nil
-	}
-	return n, err
+	return contents, nil
 }
 
-func GetDataBlobKeyContentsFromObjects(SHA1 [20]byte, bucket *ArqBucket) ([]byte, error) {
+func GetDataBlobKeyContentsFromObjects(ctx context.Context, SHA1 [20]byte, bucket *ArqBucket) ([]byte, error) {
 	SHA1String := hex.EncodeToString(SHA1[:])
 	log.Debugf("GetDataBlobKeyContents SHA1 %s, bucket %s", SHA1String, bucket)
 	backupSet := bucket.ArqBackupSet
 	key := path.Join(backupSet.UUID, "objects", SHA1String)
 	log.Debugf("key: %s", key)
-	dataFilepath, err := backupSet.Connection.CachedGet(key)
+	dataFilepath, err := backupSet.getVerifiedObject(ctx, key)
 	if err != nil {
 		err2 := errors.New(fmt.Sprintf("downloadDataFromDataBlobKey: failed to download SHA1 %s: %s", SHA1String, err))
 		log.Errorf("%s", err2)
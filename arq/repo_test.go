@@ -0,0 +1,101 @@
+/*
+arqinator: arq/repo_test.go
+Tests restoring files, carrying on with an interrupted restore, and restoring concurrently.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package arq
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDownloadNodeSkipsOnlyRestoredFiles(t *testing.T) {
+	snapshot, _ := newTestSnapshot(t)
+	ctx := context.Background()
+	destinationPath := filepath.Join(t.TempDir(), "a.txt")
+	if err := snapshot.Restore(ctx, "/a.txt", destinationPath); err != nil {
+		t.Fatalf("Restore failed: %s", err)
+	}
+	fileInfo, err := os.Stat(destinationPath)
+	if err != nil {
+		t.Fatalf("Stat failed: %s", err)
+	}
+	if mtime := time.Unix(1460000000, 500); !fileInfo.ModTime().Equal(mtime) {
+		t.Errorf("Expected modification time %s, got %s", mtime, fileInfo.ModTime())
+	}
+
+	// A file of the same size that restore didn't write is restored again
+	if err := ioutil.WriteFile(destinationPath, []byte("HELLO WORLD"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+	if err := snapshot.Restore(ctx, "/a.txt", destinationPath); err != nil {
+		t.Fatalf("Restore failed: %s", err)
+	}
+	if contents, _ := ioutil.ReadFile(destinationPath); string(contents) != "hello world" {
+		t.Errorf("Expected a file with the wrong contents to be restored again, got %s", contents)
+	}
+
+	// A file with the node's size and modification time is skipped
+	if err := ioutil.WriteFile(destinationPath, []byte("HELLO WORLD"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+	if err := os.Chtimes(destinationPath, fileInfo.ModTime(), fileInfo.ModTime()); err != nil {
+		t.Fatalf("Chtimes failed: %s", err)
+	}
+	if err := snapshot.Restore(ctx, "/a.txt", destinationPath); err != nil {
+		t.Fatalf("Restore failed: %s", err)
+	}
+	if contents, _ := ioutil.ReadFile(destinationPath); string(contents) != "HELLO WORLD" {
+		t.Errorf("Expected an already restored file to be skipped, got %s", contents)
+	}
+}
+
+func TestRestoreConcurrently(t *testing.T) {
+	snapshot, _ := newTestSnapshot(t)
+	ctx := context.Background()
+	destinationDirectory := t.TempDir()
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			errs[i] = snapshot.Restore(ctx, "/dir", filepath.Join(destinationDirectory, fmt.Sprint(i)))
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("Restore %d failed: %s", i, err)
+			continue
+		}
+		contents, _ := ioutil.ReadFile(filepath.Join(destinationDirectory, fmt.Sprint(i), "sub", "c.txt"))
+		if string(contents) != "abcdefghi" {
+			t.Errorf("Restore %d: expected sub/c.txt to be abcdefghi, got %s", i, contents)
+		}
+	}
+}
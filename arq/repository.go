@@ -0,0 +1,194 @@
+/*
+arqinator: arq/repository.go
+Implements the entry point for programs reading Arq backups.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+/*
+A Repository is every backup set a connection can decrypt. Each backup set has folders, each folder has
+snapshots, one per backup, and each snapshot has the files that backup saved:
+
+	repository, err := arq.Open(ctx, connection, passwords)
+	folder := repository.Folders()[0]
+	snapshot, err := folder.Latest(ctx)
+	err = snapshot.Walk(ctx, "/", func(file *arq.File, err error) error {
+		fmt.Println(file.Path)
+		return err
+	})
+	r, err := snapshot.Open(ctx, "/notes.txt")
+
+Paths within a snapshot are relative to the top of the backed up folder, which is "/". Pack indexes
+are downloaded as they're needed. Folder.CacheTrees and Folder.CacheBlobs download all of a folder's at
+once, which is quicker when most of them will be needed, e.g. to restore the whole folder.
+Calls that read the backup stop and return ctx.Err() once ctx is done, leaving the cache and any
+restored files in a state that a later call can carry on from.
+
+Repositories, folders and snapshots are safe for concurrent use, as are the FileReaders snapshots open.
+Restoring to the same destination from two goroutines at once isn't.
+*/
+
+package arq
+
+import (
+	"context"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/asimihsan/arqinator/connector"
+)
+
+type Repository struct {
+	connection     connector.Connection
+	cacheDirectory string
+	backupSets     []*ArqBackupSet
+	folders        []*Folder
+}
+
+/*
+A folder that Arq backs up, i.e. a bucket of a backup set.
+*/
+type Folder struct {
+	UUID         string
+	LocalPath    string
+	ComputerName string
+	BackupSet    *ArqBackupSet
+	Bucket       *ArqBucket
+
+	repository *Repository
+
+	// Held while caching, so that a second caller waits for the first rather than caching again
+	cacheMutex     sync.Mutex
+	hasCachedTrees bool
+	hasCachedBlobs bool
+}
+
+/*
+Open the backup sets that connection can see and decrypt with passwords. Backup sets that can't be
+decrypted are left out, see GetAllArqBackupSets for why.
+*/
+func Open(ctx context.Context, connection connector.Connection, passwords *Passwords) (*Repository, error) {
+	backupSets, err := GetArqBackupSets(ctx, connection, passwords)
+	if err != nil {
+		log.Debugf("Open failed to get backup sets: %s", err)
+		return nil, err
+	}
+	r := &Repository{
+		connection:     connection,
+		cacheDirectory: connection.GetCacheDirectory(),
+		backupSets:     backupSets,
+		folders:        make([]*Folder, 0),
+	}
+	for _, backupSet := range backupSets {
+		for _, bucket := range backupSet.Buckets {
+			r.folders = append(r.folders, &Folder{
+				UUID:         bucket.UUID,
+				LocalPath:    bucket.LocalPath,
+				ComputerName: backupSet.ComputerInfo.ComputerName,
+				BackupSet:    backupSet,
+				Bucket:       bucket,
+				repository:   r,
+			})
+		}
+	}
+	return r, nil
+}
+
+func (r *Repository) BackupSets() []*ArqBackupSet {
+	return r.backupSets
+}
+
+/*
+The folders of every backup set.
+*/
+func (r *Repository) Folders() []*Folder {
+	return r.folders
+}
+
+/*
+The snapshots of every folder, newest first within each folder.
+*/
+func (r *Repository) Snapshots(ctx context.Context) ([]*Snapshot, error) {
+	snapshots := make([]*Snapshot, 0)
+	for _, folder := range r.folders {
+		folderSnapshots, err := folder.Snapshots(ctx)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, folderSnapshots...)
+	}
+	return snapshots, nil
+}
+
+/*
+Cache all the indexes of the folder's pack sets that hold trees, which are needed to list directories.
+*/
+func (f *Folder) CacheTrees(ctx context.Context) error {
+	f.cacheMutex.Lock()
+	defer f.cacheMutex.Unlock()
+	if f.hasCachedTrees {
+		return nil
+	}
+	if err := f.BackupSet.cacheTreePackSet(ctx, f.Bucket); err != nil {
+		log.Debugf("CacheTrees failed for folder %s: %s", f.UUID, err)
+		return err
+	}
+	f.hasCachedTrees = true
+	return nil
+}
+
+/*
+Cache all the indexes of the folder's pack sets that hold file contents, which are needed to read files.
+*/
+func (f *Folder) CacheBlobs(ctx context.Context) error {
+	f.cacheMutex.Lock()
+	defer f.cacheMutex.Unlock()
+	if f.hasCachedBlobs {
+		return nil
+	}
+	if err := f.BackupSet.cacheBlobPackSet(ctx, f.Bucket); err != nil {
+		log.Debugf("CacheBlobs failed for folder %s: %s", f.UUID, err)
+		return err
+	}
+	f.hasCachedBlobs = true
+	return nil
+}
+
+/*
+The latest snapshot of the folder.
+*/
+func (f *Folder) Latest(ctx context.Context) (*Snapshot, error) {
+	commit, err := GetHeadCommit(ctx, f.repository.cacheDirectory, f.BackupSet, f.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	return newSnapshot(f, commit), nil
+}
+
+/*
+Every snapshot of the folder, newest first.
+*/
+func (f *Folder) Snapshots(ctx context.Context) ([]*Snapshot, error) {
+	commits, err := ListCommits(ctx, f.repository.cacheDirectory, f.BackupSet, f.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make([]*Snapshot, len(commits))
+	for i, commit := range commits {
+		snapshots[i] = newSnapshot(f, commit)
+	}
+	return snapshots, nil
+}
@@ -0,0 +1,51 @@
+/*
+arqinator: arq/repository_test.go
+Tests caching a folder's pack indexes from several goroutines at once.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package arq
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestFolderCachesConcurrently(t *testing.T) {
+	snapshot, _ := newTestSnapshot(t)
+	folder := snapshot.Folder
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			if errs[i] = folder.CacheTrees(context.Background()); errs[i] == nil {
+				errs[i] = folder.CacheBlobs(context.Background())
+			}
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("Caching %d failed: %s", i, err)
+		}
+	}
+}
@@ -0,0 +1,385 @@
+/*
+arqinator: arq/snapshot.go
+Implements browsing and reading the files of one backup of a folder.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package arq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/asimihsan/arqinator/arq/types"
+)
+
+const (
+	// st_mode file type bits, which Arq stores as is
+	ST_MODE_TYPE_MASK = 0170000
+	ST_MODE_SYMLINK   = 0120000
+)
+
+var (
+	// Returned by a WalkFunc to skip the contents of a directory.
+	SkipDir = errors.New("skip this directory")
+)
+
+/*
+One backup of a folder. The trees read from it are kept, so browsing the same directories again
+doesn't read them again. A snapshot is safe for concurrent use, as is a FileReader, but two restores
+to the same destination at once aren't.
+*/
+type Snapshot struct {
+	Folder       *Folder
+	ID           string
+	CreationDate time.Time
+	// Local path of the folder when it was backed up
+	Path       string
+	IsComplete bool
+
+	commit *ArqCommit
+
+	// Keyed by path
+	trees      map[string]*arq_types.Tree
+	treesMutex sync.Mutex
+}
+
+/*
+A file or directory of a snapshot.
+*/
+type File struct {
+	// Last element of Path, or the local path of the folder for the top directory.
+	Name    string
+	Path    string
+	Size    int64
+	Mode    os.FileMode
+	ModTime time.Time
+
+	// nil for the top directory
+	Node *arq_types.Node
+}
+
+func (f *File) IsDir() bool {
+	return f.Mode.IsDir()
+}
+
+type WalkFunc func(file *File, err error) error
+
+func newSnapshot(folder *Folder, commit *ArqCommit) *Snapshot {
+	return &Snapshot{
+		Folder:       folder,
+		ID:           commit.ID,
+		CreationDate: commit.CreationDate,
+		Path:         commit.Path,
+		IsComplete:   commit.IsComplete,
+		commit:       commit,
+		trees:        make(map[string]*arq_types.Tree),
+	}
+}
+
+func newFile(p string, node *arq_types.Node) *File {
+	mode := node.Mode & os.ModePerm
+	if node.IsTree.IsTrue() {
+		mode |= os.ModeDir
+	} else if uint32(node.Mode)&ST_MODE_TYPE_MASK == ST_MODE_SYMLINK {
+		mode |= os.ModeSymlink
+	}
+	return &File{
+		Name:    node.Name.ToString(),
+		Path:    p,
+		Size:    int64(node.UncompressedDataSize),
+		Mode:    mode,
+		ModTime: time.Unix(node.MtimeSec, node.MtimeNsec),
+		Node:    node,
+	}
+}
+
+func newPathError(op string, p string, err error) error {
+	return &os.PathError{Op: op, Path: p, Err: err}
+}
+
+/*
+Convert a local path within the backed up folder, e.g. /Users/alice/Documents/notes.txt, to a path in
+the snapshot, e.g. /notes.txt.
+*/
+func (s *Snapshot) RelativePath(localPath string) (string, error) {
+	root := strings.TrimSuffix(s.Path, "/")
+	localPath = path.Clean(localPath)
+	if localPath != root && !strings.HasPrefix(localPath, root+"/") {
+		return "", errors.New(fmt.Sprintf("Path %s is not located within backed up folder %s", localPath, s.Path))
+	}
+	return path.Clean("/" + strings.TrimPrefix(localPath, root)), nil
+}
+
+/*
+The tree is read without holding treesMutex, so a slow read doesn't hold up others. Two callers may both
+read the same tree, and either copy is kept.
+*/
+func (s *Snapshot) getTree(ctx context.Context, p string, node *arq_types.Node) (*arq_types.Tree, error) {
+	s.treesMutex.Lock()
+	tree, ok := s.trees[p]
+	s.treesMutex.Unlock()
+	if ok {
+		return tree, nil
+	}
+	folder := s.Folder
+	var err error
+	if p == "/" {
+		tree, err = GetCommitTree(ctx, folder.repository.cacheDirectory, folder.BackupSet, folder.Bucket, s.commit)
+	} else {
+		tree, err = GetNodeTree(ctx, folder.repository.cacheDirectory, folder.BackupSet, folder.Bucket, node)
+	}
+	if err == nil && tree == nil {
+		err = errors.New("tree couldn't be parsed")
+	}
+	if err != nil {
+		log.Debugf("Snapshot %s failed to get tree of %s: %s", s.ID, p, err)
+		return nil, newPathError("read", p, err)
+	}
+	s.treesMutex.Lock()
+	s.trees[p] = tree
+	s.treesMutex.Unlock()
+	return tree, nil
+}
+
+/*
+Returns the tree of the directory at p, reading the trees of the directories above it as needed.
+*/
+func (s *Snapshot) lookupTree(ctx context.Context, p string) (*arq_types.Tree, error) {
+	tree, err := s.getTree(ctx, "/", nil)
+	if err != nil {
+		return nil, err
+	}
+	currentPath := "/"
+	for _, element := range strings.Split(strings.Trim(p, "/"), "/") {
+		if element == "" {
+			continue
+		}
+		var node *arq_types.Node
+		for _, child := range tree.Nodes {
+			if child.Name.Equal(element) {
+				node = child
+			}
+		}
+		currentPath = path.Join(currentPath, element)
+		if node == nil {
+			return nil, newPathError("lstat", currentPath, os.ErrNotExist)
+		}
+		if !node.IsTree.IsTrue() {
+			return nil, newPathError("open", currentPath, errors.New("not a directory"))
+		}
+		if tree, err = s.getTree(ctx, currentPath, node); err != nil {
+			return nil, err
+		}
+	}
+	return tree, nil
+}
+
+/*
+Describe the file or directory at p. Only the trees of the directories above p are read, not the tree
+of p itself.
+*/
+func (s *Snapshot) Stat(ctx context.Context, p string) (*File, error) {
+	p = path.Clean("/" + p)
+	if p == "/" {
+		tree, err := s.getTree(ctx, "/", nil)
+		if err != nil {
+			return nil, err
+		}
+		var size int64
+		for _, node := range tree.Nodes {
+			size += int64(node.UncompressedDataSize)
+		}
+		return &File{
+			Name:    path.Base(s.Path),
+			Path:    p,
+			Size:    size,
+			Mode:    os.ModeDir | tree.Mode&os.ModePerm,
+			ModTime: s.CreationDate,
+		}, nil
+	}
+	parentTree, err := s.lookupTree(ctx, path.Dir(p))
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range parentTree.Nodes {
+		if node.Name.Equal(path.Base(p)) {
+			return newFile(p, node), nil
+		}
+	}
+	return nil, newPathError("lstat", p, os.ErrNotExist)
+}
+
+/*
+The contents of the directory at p, in the order Arq stored them.
+*/
+func (s *Snapshot) ReadDir(ctx context.Context, p string) ([]*File, error) {
+	p = path.Clean("/" + p)
+	tree, err := s.lookupTree(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]*File, len(tree.Nodes))
+	for i, node := range tree.Nodes {
+		files[i] = newFile(path.Join(p, node.Name.ToString()), node)
+	}
+	return files, nil
+}
+
+/*
+Call fn for root and everything below it, directories before their contents. If a directory can't be
+read fn is called again for it with the error. Return SkipDir from fn to skip a directory, or any other
+error to stop.
+*/
+func (s *Snapshot) Walk(ctx context.Context, root string, fn WalkFunc) error {
+	file, err := s.Stat(ctx, root)
+	if err != nil {
+		return fn(&File{Name: path.Base(root), Path: path.Clean("/" + root)}, err)
+	}
+	err = s.walk(ctx, file, fn)
+	if err == SkipDir {
+		return nil
+	}
+	return err
+}
+
+func (s *Snapshot) walk(ctx context.Context, file *File, fn WalkFunc) error {
+	if err := fn(file, nil); err != nil || !file.IsDir() {
+		return err
+	}
+	children, err := s.ReadDir(ctx, file.Path)
+	if err != nil {
+		return fn(file, err)
+	}
+	for _, child := range children {
+		if err := s.walk(ctx, child, fn); err != nil && !(err == SkipDir && child.IsDir()) {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Open the file at p for reading. The reader satisfies io.ReadSeeker and io.ReaderAt.
+*/
+func (s *Snapshot) Open(ctx context.Context, p string) (*FileReader, error) {
+	file, err := s.Stat(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	if file.IsDir() {
+		return nil, newPathError("read", file.Path, errors.New("is a directory"))
+	}
+	return &FileReader{ctx: ctx, snapshot: s, file: file}, nil
+}
+
+/*
+Restore the file or directory at p to destinationPath. If destinationPath exists, files an earlier
+restore finished are skipped and the rest overwritten, so restoring again carries on from an interrupted
+restore, see DownloadNode. Like DownloadTree, files that can't be restored are logged and skipped, and
+ErrorCouldNotRecoverTree is returned if a directory couldn't be read at all. Restoring a directory caches
+all the folder's blob pack indexes first.
+*/
+func (s *Snapshot) Restore(ctx context.Context, p string, destinationPath string) error {
+	file, err := s.Stat(ctx, p)
+	if err != nil {
+		return err
+	}
+	folder := s.Folder
+	cacheDirectory := folder.repository.cacheDirectory
+	if !file.IsDir() {
+		return DownloadNode(ctx, file.Node, cacheDirectory, folder.BackupSet, folder.Bucket, file.Path, destinationPath)
+	}
+	if err := folder.CacheBlobs(ctx); err != nil {
+		return err
+	}
+	tree, err := s.lookupTree(ctx, file.Path)
+	if err != nil {
+		log.Debugf("Restore failed to read directory %s: %s", file.Path, err)
+		tree = nil
+	}
+	return DownloadTree(ctx, tree, cacheDirectory, folder.BackupSet, folder.Bucket, file.Path, destinationPath)
+}
+
+/*
+Reads a file of a snapshot. Only the chunks covering what's read are fetched, once the lengths of the
+chunks before them are known, see NodeReader.
+*/
+type FileReader struct {
+	// Reads stop once ctx is done
+	ctx      context.Context
+	snapshot *Snapshot
+	file     *File
+
+	// Created by the first read
+	reader      NodeReader
+	readerMutex sync.Mutex
+}
+
+func (r *FileReader) Stat() *File {
+	return r.file
+}
+
+func (r *FileReader) getReader() (NodeReader, error) {
+	r.readerMutex.Lock()
+	defer r.readerMutex.Unlock()
+	if r.reader == nil {
+		folder := r.snapshot.Folder
+		reader, err := GetNodeReader(r.ctx, folder.repository.cacheDirectory, folder.BackupSet, folder.Bucket, r.file.Node)
+		if err != nil {
+			log.Debugf("FileReader failed to get reader for %s: %s", r.file.Path, err)
+			return nil, err
+		}
+		r.reader = reader
+	}
+	return r.reader, nil
+}
+
+func (r *FileReader) Seek(offset int64, whence int) (int64, error) {
+	reader, err := r.getReader()
+	if err != nil {
+		return 0, err
+	}
+	position, err := reader.Seek(offset, whence)
+	if err != nil {
+		return 0, newPathError("seek", r.file.Path, err)
+	}
+	return position, nil
+}
+
+func (r *FileReader) Read(p []byte) (int, error) {
+	reader, err := r.getReader()
+	if err != nil {
+		return 0, err
+	}
+	return reader.Read(p)
+}
+
+func (r *FileReader) ReadAt(p []byte, offset int64) (int, error) {
+	reader, err := r.getReader()
+	if err != nil {
+		return 0, err
+	}
+	return reader.ReadAt(p, offset)
+}
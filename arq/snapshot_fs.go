@@ -0,0 +1,210 @@
+/*
+arqinator: arq/snapshot_fs.go
+Implements io/fs over the files of a snapshot.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package arq
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+The snapshot as an fs.FS, which also implements fs.ReadDirFS and fs.StatFS. As with io/fs, names are
+unrooted, e.g. "photos/2016/a.jpg", and "." is the top of the backed up folder. It's safe for concurrent
+use, as are the files it opens, so one can be shared by the requests of an http.FileServer. io/fs has no
+contexts, so reading stops once ctx is done.
+*/
+func (s *Snapshot) FS(ctx context.Context) fs.FS {
+	return &snapshotFS{ctx: ctx, snapshot: s}
+}
+
+type snapshotFS struct {
+	ctx      context.Context
+	snapshot *Snapshot
+}
+
+/*
+Convert a name to a snapshot path, checking it's valid for io/fs.
+*/
+func (fsys *snapshotFS) resolve(op string, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return "/" + name, nil
+}
+
+/*
+Snapshot errors carry snapshot paths, whereas io/fs errors carry the name that was asked for.
+*/
+func newFSPathError(op string, name string, err error) error {
+	if pathError, ok := err.(*os.PathError); ok {
+		err = pathError.Err
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+func (fsys *snapshotFS) Open(name string) (fs.File, error) {
+	p, err := fsys.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := fsys.snapshot.Stat(fsys.ctx, p)
+	if err != nil {
+		return nil, newFSPathError("open", name, err)
+	}
+	if file.IsDir() {
+		return &snapshotDir{fsys: fsys, name: name, file: file}, nil
+	}
+	reader, err := fsys.snapshot.Open(fsys.ctx, p)
+	if err != nil {
+		return nil, newFSPathError("open", name, err)
+	}
+	return &snapshotFile{reader: reader}, nil
+}
+
+func (fsys *snapshotFS) Stat(name string) (fs.FileInfo, error) {
+	p, err := fsys.resolve("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := fsys.snapshot.Stat(fsys.ctx, p)
+	if err != nil {
+		return nil, newFSPathError("stat", name, err)
+	}
+	return &fileInfo{file: file}, nil
+}
+
+/*
+Unlike Snapshot.ReadDir, entries are sorted by name, as fs.ReadDirFS requires.
+*/
+func (fsys *snapshotFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	p, err := fsys.resolve("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	files, err := fsys.snapshot.ReadDir(fsys.ctx, p)
+	if err != nil {
+		return nil, newFSPathError("readdir", name, err)
+	}
+	entries := make([]fs.DirEntry, len(files))
+	for i, file := range files {
+		entries[i] = fs.FileInfoToDirEntry(&fileInfo{file: file})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+/*
+A File as an fs.FileInfo. Sys returns the Node, or nil for the top directory.
+*/
+type fileInfo struct {
+	file *File
+}
+
+func (fi *fileInfo) Name() string       { return fi.file.Name }
+func (fi *fileInfo) Size() int64        { return fi.file.Size }
+func (fi *fileInfo) Mode() fs.FileMode  { return fi.file.Mode }
+func (fi *fileInfo) ModTime() time.Time { return fi.file.ModTime }
+func (fi *fileInfo) IsDir() bool        { return fi.file.IsDir() }
+func (fi *fileInfo) Sys() interface{}   { return fi.file.Node }
+
+/*
+An open file, which also implements io.Seeker and io.ReaderAt so that http.FileServer can serve ranges
+of it.
+*/
+type snapshotFile struct {
+	reader *FileReader
+}
+
+func (f *snapshotFile) Stat() (fs.FileInfo, error) {
+	return &fileInfo{file: f.reader.Stat()}, nil
+}
+
+func (f *snapshotFile) Read(p []byte) (int, error) {
+	return f.reader.Read(p)
+}
+
+func (f *snapshotFile) Seek(offset int64, whence int) (int64, error) {
+	return f.reader.Seek(offset, whence)
+}
+
+func (f *snapshotFile) ReadAt(p []byte, offset int64) (int, error) {
+	return f.reader.ReadAt(p, offset)
+}
+
+func (f *snapshotFile) Close() error {
+	return nil
+}
+
+/*
+An open directory. Its entries are read by the first call to ReadDir.
+*/
+type snapshotDir struct {
+	fsys *snapshotFS
+	name string
+	file *File
+
+	mutex   sync.Mutex
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *snapshotDir) Stat() (fs.FileInfo, error) {
+	return &fileInfo{file: d.file}, nil
+}
+
+func (d *snapshotDir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: fs.ErrInvalid}
+}
+
+func (d *snapshotDir) Close() error {
+	return nil
+}
+
+func (d *snapshotDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.entries == nil {
+		entries, err := d.fsys.ReadDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries = entries
+	}
+	remaining := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return remaining, nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(remaining) {
+		n = len(remaining)
+	}
+	d.offset += n
+	return remaining[:n], nil
+}
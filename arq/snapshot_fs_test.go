@@ -0,0 +1,288 @@
+/*
+arqinator: arq/snapshot_fs_test.go
+Tests the io/fs view of a snapshot of a small Arq 7 backup held in memory.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package arq
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/asimihsan/arqinator/arq/types"
+	"github.com/asimihsan/arqinator/connector"
+)
+
+const (
+	TEST_BACKUP_SET_UUID = "backup-set"
+	TEST_PACK_KEY        = TEST_BACKUP_SET_UUID + "/largeblobpacks/00/pack.pack"
+)
+
+/*
+Serves one pack of blobs from memory.
+*/
+type testConnection struct {
+	pack []byte
+}
+
+func (c *testConnection) String() string            { return "test" }
+func (c *testConnection) GetCacheDirectory() string { return "" }
+func (c *testConnection) Close() error              { return nil }
+func (c *testConnection) Get(ctx context.Context, key string) (string, error) {
+	return "", &os.PathError{Op: "get", Path: key, Err: os.ErrNotExist}
+}
+func (c *testConnection) CachedGet(ctx context.Context, key string) (string, error) {
+	return c.Get(ctx, key)
+}
+func (c *testConnection) ListObjectsAsFolders(ctx context.Context, prefix string) ([]connector.Object, error) {
+	return nil, nil
+}
+func (c *testConnection) ListObjectsAsAll(ctx context.Context, prefix string) ([]connector.Object, error) {
+	return nil, nil
+}
+
+func (c *testConnection) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error) {
+	if key != TEST_PACK_KEY {
+		return nil, &os.PathError{Op: "get", Path: key, Err: os.ErrNotExist}
+	}
+	return ioutil.NopCloser(bytes.NewReader(c.pack[offset : offset+length])), nil
+}
+
+/*
+Builds Arq 7 trees and file contents as uncompressed blobs of one large pack.
+*/
+type testBackupWriter struct {
+	pack  bytes.Buffer
+	blobs int
+}
+
+func (w *testBackupWriter) addBlob(contents []byte) *arq_types.BlobLoc {
+	w.blobs++
+	blobLoc := &arq_types.BlobLoc{
+		BlobIdentifier:  fmt.Sprintf("blob-%d", w.blobs),
+		IsPacked:        true,
+		IsLargePack:     true,
+		RelativePath:    "/" + TEST_PACK_KEY,
+		Offset:          uint64(w.pack.Len()),
+		Length:          uint64(len(contents)),
+		CompressionType: arq_types.COMPRESSION_TYPE_NONE,
+	}
+	w.pack.Write(contents)
+	return blobLoc
+}
+
+func writeTestString(b *bytes.Buffer, s string) {
+	b.WriteByte(1)
+	binary.Write(b, binary.BigEndian, uint64(len(s)))
+	b.WriteString(s)
+}
+
+func writeTestBoolean(b *bytes.Buffer, value bool) {
+	if value {
+		b.WriteByte(1)
+	} else {
+		b.WriteByte(0)
+	}
+}
+
+func writeTestBlobLoc(b *bytes.Buffer, blobLoc *arq_types.BlobLoc) {
+	writeTestString(b, blobLoc.BlobIdentifier)
+	writeTestBoolean(b, blobLoc.IsPacked)
+	writeTestBoolean(b, blobLoc.IsLargePack)
+	writeTestString(b, blobLoc.RelativePath)
+	binary.Write(b, binary.BigEndian, blobLoc.Offset)
+	binary.Write(b, binary.BigEndian, blobLoc.Length)
+	writeTestBoolean(b, blobLoc.StretchEncryptionKey)
+	binary.Write(b, binary.BigEndian, blobLoc.CompressionType)
+}
+
+/*
+A node as ReadArq7Node reads it, for a tree of version 1.
+*/
+type testNode struct {
+	name      string
+	isTree    bool
+	treeLoc   *arq_types.BlobLoc
+	dataLocs  []*arq_types.BlobLoc
+	size      uint64
+	mode      uint32
+	mtimeSec  int64
+	mtimeNsec int64
+}
+
+func (w *testBackupWriter) addTree(nodes []testNode) *arq_types.BlobLoc {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, uint32(1))
+	binary.Write(&b, binary.BigEndian, uint64(len(nodes)))
+	for _, node := range nodes {
+		writeTestString(&b, node.name)
+		writeTestBoolean(&b, node.isTree)
+		writeTestBoolean(&b, node.treeLoc != nil)
+		if node.treeLoc != nil {
+			writeTestBlobLoc(&b, node.treeLoc)
+		}
+		binary.Write(&b, binary.BigEndian, uint32(0))
+		binary.Write(&b, binary.BigEndian, uint64(len(node.dataLocs)))
+		for _, blobLoc := range node.dataLocs {
+			writeTestBlobLoc(&b, blobLoc)
+		}
+		writeTestBoolean(&b, false)
+		binary.Write(&b, binary.BigEndian, uint64(0))
+		binary.Write(&b, binary.BigEndian, node.size)
+		binary.Write(&b, binary.BigEndian, uint64(0))
+		binary.Write(&b, binary.BigEndian, node.mtimeSec)
+		binary.Write(&b, binary.BigEndian, node.mtimeNsec)
+		binary.Write(&b, binary.BigEndian, [4]int64{})
+		writeTestString(&b, "alice")
+		writeTestString(&b, "staff")
+		writeTestBoolean(&b, false)
+		binary.Write(&b, binary.BigEndian, int32(0))
+		binary.Write(&b, binary.BigEndian, uint64(0))
+		binary.Write(&b, binary.BigEndian, node.mode)
+		binary.Write(&b, binary.BigEndian, [3]uint32{1, 501, 20})
+		binary.Write(&b, binary.BigEndian, [3]int32{})
+	}
+	return w.addBlob(b.Bytes())
+}
+
+func (w *testBackupWriter) addFile(name string, chunks ...string) testNode {
+	node := testNode{name: name, mode: 0644, mtimeSec: 1460000000, mtimeNsec: 500}
+	for _, chunk := range chunks {
+		node.dataLocs = append(node.dataLocs, w.addBlob([]byte(chunk)))
+		node.size += uint64(len(chunk))
+	}
+	return node
+}
+
+func (w *testBackupWriter) addDirectory(name string, nodes ...testNode) testNode {
+	return testNode{name: name, isTree: true, treeLoc: w.addTree(nodes), mode: 040755, mtimeSec: 1460000000}
+}
+
+/*
+A snapshot of a folder holding a.txt, empty.txt, dir/b.txt and dir/sub/c.txt, whose files are split into
+chunks so that reads span them.
+*/
+func newTestSnapshot(t *testing.T) (*Snapshot, *testConnection) {
+	var w testBackupWriter
+	root := w.addDirectory("Documents",
+		w.addFile("a.txt", "hello ", "world"),
+		w.addFile("empty.txt"),
+		w.addDirectory("dir",
+			w.addFile("b.txt", "0123456789"),
+			w.addDirectory("sub", w.addFile("c.txt", "abc", "def", "ghi"))),
+	)
+	connection := &testConnection{pack: w.pack.Bytes()}
+	backupSet := &ArqBackupSet{Connection: connection, UUID: TEST_BACKUP_SET_UUID, Format: BACKUP_FORMAT_ARQ7}
+	folder := &Folder{
+		UUID:       "folder",
+		LocalPath:  "/Users/alice/Documents",
+		BackupSet:  backupSet,
+		repository: &Repository{connection: connection, cacheDirectory: t.TempDir()},
+	}
+	rootNode := &arq_types.Node{
+		Name:        &arq_types.String{Data: []byte(root.name)},
+		IsTree:      &arq_types.Boolean{IsPresent: true, Data: true},
+		TreeBlobLoc: root.treeLoc,
+		Mode:        os.FileMode(root.mode),
+		MtimeSec:    root.mtimeSec,
+	}
+	commit := &ArqCommit{
+		ID:           "1460000000000",
+		CreationDate: time.Unix(1460000000, 0),
+		Path:         folder.LocalPath,
+		IsComplete:   true,
+		rootNode:     rootNode,
+	}
+	return newSnapshot(folder, commit), connection
+}
+
+func TestSnapshotFS(t *testing.T) {
+	snapshot, _ := newTestSnapshot(t)
+	fsys := snapshot.FS(context.Background())
+	if err := fstest.TestFS(fsys, "a.txt", "empty.txt", "dir/b.txt", "dir/sub/c.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := fs.ReadFile(fsys, "dir/sub/c.txt")
+	if err != nil || string(contents) != "abcdefghi" {
+		t.Errorf("Expected abcdefghi, got %s, %v", contents, err)
+	}
+	info, err := fs.Stat(fsys, "a.txt")
+	if err != nil {
+		t.Fatalf("Stat failed: %s", err)
+	}
+	if info.Size() != 11 || info.Mode() != 0644 || !info.ModTime().Equal(time.Unix(1460000000, 500)) {
+		t.Errorf("Unexpected size %d, mode %s or modification time %s", info.Size(), info.Mode(), info.ModTime())
+	}
+	if _, err := fs.Stat(fsys, "dir/missing"); !os.IsNotExist(err) {
+		t.Errorf("Expected Stat of a missing file to fail with a not exist error, got %v", err)
+	}
+	if _, err := fsys.Open("/a.txt"); err == nil {
+		t.Errorf("Expected Open of a rooted name to fail")
+	}
+}
+
+/*
+Run with -race. Every goroutine shares one FS, and the ones that share an open file read it with ReadAt.
+*/
+func TestSnapshotFSConcurrentUse(t *testing.T) {
+	snapshot, _ := newTestSnapshot(t)
+	fsys := snapshot.FS(context.Background())
+	shared, err := fsys.Open("dir/sub/c.txt")
+	if err != nil {
+		t.Fatalf("Open failed: %s", err)
+	}
+	expected := map[string]string{"a.txt": "hello world", "dir/b.txt": "0123456789", "dir/sub/c.txt": "abcdefghi"}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 128)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for name, want := range expected {
+				contents, err := fs.ReadFile(fsys, name)
+				if err != nil || string(contents) != want {
+					errs <- &fs.PathError{Op: "read", Path: name, Err: err}
+				}
+			}
+			if _, err := fs.ReadDir(fsys, "dir/sub"); err != nil {
+				errs <- err
+			}
+			p := make([]byte, 3)
+			offset := int64(i%3) * 3
+			if _, err := shared.(io.ReaderAt).ReadAt(p, offset); err != nil || string(p) != "abcdefghi"[offset:offset+3] {
+				errs <- &fs.PathError{Op: "readat", Path: "dir/sub/c.txt", Err: err}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Concurrent read failed: %v", err)
+	}
+}
@@ -0,0 +1,189 @@
+/*
+arqinator: arq/types/arq7_tree.go
+Implements reading Arq 7 trees and nodes into the same Tree and Node types as earlier versions.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+/*
+References:
+-	https://www.arqbackup.com/documentation/arq7/English.lproj/dataFormat.html
+
+An Arq 7 tree is a version followed by its child nodes sorted by name:
+
+	[UInt32:version]
+	[UInt64:childNodesByNameCount]
+	(
+		[String:childName]
+		[Node:childNode]
+	)
+
+Arq 6 and 7 trees don't carry the metadata of the directory itself, that's in the node that points at them.
+*/
+
+package arq_types
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	ARQ7_TREE_VERSION_WITH_REPARSE_POINTS = 2
+)
+
+func ReadArq7Tree(p *bytes.Buffer) (*Tree, error) {
+	var version uint32
+	if err := binary.Read(p, binary.BigEndian, &version); err != nil {
+		log.Debugf("ReadArq7Tree failed to read version: %s", err)
+		return nil, err
+	}
+	tree := &Tree{Header: &Header{Type: BLOB_TYPE_TREE, Version: int(version)}}
+	var i, numNodes uint64
+	if err := binary.Read(p, binary.BigEndian, &numNodes); err != nil {
+		log.Debugf("ReadArq7Tree failed to read node count: %s", err)
+		return nil, err
+	}
+	tree.Nodes = make([]*Node, 0, numNodes)
+	for i = 0; i < numNodes; i++ {
+		name, err := ReadString(p)
+		if err != nil || name == nil {
+			return nil, errors.New(fmt.Sprintf("ReadArq7Tree failed during child name parsing: %s", err))
+		}
+		node, err := ReadArq7Node(p, int(version))
+		if err != nil {
+			log.Debugf("ReadArq7Tree failed to read node %s: %s", name, err)
+			return nil, err
+		}
+		node.Name = name
+		tree.Nodes = append(tree.Nodes, node)
+	}
+	return tree, nil
+}
+
+func readOptionalBlobLoc(p *bytes.Buffer) (*BlobLoc, error) {
+	isPresent, err := ReadBoolean(p)
+	if err != nil {
+		return nil, err
+	}
+	if !isPresent.IsTrue() {
+		return nil, nil
+	}
+	return ReadBlobLoc(p)
+}
+
+func readBlobLocs(p *bytes.Buffer) ([]*BlobLoc, error) {
+	var i, count uint64
+	if err := binary.Read(p, binary.BigEndian, &count); err != nil {
+		return nil, err
+	}
+	blobLocs := make([]*BlobLoc, 0, count)
+	for i = 0; i < count; i++ {
+		blobLoc, err := ReadBlobLoc(p)
+		if err != nil {
+			return nil, err
+		}
+		blobLocs = append(blobLocs, blobLoc)
+	}
+	return blobLocs, nil
+}
+
+/*
+Read a node without its name, which is stored in the parent tree.
+*/
+func ReadArq7Node(p *bytes.Buffer, treeVersion int) (node *Node, err error) {
+	var err2 error
+	node = &Node{TreeVersion: treeVersion}
+	if node.IsTree, err2 = ReadBoolean(p); err2 != nil {
+		err = errors.New(fmt.Sprintf("ReadArq7Node failed during IsTree parsing: %s", err2))
+		return
+	}
+	if node.TreeBlobLoc, err2 = readOptionalBlobLoc(p); err2 != nil {
+		err = errors.New(fmt.Sprintf("ReadArq7Node failed during TreeBlobLoc parsing: %s", err2))
+		return
+	}
+	var computerOSType uint32
+	binary.Read(p, binary.BigEndian, &computerOSType)
+	if node.DataBlobLocs, err2 = readBlobLocs(p); err2 != nil {
+		err = errors.New(fmt.Sprintf("ReadArq7Node failed during DataBlobLocs parsing: %s", err2))
+		return
+	}
+	if _, err2 = readOptionalBlobLoc(p); err2 != nil {
+		err = errors.New(fmt.Sprintf("ReadArq7Node failed during AclBlobLoc parsing: %s", err2))
+		return
+	}
+	if _, err2 = readBlobLocs(p); err2 != nil {
+		err = errors.New(fmt.Sprintf("ReadArq7Node failed during XattrsBlobLocs parsing: %s", err2))
+		return
+	}
+	var containedFilesCount uint64
+	binary.Read(p, binary.BigEndian, &node.UncompressedDataSize)
+	binary.Read(p, binary.BigEndian, &containedFilesCount)
+	binary.Read(p, binary.BigEndian, &node.MtimeSec)
+	binary.Read(p, binary.BigEndian, &node.MtimeNsec)
+	binary.Read(p, binary.BigEndian, &node.CtimeSec)
+	binary.Read(p, binary.BigEndian, &node.CtimeNsec)
+	binary.Read(p, binary.BigEndian, &node.CreateTimeSec)
+	binary.Read(p, binary.BigEndian, &node.CreateTimeNsec)
+	if _, err2 = ReadString(p); err2 != nil {
+		err = errors.New(fmt.Sprintf("ReadArq7Node failed during username parsing: %s", err2))
+		return
+	}
+	if _, err2 = ReadString(p); err2 != nil {
+		err = errors.New(fmt.Sprintf("ReadArq7Node failed during groupName parsing: %s", err2))
+		return
+	}
+	if _, err2 = ReadBoolean(p); err2 != nil {
+		err = errors.New(fmt.Sprintf("ReadArq7Node failed during deleted parsing: %s", err2))
+		return
+	}
+	var (
+		stIno          uint64
+		mode, uid, gid uint32
+		flags          int32
+		winAttrs       uint32
+	)
+	binary.Read(p, binary.BigEndian, &node.StDev)
+	binary.Read(p, binary.BigEndian, &stIno)
+	binary.Read(p, binary.BigEndian, &mode)
+	binary.Read(p, binary.BigEndian, &node.StNlink)
+	binary.Read(p, binary.BigEndian, &uid)
+	binary.Read(p, binary.BigEndian, &gid)
+	binary.Read(p, binary.BigEndian, &node.StRdev)
+	binary.Read(p, binary.BigEndian, &flags)
+	if err2 = binary.Read(p, binary.BigEndian, &winAttrs); err2 != nil {
+		err = errors.New(fmt.Sprintf("ReadArq7Node node is truncated: %s", err2))
+		return
+	}
+	if treeVersion >= ARQ7_TREE_VERSION_WITH_REPARSE_POINTS {
+		var reparseTag uint32
+		binary.Read(p, binary.BigEndian, &reparseTag)
+		if _, err2 = ReadBoolean(p); err2 != nil {
+			err = errors.New(fmt.Sprintf("ReadArq7Node failed during reparsePointIsDirectory parsing: %s", err2))
+			return
+		}
+	}
+	node.StIno = int32(stIno)
+	node.Mode = os.FileMode(mode)
+	node.Uid = int32(uid)
+	node.Gid = int32(gid)
+	node.Flags = int64(flags)
+	return
+}
@@ -0,0 +1,90 @@
+/*
+arqinator: arq/types/blob_loc.go
+Implements an Arq 7 BlobLoc, the location of a blob within a pack or standalone object.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package arq_types
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	COMPRESSION_TYPE_NONE = uint32(0)
+	COMPRESSION_TYPE_GZIP = uint32(1)
+	COMPRESSION_TYPE_LZ4  = uint32(2)
+)
+
+/*
+The JSON field names are used in backup records, the same fields are stored in binary in trees.
+*/
+type BlobLoc struct {
+	BlobIdentifier       string `json:"blobIdentifier"`
+	IsPacked             bool   `json:"isPacked"`
+	IsLargePack          bool   `json:"isLargePack"`
+	RelativePath         string `json:"relativePath"`
+	Offset               uint64 `json:"offset"`
+	Length               uint64 `json:"length"`
+	StretchEncryptionKey bool   `json:"stretchEncryptionKey"`
+	CompressionType      uint32 `json:"compressionType"`
+}
+
+func (b BlobLoc) String() string {
+	return fmt.Sprintf("{BlobLoc: BlobIdentifier=%s, IsPacked=%t, IsLargePack=%t, RelativePath=%s, "+
+		"Offset=%d, Length=%d, CompressionType=%d}",
+		b.BlobIdentifier, b.IsPacked, b.IsLargePack, b.RelativePath, b.Offset, b.Length, b.CompressionType)
+}
+
+func ReadBlobLoc(p *bytes.Buffer) (*BlobLoc, error) {
+	blobLoc := &BlobLoc{}
+	blobIdentifier, err := ReadString(p)
+	if err != nil || blobIdentifier == nil {
+		return nil, errors.New(fmt.Sprintf("ReadBlobLoc failed during BlobIdentifier parsing: %s", err))
+	}
+	blobLoc.BlobIdentifier = blobIdentifier.ToString()
+	isPacked, err := ReadBoolean(p)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("ReadBlobLoc failed during IsPacked parsing: %s", err))
+	}
+	blobLoc.IsPacked = isPacked.IsTrue()
+	isLargePack, err := ReadBoolean(p)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("ReadBlobLoc failed during IsLargePack parsing: %s", err))
+	}
+	blobLoc.IsLargePack = isLargePack.IsTrue()
+	relativePath, err := ReadString(p)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("ReadBlobLoc failed during RelativePath parsing: %s", err))
+	}
+	if relativePath != nil {
+		blobLoc.RelativePath = relativePath.ToString()
+	}
+	binary.Read(p, binary.BigEndian, &blobLoc.Offset)
+	binary.Read(p, binary.BigEndian, &blobLoc.Length)
+	stretchEncryptionKey, err := ReadBoolean(p)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("ReadBlobLoc failed during StretchEncryptionKey parsing: %s", err))
+	}
+	blobLoc.StretchEncryptionKey = stretchEncryptionKey.IsTrue()
+	if err := binary.Read(p, binary.BigEndian, &blobLoc.CompressionType); err != nil {
+		return nil, errors.New(fmt.Sprintf("ReadBlobLoc failed during CompressionType parsing: %s", err))
+	}
+	return blobLoc, nil
+}
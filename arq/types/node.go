@@ -67,6 +67,10 @@ type Node struct {
 	CreateTimeNsec           int64
 	StBlocks                 int64
 	StBlksize                uint32
+
+	// Only present for Arq 7, which locates data and trees by BlobLoc rather than BlobKey
+	DataBlobLocs []*BlobLoc
+	TreeBlobLoc  *BlobLoc
 }
 
 func (n Node) String() string {
@@ -0,0 +1,109 @@
+/*
+arqinator: cache.go
+Implements the cache command for inspecting, trimming and clearing the cache directory.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	"github.com/dustin/go-humanize"
+
+	"github.com/asimihsan/arqinator/arq"
+	"github.com/asimihsan/arqinator/connector"
+)
+
+func getCacheManager(c *cli.Context) (*connector.CacheManager, error) {
+	var maxSize uint64
+	if value := globalString(c, "cache-max-size"); value != "" {
+		var err error
+		if maxSize, err = humanize.ParseBytes(value); err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid cache-max-size %s, expected a size like '20GB': %s", value, err))
+		}
+	}
+	return connector.NewCacheManager(globalString(c, "cache-directory"), int64(maxSize), arq.IsEvictableCacheKey)
+}
+
+func cacheStats(c *cli.Context) error {
+	cacheManager, err := getCacheManager(c)
+	if err != nil {
+		return err
+	}
+	stats, err := cacheManager.Stats()
+	if err != nil {
+		return errors.New(fmt.Sprintf("Failed to read cache directory %s: %s", cacheManager.Directory, err))
+	}
+	limit := "none"
+	if cacheManager.MaxSize > 0 {
+		limit = humanize.Bytes(uint64(cacheManager.MaxSize))
+	}
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 0, 8, 1, '\t', 0)
+	fmt.Fprintf(w, "Directory\t%s\n", cacheManager.Directory)
+	fmt.Fprintf(w, "Size\t%s in %d files\n", humanize.Bytes(uint64(stats.Size)), stats.Files)
+	fmt.Fprintf(w, "Evictable\t%s in %d files (packs and objects)\n", humanize.Bytes(uint64(stats.EvictableSize)),
+		stats.EvictableFiles)
+	fmt.Fprintf(w, "Pinned\t%s in %d files (indexes, tree packs and metadata)\n",
+		humanize.Bytes(uint64(stats.Size-stats.EvictableSize)), stats.Files-stats.EvictableFiles)
+	fmt.Fprintf(w, "Leftovers\t%s in %d files (partial downloads)\n", humanize.Bytes(uint64(stats.LeftoverSize)),
+		stats.LeftoverFiles)
+	fmt.Fprintf(w, "Limit\t%s\n", limit)
+	w.Flush()
+	return nil
+}
+
+func cachePrune(c *cli.Context) error {
+	cacheManager, err := getCacheManager(c)
+	if err != nil {
+		return err
+	}
+	files, size, err := cacheManager.Prune()
+	if err != nil {
+		return errors.New(fmt.Sprintf("Failed to prune cache directory %s: %s", cacheManager.Directory, err))
+	}
+	log.Printf("Freed %s by deleting %d files from %s", humanize.Bytes(uint64(size)), files, cacheManager.Directory)
+	return nil
+}
+
+func cacheClear(c *cli.Context) error {
+	cacheManager, err := getCacheManager(c)
+	if err != nil {
+		return err
+	}
+	fileInfo, err := os.Stat(cacheManager.Directory)
+	if os.IsNotExist(err) {
+		log.Printf("Cache directory %s doesn't exist, nothing to clear", cacheManager.Directory)
+		return nil
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("Can't clear cache directory %s: %s", cacheManager.Directory, err))
+	}
+	if !fileInfo.IsDir() {
+		return errors.New(fmt.Sprintf("Won't clear cache directory %s, it isn't a directory", cacheManager.Directory))
+	}
+	if err := cacheManager.Clear(); err != nil {
+		return errors.New(fmt.Sprintf("Failed to clear cache directory %s: %s", cacheManager.Directory, err))
+	}
+	log.Printf("Cleared cache directory %s", cacheManager.Directory)
+	return nil
+}
@@ -0,0 +1,176 @@
+/*
+arqinator: config.go
+Implements named profiles of settings read from a configuration file.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+/*
+The configuration file is TOML. Each profile is a table whose keys are the names of global flags, plus
+the command flags that choose a backup set and folder:
+
+	[profile.default]
+	backup-type = "s3"
+	s3-region = "us-west-2"
+	s3-bucket-name = "arq-backups"
+	password-file = "/Users/alice/.arq_passwords"
+
+	[profile.nas]
+	backup-type = "sftp"
+	sftp-host = "nas.local"
+	sftp-port = 2222
+	backup-set-uuid = "AAAAAAAA-BBBB-CCCC-DDDD-EEEEEEEEEEEE"
+
+Flags given on the command line override the profile, which overrides environment variables and flag
+defaults.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/BurntSushi/toml"
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+)
+
+const (
+	DEFAULT_CONFIG_FILEPATH = "~/.config/arqinator/config"
+	DEFAULT_PROFILE         = "default"
+)
+
+type config struct {
+	Profile map[string]map[string]interface{} `toml:"profile"`
+}
+
+/*
+Setting values of the active profile, keyed by flag name. Loaded by settingsSetup.
+*/
+var profile = map[string]string{}
+
+/*
+Command flags that may also be set in a profile.
+*/
+var profileCommandFlags = []cli.Flag{
+	cli.StringFlag{Name: "backup-set-uuid"},
+	cli.StringFlag{Name: "computer"},
+	cli.StringFlag{Name: "folder-uuid"},
+	cli.StringFlag{Name: "folder"},
+}
+
+/*
+Flags that don't make sense in a profile, e.g. because they choose the profile.
+*/
+var nonProfileFlags = map[string]bool{
+	"config":  true,
+	"profile": true,
+}
+
+/*
+Returns an empty profile if the configuration file doesn't exist and no profile was asked for, or if
+the default profile was asked for and the file doesn't have one.
+*/
+func loadProfile(filepath string, name string, flags []cli.Flag) (map[string]string, error) {
+	isDefault := name == ""
+	if isDefault {
+		name = DEFAULT_PROFILE
+	}
+	if _, err := os.Stat(filepath); os.IsNotExist(err) {
+		if isDefault {
+			return map[string]string{}, nil
+		}
+		return nil, errors.New(fmt.Sprintf("Can't use profile %s, config file %s doesn't exist", name, filepath))
+	}
+	var conf config
+	if _, err := toml.DecodeFile(filepath, &conf); err != nil {
+		log.Debugf("loadProfile failed to decode %s: %s", filepath, err)
+		return nil, errors.New(fmt.Sprintf("Failed to read config file %s: %s", filepath, err))
+	}
+	settings, ok := conf.Profile[name]
+	if !ok {
+		if isDefault {
+			return map[string]string{}, nil
+		}
+		return nil, errors.New(fmt.Sprintf("Config file %s has no profile %s", filepath, name))
+	}
+
+	flagsByName := make(map[string]cli.Flag)
+	for _, flag := range append(flags, profileCommandFlags...) {
+		switch f := flag.(type) {
+		case cli.StringFlag:
+			flagsByName[f.Name] = f
+		case cli.BoolFlag:
+			flagsByName[f.Name] = f
+		case cli.IntFlag:
+			flagsByName[f.Name] = f
+		}
+	}
+	result := make(map[string]string)
+	for key, value := range settings {
+		flag, ok := flagsByName[key]
+		if !ok || nonProfileFlags[key] {
+			return nil, errors.New(fmt.Sprintf("Profile %s has unknown setting %s", name, key))
+		}
+		var isValid bool
+		switch flag.(type) {
+		case cli.StringFlag:
+			_, isValid = value.(string)
+		case cli.BoolFlag:
+			_, isValid = value.(bool)
+		case cli.IntFlag:
+			_, isValid = value.(int64)
+		}
+		if !isValid {
+			return nil, errors.New(fmt.Sprintf("Profile %s setting %s has the wrong type: %v", name, key, value))
+		}
+		result[key] = fmt.Sprint(value)
+	}
+	log.Debugf("Using profile %s from %s", name, filepath)
+	return result, nil
+}
+
+func globalString(c *cli.Context, name string) string {
+	if value, ok := profile[name]; ok && !c.GlobalIsSet(name) {
+		return value
+	}
+	return c.GlobalString(name)
+}
+
+func globalBool(c *cli.Context, name string) bool {
+	if value, ok := profile[name]; ok && !c.GlobalIsSet(name) {
+		b, _ := strconv.ParseBool(value)
+		return b
+	}
+	return c.GlobalBool(name)
+}
+
+func globalInt(c *cli.Context, name string) int {
+	if value, ok := profile[name]; ok && !c.GlobalIsSet(name) {
+		i, _ := strconv.Atoi(value)
+		return i
+	}
+	return c.GlobalInt(name)
+}
+
+func commandString(c *cli.Context, name string) string {
+	if value, ok := profile[name]; ok && !c.IsSet(name) {
+		return value
+	}
+	return c.String(name)
+}
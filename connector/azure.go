@@ -0,0 +1,334 @@
+/*
+arqinator: connector/azure.go
+Implements Microsoft Azure Blob Storage backup type for Arq.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+/*
+References:
+-	https://docs.microsoft.com/en-us/rest/api/storageservices/authorize-with-shared-key
+-	https://docs.microsoft.com/en-us/rest/api/storageservices/list-blobs
+-	https://docs.microsoft.com/en-us/rest/api/storageservices/get-blob
+-	https://github.com/Azure/Azurite#default-storage-account
+*/
+
+package connector
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	AZURE_API_VERSION = "2019-12-12"
+	AZURE_MAX_RESULTS = 5000
+	AZURE_UTF8_BOM    = "\xef\xbb\xbf"
+)
+
+type AzureConnection struct {
+	HTTPClient     *http.Client
+	AccountName    string
+	AccountKey     []byte
+	SASToken       string
+	ContainerName  string
+	Endpoint       string
+	CacheDirectory string
+}
+
+func (c AzureConnection) String() string {
+	return fmt.Sprintf("{AzureConnection: Endpoint=%s, ContainerName=%s, CacheDirectory=%s}",
+		c.Endpoint, c.ContainerName, c.CacheDirectory)
+}
+
+/*
+Exactly one of accountKey (base64 encoded, as shown in the Azure portal) or sasToken must be set.
+endpoint defaults to https://<accountName>.blob.core.windows.net; for the Azurite emulator use e.g.
+http://127.0.0.1:10000/devstoreaccount1.
+*/
+func NewAzureConnection(accountName string, accountKey string, sasToken string, containerName string,
+	endpoint string, cacheDirectory string) (*AzureConnection, error) {
+	conn := AzureConnection{
+		HTTPClient:     http.DefaultClient,
+		AccountName:    accountName,
+		SASToken:       strings.TrimPrefix(sasToken, "?"),
+		ContainerName:  containerName,
+		Endpoint:       strings.TrimSuffix(endpoint, "/"),
+		CacheDirectory: cacheDirectory,
+	}
+	if conn.Endpoint == "" {
+		conn.Endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", accountName)
+	}
+	if accountKey == "" && conn.SASToken == "" {
+		return nil, errors.New("Azure needs either an account key or a SAS token")
+	}
+	if accountKey != "" {
+		key, err := base64.StdEncoding.DecodeString(accountKey)
+		if err != nil {
+			log.Debugf("NewAzureConnection failed to base64 decode account key: %s", err)
+			return nil, errors.New(fmt.Sprintf("Azure account key isn't valid base64: %s", err))
+		}
+		conn.AccountKey = key
+	}
+	return &conn, nil
+}
+
+func (c AzureConnection) GetCacheDirectory() string {
+	return c.CacheDirectory
+}
+
+func (c AzureConnection) Close() error {
+	return nil
+}
+
+type AzureObject struct {
+	Name string
+	Size int64
+}
+
+func (o AzureObject) String() string {
+	return fmt.Sprintf("{AzureObject: Name=%s}", o.Name)
+}
+
+func (o AzureObject) GetPath() string {
+	return o.Name
+}
+
+func (o AzureObject) GetSize() int64 {
+	return o.Size
+}
+
+type azureEnumerationResults struct {
+	Blobs []struct {
+		Name          string `xml:"Name"`
+		ContentLength int64  `xml:"Properties>Content-Length"`
+	} `xml:"Blobs>Blob"`
+	BlobPrefixes []struct {
+		Name string `xml:"Name"`
+	} `xml:"Blobs>BlobPrefix"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+/*
+Build the string to sign for Shared Key authorization. We always send x-ms-date rather than Date.
+*/
+func (conn AzureConnection) getStringToSign(req *http.Request) string {
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = fmt.Sprintf("%d", req.ContentLength)
+	}
+	headers := []string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+	}
+
+	msHeaders := make([]string, 0)
+	for name := range req.Header {
+		lowerName := strings.ToLower(name)
+		if strings.HasPrefix(lowerName, "x-ms-") {
+			msHeaders = append(msHeaders, lowerName)
+		}
+	}
+	sort.Strings(msHeaders)
+	var canonicalizedHeaders bytes.Buffer
+	for _, name := range msHeaders {
+		fmt.Fprintf(&canonicalizedHeaders, "%s:%s\n", name, strings.TrimSpace(req.Header.Get(name)))
+	}
+
+	var canonicalizedResource bytes.Buffer
+	fmt.Fprintf(&canonicalizedResource, "/%s%s", conn.AccountName, req.URL.EscapedPath())
+	query := req.URL.Query()
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values := query[name]
+		sort.Strings(values)
+		fmt.Fprintf(&canonicalizedResource, "\n%s:%s", strings.ToLower(name), strings.Join(values, ","))
+	}
+
+	return strings.Join(headers, "\n") + "\n" + canonicalizedHeaders.String() + canonicalizedResource.String()
+}
+
+/*
+Authorize a request whose x-ms-date and x-ms-version headers are already set, either by signing it
+with the account key or by appending the SAS token to its query.
+*/
+func (conn AzureConnection) authorize(req *http.Request) {
+	if conn.AccountKey != nil {
+		mac := hmac.New(sha256.New, conn.AccountKey)
+		mac.Write([]byte(conn.getStringToSign(req)))
+		signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+		req.Header.Set("Authorization", fmt.Sprintf("SharedKey %s:%s", conn.AccountName, signature))
+	} else {
+		if req.URL.RawQuery == "" {
+			req.URL.RawQuery = conn.SASToken
+		} else {
+			req.URL.RawQuery = req.URL.RawQuery + "&" + conn.SASToken
+		}
+	}
+}
+
+func (conn AzureConnection) do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", AZURE_API_VERSION)
+	conn.authorize(req)
+	return conn.HTTPClient.Do(req)
+}
+
+func (conn AzureConnection) getBlobURL(name string) string {
+	return conn.Endpoint + (&url.URL{Path: "/" + conn.ContainerName + "/" + name}).EscapedPath()
+}
+
+func (conn AzureConnection) ListObjectsAsFolders(ctx context.Context, prefix string) ([]Object, error) {
+	return conn.listObjects(ctx, prefix, "/")
+}
+
+func (conn AzureConnection) ListObjectsAsAll(ctx context.Context, prefix string) ([]Object, error) {
+	return conn.listObjects(ctx, prefix, "")
+}
+
+func (conn AzureConnection) listObjects(ctx context.Context, prefix string, delimiter string) ([]Object, error) {
+	log.Debugf("AzureConnection listObjects. prefix: %s, delimiter: %s", prefix, delimiter)
+	objects := make([]Object, 0)
+	marker := ""
+	for {
+		query := url.Values{}
+		query.Set("restype", "container")
+		query.Set("comp", "list")
+		query.Set("maxresults", fmt.Sprintf("%d", AZURE_MAX_RESULTS))
+		if prefix != "" {
+			query.Set("prefix", prefix)
+		}
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+		containerURL := conn.Endpoint + (&url.URL{Path: "/" + conn.ContainerName}).EscapedPath()
+		req, err := http.NewRequestWithContext(ctx, "GET", containerURL+"?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := conn.do(req)
+		if err != nil {
+			log.Debugf("Failed to list blobs for container %s, prefix %s: %s", conn.ContainerName, prefix, err)
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, newHTTPStatusError(resp)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		var results azureEnumerationResults
+		if err := xml.Unmarshal(bytes.TrimPrefix(body, []byte(AZURE_UTF8_BOM)), &results); err != nil {
+			log.Debugf("Failed to parse List Blobs response for container %s: %s", conn.ContainerName, err)
+			return nil, err
+		}
+		if delimiter == "/" { // folders
+			for _, blobPrefix := range results.BlobPrefixes {
+				objects = append(objects, AzureObject{Name: strings.TrimSuffix(blobPrefix.Name, "/")})
+			}
+		} else { // regular files
+			for _, blob := range results.Blobs {
+				objects = append(objects, AzureObject{Name: blob.Name, Size: blob.ContentLength})
+			}
+		}
+		if results.NextMarker == "" {
+			break
+		}
+		marker = results.NextMarker
+	}
+	return objects, nil
+}
+
+func (conn AzureConnection) CachedGet(ctx context.Context, key string) (string, error) {
+	return cachedGet(ctx, conn, key)
+}
+
+func (conn AzureConnection) Get(ctx context.Context, key string) (string, error) {
+	cacheFilepath, err := cacheFilepathFor(conn.GetCacheDirectory(), key)
+	if err != nil {
+		log.Errorf("Failed to getCacheFilepath in Get: %s", err)
+		return cacheFilepath, err
+	}
+	r, err := conn.GetRange(ctx, key, 0, -1)
+	if err != nil {
+		log.Errorf("Failed to download key %s: %s", key, err)
+		return cacheFilepath, err
+	}
+	defer r.Close()
+	if err = writeCacheFile(ctx, cacheFilepath, r, readerSize(r)); err != nil {
+		log.Errorf("Failed to download key %s: %s", key, err)
+		return cacheFilepath, err
+	}
+	return cacheFilepath, nil
+}
+
+/*
+Download part of a block blob. Callers must close the returned reader.
+*/
+func (conn AzureConnection) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", conn.getBlobURL(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset != 0 || length >= 0 {
+		req.Header.Set("x-ms-range", formatRange(offset, length))
+	}
+	resp, err := conn.do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, newObjectNotExistError(key)
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return nil, newHTTPStatusError(resp)
+	}
+	return getRangeBody(resp, offset, length)
+}
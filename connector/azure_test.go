@@ -0,0 +1,286 @@
+/*
+arqinator: connector/azure_test.go
+Tests Shared Key signing and the Azure Blob Storage backup type against a local stub of the Blob service.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package connector
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	// The well-known account of the Azurite emulator.
+	AZURE_TEST_ACCOUNT_NAME   = "devstoreaccount1"
+	AZURE_TEST_ACCOUNT_KEY    = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+	AZURE_TEST_CONTAINER_NAME = "arq"
+	AZURE_TEST_DATE           = "Mon, 02 Jan 2006 15:04:05 GMT"
+	AZURE_TEST_PAGE_SIZE      = 2
+)
+
+/*
+Expected signatures were computed independently of this package, with openssl dgst -sha256 -mac HMAC
+over the string to sign given in the test.
+*/
+func TestAzureSharedKeySignature(t *testing.T) {
+	conn, err := NewAzureConnection(AZURE_TEST_ACCOUNT_NAME, AZURE_TEST_ACCOUNT_KEY, "", AZURE_TEST_CONTAINER_NAME,
+		"http://127.0.0.1:10000/"+AZURE_TEST_ACCOUNT_NAME, t.TempDir())
+	if err != nil {
+		t.Fatalf("NewAzureConnection failed: %s", err)
+	}
+	tests := []struct {
+		url          string
+		xmsRange     string
+		stringToSign string
+		signature    string
+	}{
+		{
+			url: conn.Endpoint + "/arq?comp=list&maxresults=5000&prefix=backup%2F&restype=container",
+			stringToSign: "GET\n\n\n\n\n\n\n\n\n\n\n\n" +
+				"x-ms-date:" + AZURE_TEST_DATE + "\nx-ms-version:2019-12-12\n" +
+				"/devstoreaccount1/devstoreaccount1/arq\ncomp:list\nmaxresults:5000\nprefix:backup/\nrestype:container",
+			signature: "Dh7Co8LDX3O3AE3wMZnuzLfDRY6GPhyyDWu9Uf7I+DY=",
+		},
+		{
+			url:      conn.getBlobURL("backup/a b.pack"),
+			xmsRange: "bytes=3-6",
+			stringToSign: "GET\n\n\n\n\n\n\n\n\n\n\n\n" +
+				"x-ms-date:" + AZURE_TEST_DATE + "\nx-ms-range:bytes=3-6\nx-ms-version:2019-12-12\n" +
+				"/devstoreaccount1/devstoreaccount1/arq/backup/a%20b.pack",
+			signature: "9iKISIerj7TzrJ42YiNsct4OrrgQ4qP1fDT1Lk6peVY=",
+		},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", test.url, nil)
+		if err != nil {
+			t.Fatalf("NewRequest failed: %s", err)
+		}
+		req.Header.Set("x-ms-date", AZURE_TEST_DATE)
+		req.Header.Set("x-ms-version", AZURE_API_VERSION)
+		if test.xmsRange != "" {
+			req.Header.Set("x-ms-range", test.xmsRange)
+		}
+		if stringToSign := conn.getStringToSign(req); stringToSign != test.stringToSign {
+			t.Errorf("Expected string to sign %q, got %q", test.stringToSign, stringToSign)
+		}
+		conn.authorize(req)
+		expected := "SharedKey " + AZURE_TEST_ACCOUNT_NAME + ":" + test.signature
+		if authorization := req.Header.Get("Authorization"); authorization != expected {
+			t.Errorf("Expected Authorization %s, got %s", expected, authorization)
+		}
+	}
+}
+
+/*
+Just enough of the Blob service to back an AzureConnection: List Blobs with pages of
+AZURE_TEST_PAGE_SIZE blobs, and Get Blob with x-ms-range support. Every request must be authorized
+with a SAS token or a Shared Key.
+*/
+type azureStub struct {
+	mutex     sync.Mutex
+	blobs     map[string][]byte
+	sasToken  string
+	listCalls int
+}
+
+type azureStubBlobs struct {
+	XMLName      xml.Name              `xml:"EnumerationResults"`
+	Blobs        []azureStubBlob       `xml:"Blobs>Blob"`
+	BlobPrefixes []azureStubBlobPrefix `xml:"Blobs>BlobPrefix"`
+	NextMarker   string
+}
+
+type azureStubBlob struct {
+	Name          string
+	ContentLength int64 `xml:"Properties>Content-Length"`
+}
+
+type azureStubBlobPrefix struct {
+	Name string
+}
+
+func (s *azureStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	isSigned := strings.HasPrefix(r.Header.Get("Authorization"), "SharedKey "+AZURE_TEST_ACCOUNT_NAME+":")
+	if r.Header.Get("x-ms-version") != AZURE_API_VERSION || (!isSigned && query.Get("sig") != s.sasToken) {
+		http.Error(w, "AuthenticationFailed", http.StatusForbidden)
+		return
+	}
+	containerPath := "/" + AZURE_TEST_ACCOUNT_NAME + "/" + AZURE_TEST_CONTAINER_NAME
+	if r.URL.Path == containerPath && query.Get("restype") == "container" && query.Get("comp") == "list" {
+		s.listBlobs(w, query.Get("prefix"), query.Get("delimiter"), query.Get("marker"))
+		return
+	}
+	contents, ok := s.blobs[strings.TrimPrefix(r.URL.Path, containerPath+"/")]
+	if !ok {
+		http.Error(w, "BlobNotFound", http.StatusNotFound)
+		return
+	}
+	if xmsRange := r.Header.Get("x-ms-range"); xmsRange != "" {
+		r.Header.Set("Range", xmsRange)
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(contents))
+}
+
+func (s *azureStub) listBlobs(w http.ResponseWriter, prefix string, delimiter string, marker string) {
+	s.mutex.Lock()
+	s.listCalls++
+	s.mutex.Unlock()
+	var names []string
+	seen := make(map[string]bool)
+	for name := range s.blobs {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(name[len(prefix):], delimiter); i >= 0 {
+				name = name[:len(prefix)+i+len(delimiter)]
+			}
+		}
+		if !seen[name] && name >= marker {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var results azureStubBlobs
+	for i, name := range names {
+		if i == AZURE_TEST_PAGE_SIZE {
+			results.NextMarker = name
+			break
+		}
+		if delimiter != "" && strings.HasSuffix(name, delimiter) {
+			results.BlobPrefixes = append(results.BlobPrefixes, azureStubBlobPrefix{Name: name})
+		} else {
+			results.Blobs = append(results.Blobs, azureStubBlob{Name: name, ContentLength: int64(len(s.blobs[name]))})
+		}
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprint(w, AZURE_UTF8_BOM+xml.Header)
+	xml.NewEncoder(w).Encode(results)
+}
+
+func newTestAzureConnection(t *testing.T, accountKey string, sasToken string) (*AzureConnection, *azureStub) {
+	stub := &azureStub{
+		blobs: map[string][]byte{
+			"backup/a.pack":        []byte("contents of a"),
+			"backup/b.index":       []byte("contents of b"),
+			"backup/c d.pack":      []byte("0123456789"),
+			"backup/objects/e":     []byte("contents of e"),
+			"backup/treepacks/f/g": []byte("contents of g"),
+		},
+		sasToken: "signature",
+	}
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+	conn, err := NewAzureConnection(AZURE_TEST_ACCOUNT_NAME, accountKey, sasToken, AZURE_TEST_CONTAINER_NAME,
+		server.URL+"/"+AZURE_TEST_ACCOUNT_NAME, t.TempDir())
+	if err != nil {
+		t.Fatalf("NewAzureConnection failed: %s", err)
+	}
+	return conn, stub
+}
+
+func getObjectPaths(objects []Object) string {
+	var paths []string
+	for _, object := range objects {
+		paths = append(paths, object.GetPath())
+	}
+	return strings.Join(paths, ",")
+}
+
+func TestAzureListObjects(t *testing.T) {
+	conn, stub := newTestAzureConnection(t, AZURE_TEST_ACCOUNT_KEY, "")
+	objects, err := conn.ListObjectsAsAll(context.Background(), "backup/")
+	if err != nil {
+		t.Fatalf("ListObjectsAsAll failed: %s", err)
+	}
+	expected := "backup/a.pack,backup/b.index,backup/c d.pack,backup/objects/e,backup/treepacks/f/g"
+	if paths := getObjectPaths(objects); paths != expected {
+		t.Errorf("Expected %s, got %s", expected, paths)
+	}
+	if objects[2].GetSize() != 10 {
+		t.Errorf("Expected size 10, got %d", objects[2].GetSize())
+	}
+	if stub.listCalls != 3 {
+		t.Errorf("Expected 3 pages of List Blobs, got %d", stub.listCalls)
+	}
+
+	folders, err := conn.ListObjectsAsFolders(context.Background(), "backup/")
+	if err != nil {
+		t.Fatalf("ListObjectsAsFolders failed: %s", err)
+	}
+	if paths := getObjectPaths(folders); paths != "backup/objects,backup/treepacks" {
+		t.Errorf("Expected backup/objects,backup/treepacks, got %s", paths)
+	}
+}
+
+func TestAzureGetRange(t *testing.T) {
+	for _, credentials := range [][2]string{{AZURE_TEST_ACCOUNT_KEY, ""}, {"", "?sv=2019-12-12&sig=signature"}} {
+		conn, _ := newTestAzureConnection(t, credentials[0], credentials[1])
+		tests := []struct {
+			offset   int64
+			length   int64
+			expected string
+		}{
+			{0, -1, "0123456789"},
+			{3, 4, "3456"},
+			{7, -1, "789"},
+		}
+		for _, test := range tests {
+			r, err := conn.GetRange(context.Background(), "backup/c d.pack", test.offset, test.length)
+			if err != nil {
+				t.Fatalf("GetRange(%d, %d) failed: %s", test.offset, test.length, err)
+			}
+			contents, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil || string(contents) != test.expected {
+				t.Errorf("GetRange(%d, %d) expected %s, got %s, %v", test.offset, test.length, test.expected,
+					contents, err)
+			}
+		}
+
+		cacheFilepath, err := conn.CachedGet(context.Background(), "backup/a.pack")
+		if err != nil {
+			t.Fatalf("CachedGet failed: %s", err)
+		}
+		if contents, _ := ioutil.ReadFile(cacheFilepath); string(contents) != "contents of a" {
+			t.Errorf("Unexpected cached contents %s", contents)
+		}
+
+		if _, err := conn.CachedGet(context.Background(), "backup/missing"); !os.IsNotExist(err) {
+			t.Errorf("Expected CachedGet of a missing key to fail with a not exist error, got %v", err)
+		}
+	}
+
+	conn, _ := newTestAzureConnection(t, "", "sig=wrong")
+	if _, err := conn.GetRange(context.Background(), "backup/a.pack", 0, -1); err == nil {
+		t.Errorf("Expected GetRange with the wrong SAS token to fail")
+	}
+}
@@ -0,0 +1,398 @@
+/*
+arqinator: connector/b2.go
+Implements Backblaze B2 backup type for Arq, using the B2 native API.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+/*
+References:
+-	https://www.backblaze.com/b2/docs/b2_authorize_account.html
+-	https://www.backblaze.com/b2/docs/b2_list_file_names.html
+-	https://www.backblaze.com/b2/docs/b2_download_file_by_name.html
+*/
+
+package connector
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	B2_DEFAULT_API_URL   = "https://api.backblazeb2.com"
+	B2_MAX_FILE_COUNT    = 1000
+	B2_FOLDER_ACTION     = "folder"
+	B2_EXPIRED_AUTH_CODE = "expired_auth_token"
+)
+
+/*
+Credentials and URLs returned by b2_authorize_account. Shared between copies of a B2Connection so that
+re-authorizing after the token expires benefits all of them.
+*/
+type b2Session struct {
+	mutex              sync.Mutex
+	AuthorizationToken string
+	APIURL             string
+	DownloadURL        string
+	AccountID          string
+	BucketID           string
+}
+
+type B2Connection struct {
+	HTTPClient     *http.Client
+	AuthURL        string
+	KeyID          string
+	ApplicationKey string
+	BucketName     string
+	CacheDirectory string
+	session        *b2Session
+}
+
+func (c B2Connection) String() string {
+	return fmt.Sprintf("{B2Connection: BucketName=%s, CacheDirectory=%s}",
+		c.BucketName, c.CacheDirectory)
+}
+
+/*
+Authorize against B2 and look up the bucket ID. authURL is usually B2_DEFAULT_API_URL.
+*/
+func NewB2Connection(authURL string, keyID string, applicationKey string, bucketName string,
+	cacheDirectory string) (*B2Connection, error) {
+	conn := B2Connection{
+		HTTPClient:     http.DefaultClient,
+		AuthURL:        strings.TrimSuffix(authURL, "/"),
+		KeyID:          keyID,
+		ApplicationKey: applicationKey,
+		BucketName:     bucketName,
+		CacheDirectory: cacheDirectory,
+		session:        &b2Session{},
+	}
+	if err := conn.authorize(context.Background()); err != nil {
+		log.Debugf("NewB2Connection failed to authorize: %s", err)
+		return nil, err
+	}
+	return &conn, nil
+}
+
+func (c B2Connection) GetCacheDirectory() string {
+	return c.CacheDirectory
+}
+
+func (c B2Connection) Close() error {
+	return nil
+}
+
+type B2Object struct {
+	FileName string
+	Size     int64
+}
+
+func (o B2Object) String() string {
+	return fmt.Sprintf("{B2Object: FileName=%s}", o.FileName)
+}
+
+func (o B2Object) GetPath() string {
+	return o.FileName
+}
+
+func (o B2Object) GetSize() int64 {
+	return o.Size
+}
+
+type b2AuthorizeAccountResponse struct {
+	AccountID          string `json:"accountId"`
+	AuthorizationToken string `json:"authorizationToken"`
+	APIURL             string `json:"apiUrl"`
+	DownloadURL        string `json:"downloadUrl"`
+	Allowed            struct {
+		BucketID   string `json:"bucketId"`
+		BucketName string `json:"bucketName"`
+	} `json:"allowed"`
+}
+
+type b2ListBucketsRequest struct {
+	AccountID  string `json:"accountId"`
+	BucketName string `json:"bucketName"`
+}
+
+type b2ListBucketsResponse struct {
+	Buckets []struct {
+		BucketID   string `json:"bucketId"`
+		BucketName string `json:"bucketName"`
+	} `json:"buckets"`
+}
+
+type b2ListFileNamesRequest struct {
+	BucketID      string `json:"bucketId"`
+	StartFileName string `json:"startFileName,omitempty"`
+	MaxFileCount  int    `json:"maxFileCount"`
+	Prefix        string `json:"prefix,omitempty"`
+	Delimiter     string `json:"delimiter,omitempty"`
+}
+
+type b2ListFileNamesResponse struct {
+	Files []struct {
+		FileName      string `json:"fileName"`
+		ContentLength int64  `json:"contentLength"`
+		Action        string `json:"action"`
+	} `json:"files"`
+	NextFileName *string `json:"nextFileName"`
+}
+
+type b2ErrorResponse struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func isB2ExpiredAuthToken(err error) bool {
+	statusErr, ok := err.(*HTTPStatusError)
+	if !ok || statusErr.StatusCode != http.StatusUnauthorized {
+		return false
+	}
+	var b2Err b2ErrorResponse
+	if json.Unmarshal([]byte(statusErr.Body), &b2Err) != nil {
+		return false
+	}
+	return b2Err.Code == B2_EXPIRED_AUTH_CODE
+}
+
+func (conn B2Connection) authorize(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", conn.AuthURL+"/b2api/v2/b2_authorize_account", nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(conn.KeyID, conn.ApplicationKey)
+	resp, err := conn.HTTPClient.Do(req)
+	if err != nil {
+		log.Debugf("B2Connection b2_authorize_account failed: %s", err)
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return newHTTPStatusError(resp)
+	}
+	defer resp.Body.Close()
+	var authResponse b2AuthorizeAccountResponse
+	if err := json.NewDecoder(resp.Body).Decode(&authResponse); err != nil {
+		log.Debugf("B2Connection failed to decode b2_authorize_account response: %s", err)
+		return err
+	}
+
+	conn.session.mutex.Lock()
+	conn.session.AuthorizationToken = authResponse.AuthorizationToken
+	conn.session.APIURL = authResponse.APIURL
+	conn.session.DownloadURL = authResponse.DownloadURL
+	conn.session.AccountID = authResponse.AccountID
+	bucketID := conn.session.BucketID
+	conn.session.mutex.Unlock()
+	if bucketID != "" {
+		return nil
+	}
+
+	// keys restricted to a single bucket tell us its ID, else we need to look it up.
+	if authResponse.Allowed.BucketName == conn.BucketName && authResponse.Allowed.BucketID != "" {
+		bucketID = authResponse.Allowed.BucketID
+	} else {
+		var bucketsResponse b2ListBucketsResponse
+		request := b2ListBucketsRequest{
+			AccountID:  authResponse.AccountID,
+			BucketName: conn.BucketName,
+		}
+		if err := conn.callAPI(ctx, "b2_list_buckets", request, &bucketsResponse); err != nil {
+			log.Debugf("B2Connection b2_list_buckets failed: %s", err)
+			return err
+		}
+		for _, bucket := range bucketsResponse.Buckets {
+			if bucket.BucketName == conn.BucketName {
+				bucketID = bucket.BucketID
+			}
+		}
+	}
+	if bucketID == "" {
+		return errors.New(fmt.Sprintf("B2 bucket %s not found, or the key isn't allowed to access it", conn.BucketName))
+	}
+	conn.session.mutex.Lock()
+	conn.session.BucketID = bucketID
+	conn.session.mutex.Unlock()
+	return nil
+}
+
+func (conn B2Connection) getSession() b2Session {
+	conn.session.mutex.Lock()
+	defer conn.session.mutex.Unlock()
+	return b2Session{
+		AuthorizationToken: conn.session.AuthorizationToken,
+		APIURL:             conn.session.APIURL,
+		DownloadURL:        conn.session.DownloadURL,
+		AccountID:          conn.session.AccountID,
+		BucketID:           conn.session.BucketID,
+	}
+}
+
+/*
+POST a JSON request to a B2 API method and decode the JSON response. If the authorization token has
+expired then re-authorize and try once more.
+*/
+func (conn B2Connection) callAPI(ctx context.Context, method string, request interface{}, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		session := conn.getSession()
+		req, err := http.NewRequestWithContext(ctx, "POST", session.APIURL+"/b2api/v2/"+method, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", session.AuthorizationToken)
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := conn.HTTPClient.Do(req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = newHTTPStatusError(resp)
+			if attempt == 0 && isB2ExpiredAuthToken(err) {
+				log.Debugf("B2Connection authorization token expired during %s, re-authorizing", method)
+				if err := conn.authorize(ctx); err != nil {
+					return err
+				}
+				continue
+			}
+			return err
+		}
+		defer resp.Body.Close()
+		return json.NewDecoder(resp.Body).Decode(response)
+	}
+}
+
+func (conn B2Connection) ListObjectsAsFolders(ctx context.Context, prefix string) ([]Object, error) {
+	return conn.listObjects(ctx, prefix, "/")
+}
+
+func (conn B2Connection) ListObjectsAsAll(ctx context.Context, prefix string) ([]Object, error) {
+	return conn.listObjects(ctx, prefix, "")
+}
+
+func (conn B2Connection) listObjects(ctx context.Context, prefix string, delimiter string) ([]Object, error) {
+	log.Debugf("B2Connection listObjects. prefix: %s, delimiter: %s", prefix, delimiter)
+	objects := make([]Object, 0)
+	request := b2ListFileNamesRequest{
+		BucketID:     conn.getSession().BucketID,
+		MaxFileCount: B2_MAX_FILE_COUNT,
+		Prefix:       prefix,
+		Delimiter:    delimiter,
+	}
+	for {
+		var response b2ListFileNamesResponse
+		if err := conn.callAPI(ctx, "b2_list_file_names", request, &response); err != nil {
+			log.Debugf("Failed to b2_list_file_names for bucket %s, prefix %s: %s", conn.BucketName, prefix, err)
+			return nil, err
+		}
+		for _, file := range response.Files {
+			isFolder := file.Action == B2_FOLDER_ACTION
+			if delimiter == "/" && isFolder { // folders
+				objects = append(objects, B2Object{FileName: strings.TrimSuffix(file.FileName, "/")})
+			} else if delimiter != "/" && !isFolder { // regular files
+				objects = append(objects, B2Object{FileName: file.FileName, Size: file.ContentLength})
+			}
+		}
+		if response.NextFileName == nil {
+			break
+		}
+		request.StartFileName = *response.NextFileName
+	}
+	return objects, nil
+}
+
+func (conn B2Connection) CachedGet(ctx context.Context, key string) (string, error) {
+	return cachedGet(ctx, conn, key)
+}
+
+func (conn B2Connection) Get(ctx context.Context, key string) (string, error) {
+	cacheFilepath, err := cacheFilepathFor(conn.GetCacheDirectory(), key)
+	if err != nil {
+		log.Errorf("Failed to getCacheFilepath in Get: %s", err)
+		return cacheFilepath, err
+	}
+	r, err := conn.GetRange(ctx, key, 0, -1)
+	if err != nil {
+		log.Errorf("Failed to download key %s: %s", key, err)
+		return cacheFilepath, err
+	}
+	defer r.Close()
+	if err = writeCacheFile(ctx, cacheFilepath, r, readerSize(r)); err != nil {
+		log.Errorf("Failed to download key %s: %s", key, err)
+		return cacheFilepath, err
+	}
+	return cacheFilepath, nil
+}
+
+/*
+Download part of a file using b2_download_file_by_name. Callers must close the returned reader.
+*/
+func (conn B2Connection) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error) {
+	escapedSegments := strings.Split(key, "/")
+	for i := range escapedSegments {
+		escapedSegments[i] = url.PathEscape(escapedSegments[i])
+	}
+	for attempt := 0; ; attempt++ {
+		session := conn.getSession()
+		downloadURL := fmt.Sprintf("%s/file/%s/%s", session.DownloadURL, url.PathEscape(conn.BucketName),
+			strings.Join(escapedSegments, "/"))
+		req, err := http.NewRequestWithContext(ctx, "GET", downloadURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", session.AuthorizationToken)
+		if offset != 0 || length >= 0 {
+			req.Header.Set("Range", formatRange(offset, length))
+		}
+		start := time.Now()
+		resp, err := conn.HTTPClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		log.Debugf("B2Connection GetRange key %s returned HTTP %d after %s", key, resp.StatusCode, time.Since(start))
+		if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent {
+			return getRangeBody(resp, offset, length)
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			resp.Body.Close()
+			return nil, newObjectNotExistError(key)
+		}
+		err = newHTTPStatusError(resp)
+		if attempt == 0 && isB2ExpiredAuthToken(err) {
+			log.Debugf("B2Connection authorization token expired during download, re-authorizing")
+			if err := conn.authorize(ctx); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return nil, err
+	}
+}
@@ -0,0 +1,268 @@
+/*
+arqinator: connector/b2_test.go
+Tests the Backblaze B2 backup type against a local stub of the B2 native API.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package connector
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	B2_TEST_KEY_ID          = "test-key-id"
+	B2_TEST_APPLICATION_KEY = "test-application-key"
+	B2_TEST_BUCKET_NAME     = "arq-backups"
+	B2_TEST_BUCKET_ID       = "bucket-id"
+	B2_TEST_PAGE_SIZE       = 2
+)
+
+/*
+Just enough of the B2 native API to back a B2Connection: b2_authorize_account, b2_list_buckets,
+b2_list_file_names with pages of B2_TEST_PAGE_SIZE files, and b2_download_file_by_name with Range
+support. Setting expireToken makes the current authorization token expire.
+*/
+type b2Stub struct {
+	mutex          sync.Mutex
+	files          map[string][]byte
+	token          string
+	authorizations int
+	listCalls      int
+	expireToken    bool
+}
+
+func (s *b2Stub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/b2api/v2/b2_authorize_account" {
+		s.authorizeAccount(w, r)
+		return
+	}
+	s.mutex.Lock()
+	authorized := r.Header.Get("Authorization") == s.token && !s.expireToken
+	s.mutex.Unlock()
+	if !authorized {
+		writeB2Error(w, http.StatusUnauthorized, B2_EXPIRED_AUTH_CODE)
+		return
+	}
+	switch {
+	case r.URL.Path == "/b2api/v2/b2_list_buckets":
+		writeB2JSON(w, map[string]interface{}{
+			"buckets": []map[string]string{{"bucketId": B2_TEST_BUCKET_ID, "bucketName": B2_TEST_BUCKET_NAME}},
+		})
+	case r.URL.Path == "/b2api/v2/b2_list_file_names":
+		s.listFileNames(w, r)
+	case strings.HasPrefix(r.URL.Path, "/file/"+B2_TEST_BUCKET_NAME+"/"):
+		key := strings.TrimPrefix(r.URL.Path, "/file/"+B2_TEST_BUCKET_NAME+"/")
+		contents, ok := s.files[key]
+		if !ok {
+			writeB2Error(w, http.StatusNotFound, "not_found")
+			return
+		}
+		http.ServeContent(w, r, key, time.Time{}, bytes.NewReader(contents))
+	default:
+		writeB2Error(w, http.StatusNotFound, "bad_request")
+	}
+}
+
+func (s *b2Stub) authorizeAccount(w http.ResponseWriter, r *http.Request) {
+	keyID, applicationKey, ok := r.BasicAuth()
+	if !ok || keyID != B2_TEST_KEY_ID || applicationKey != B2_TEST_APPLICATION_KEY {
+		writeB2Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	s.mutex.Lock()
+	s.authorizations++
+	s.token = fmt.Sprintf("token-%d", s.authorizations)
+	s.expireToken = false
+	token := s.token
+	s.mutex.Unlock()
+	url := "http://" + r.Host
+	writeB2JSON(w, map[string]interface{}{
+		"accountId":          "account-id",
+		"authorizationToken": token,
+		"apiUrl":             url,
+		"downloadUrl":        url,
+		"allowed":            map[string]string{},
+	})
+}
+
+func (s *b2Stub) listFileNames(w http.ResponseWriter, r *http.Request) {
+	var request b2ListFileNamesRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.BucketID != B2_TEST_BUCKET_ID {
+		writeB2Error(w, http.StatusBadRequest, "bad_request")
+		return
+	}
+	s.mutex.Lock()
+	s.listCalls++
+	s.mutex.Unlock()
+	var names []string
+	for name := range s.files {
+		if strings.HasPrefix(name, request.Prefix) && name >= request.StartFileName {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	files := make([]map[string]interface{}, 0)
+	var nextFileName *string
+	for i, name := range names {
+		if i == B2_TEST_PAGE_SIZE {
+			nextFileName = &names[i]
+			break
+		}
+		files = append(files, map[string]interface{}{
+			"fileName": name, "contentLength": len(s.files[name]), "action": "upload",
+		})
+	}
+	writeB2JSON(w, map[string]interface{}{"files": files, "nextFileName": nextFileName})
+}
+
+func writeB2JSON(w http.ResponseWriter, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func writeB2Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(b2ErrorResponse{Status: status, Code: code, Message: code})
+}
+
+func newTestB2Connection(t *testing.T) (*B2Connection, *b2Stub) {
+	stub := &b2Stub{files: map[string][]byte{
+		"backup/a.pack":  []byte("contents of a"),
+		"backup/b.index": []byte("contents of b"),
+		"backup/c.pack":  []byte("0123456789"),
+		"other/d":        []byte("contents of d"),
+	}}
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+	conn, err := NewB2Connection(server.URL, B2_TEST_KEY_ID, B2_TEST_APPLICATION_KEY, B2_TEST_BUCKET_NAME, t.TempDir())
+	if err != nil {
+		t.Fatalf("NewB2Connection failed: %s", err)
+	}
+	return conn, stub
+}
+
+func TestB2Authorize(t *testing.T) {
+	conn, stub := newTestB2Connection(t)
+	if stub.authorizations != 1 {
+		t.Errorf("Expected 1 authorization, got %d", stub.authorizations)
+	}
+	if session := conn.getSession(); session.BucketID != B2_TEST_BUCKET_ID || session.AuthorizationToken != "token-1" {
+		t.Errorf("Unexpected bucket ID %s or token %s", session.BucketID, session.AuthorizationToken)
+	}
+
+	if _, err := NewB2Connection(conn.AuthURL, B2_TEST_KEY_ID, "wrong", B2_TEST_BUCKET_NAME, t.TempDir()); err == nil {
+		t.Errorf("Expected NewB2Connection with the wrong application key to fail")
+	}
+}
+
+func TestB2ListObjectsPaginates(t *testing.T) {
+	conn, stub := newTestB2Connection(t)
+	objects, err := conn.ListObjectsAsAll(context.Background(), "backup/")
+	if err != nil {
+		t.Fatalf("ListObjectsAsAll failed: %s", err)
+	}
+	var paths []string
+	for _, object := range objects {
+		paths = append(paths, object.GetPath())
+	}
+	expected := "backup/a.pack backup/b.index backup/c.pack"
+	if strings.Join(paths, " ") != expected {
+		t.Errorf("Expected %s, got %s", expected, strings.Join(paths, " "))
+	}
+	if objects[2].GetSize() != 10 {
+		t.Errorf("Expected size 10, got %d", objects[2].GetSize())
+	}
+	if stub.listCalls != 2 {
+		t.Errorf("Expected 2 pages of b2_list_file_names, got %d", stub.listCalls)
+	}
+}
+
+func TestB2GetRange(t *testing.T) {
+	conn, _ := newTestB2Connection(t)
+	tests := []struct {
+		offset   int64
+		length   int64
+		expected string
+	}{
+		{0, -1, "0123456789"},
+		{3, 4, "3456"},
+		{7, -1, "789"},
+	}
+	for _, test := range tests {
+		r, err := conn.GetRange(context.Background(), "backup/c.pack", test.offset, test.length)
+		if err != nil {
+			t.Fatalf("GetRange(%d, %d) failed: %s", test.offset, test.length, err)
+		}
+		contents, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || string(contents) != test.expected {
+			t.Errorf("GetRange(%d, %d) expected %s, got %s, %v", test.offset, test.length, test.expected, contents, err)
+		}
+	}
+
+	cacheFilepath, err := conn.CachedGet(context.Background(), "backup/a.pack")
+	if err != nil {
+		t.Fatalf("CachedGet failed: %s", err)
+	}
+	if contents, _ := ioutil.ReadFile(cacheFilepath); string(contents) != "contents of a" {
+		t.Errorf("Unexpected cached contents %s", contents)
+	}
+
+	if _, err := conn.CachedGet(context.Background(), "backup/missing"); !os.IsNotExist(err) {
+		t.Errorf("Expected CachedGet of a missing key to fail with a not exist error, got %v", err)
+	}
+}
+
+func TestB2ReauthorizesExpiredToken(t *testing.T) {
+	conn, stub := newTestB2Connection(t)
+
+	stub.mutex.Lock()
+	stub.expireToken = true
+	stub.mutex.Unlock()
+	if _, err := conn.ListObjectsAsAll(context.Background(), "other/"); err != nil {
+		t.Fatalf("ListObjectsAsAll after token expired failed: %s", err)
+	}
+
+	stub.mutex.Lock()
+	stub.expireToken = true
+	stub.mutex.Unlock()
+	r, err := conn.GetRange(context.Background(), "other/d", 0, -1)
+	if err != nil {
+		t.Fatalf("GetRange after token expired failed: %s", err)
+	}
+	r.Close()
+
+	if stub.authorizations != 3 {
+		t.Errorf("Expected 3 authorizations, got %d", stub.authorizations)
+	}
+	if token := conn.getSession().AuthorizationToken; token != "token-3" {
+		t.Errorf("Expected the connection to use the new token, got %s", token)
+	}
+}
@@ -0,0 +1,305 @@
+/*
+arqinator: connector/cache.go
+Implements helpers shared by connectors for storing downloaded objects in the cache directory.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package connector
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/asimihsan/arqinator/progress"
+)
+
+const (
+	// Next to every cache file is a checksum of its contents, in the format of sha256sum. A cache file
+	// without one was never completely written, or was written by an older version, and isn't trusted.
+	CACHE_CHECKSUM_SUFFIX = ".sha256"
+
+	// Downloads are written to temporary files with this suffix, and only renamed into place once
+	// they're complete.
+	CACHE_PARTIAL_SUFFIX = ".partial"
+)
+
+var (
+	ErrorCacheChecksumMismatch = errors.New("Cache file doesn't match its checksum")
+)
+
+/*
+Returned when a download is a different length to the object it's a download of, e.g. because the
+connection was dropped mid-way without an error. It's retryable, like any other truncated read.
+*/
+type cacheSizeError struct {
+	cacheFilepath string
+	expected      int64
+	actual        int64
+}
+
+func (e *cacheSizeError) Error() string {
+	return fmt.Sprintf("Downloaded %d bytes for cache file %s, expected %d", e.actual, e.cacheFilepath, e.expected)
+}
+
+func (e *cacheSizeError) Unwrap() error {
+	return io.ErrUnexpectedEOF
+}
+
+func cacheFilepathFor(cacheDirectory string, key string) (string, error) {
+	cacheFilepath := filepath.Join(cacheDirectory, key)
+	cacheFilepath, err := filepath.Abs(cacheFilepath)
+	if err != nil {
+		log.Debugf("Failed to make cacheFilepath %s absolute: %s", cacheFilepath, err)
+		return "", err
+	}
+	return cacheFilepath, nil
+}
+
+func checksumFilepathFor(cacheFilepath string) string {
+	return cacheFilepath + CACHE_CHECKSUM_SUFFIX
+}
+
+/*
+Whether cacheFilepath was completely downloaded. Zero-byte objects are cached like any other.
+*/
+func isCached(cacheFilepath string) bool {
+	if _, err := os.Stat(cacheFilepath); err != nil {
+		return false
+	}
+	if _, err := os.Stat(checksumFilepathFor(cacheFilepath)); err != nil {
+		log.Debugf("Cache file %s has no checksum, downloading it again", cacheFilepath)
+		return false
+	}
+	return true
+}
+
+/*
+Return the cached copy of key if there is one, else Get it. The cached copy could still have been
+corrupted since it was downloaded; callers that can't otherwise verify it should VerifyCacheFile.
+
+Only one process or goroutine downloads a key at a time, and the others wait for it and use its
+download.
+*/
+func cachedGet(ctx context.Context, conn Connection, key string) (string, error) {
+	cacheFilepath, err := cacheFilepathFor(conn.GetCacheDirectory(), key)
+	if err != nil {
+		log.Debugf("Failed to getCacheFilepath in CachedGet: %s", err)
+		return "", err
+	}
+	if isCached(cacheFilepath) {
+		return cacheFilepath, nil
+	}
+	unlock, err := LockCacheFile(ctx, conn.GetCacheDirectory(), key)
+	if err != nil {
+		log.Debugf("Failed to lock cache file of key %s: %s", key, err)
+		return cacheFilepath, err
+	}
+	defer unlock()
+	if isCached(cacheFilepath) {
+		return cacheFilepath, nil
+	}
+	cacheFilepath, err = conn.Get(ctx, key)
+	if err != nil {
+		log.Debugln("Failed to cachedGet key: ", key)
+		return cacheFilepath, err
+	}
+	return cacheFilepath, nil
+}
+
+/*
+Download into the cache file at cacheFilepath, creating parent directories as required. download writes
+the object to a temporary file, which is synced, checked to be expectedSize bytes long, checksummed, and
+only then renamed to cacheFilepath. The checksum sidecar of an earlier download is removed before the
+rename and the new one written after it, so a cache file with a sidecar is always complete and matches
+it. expectedSize of -1 means the size isn't known. On failure, including ctx being done, the temporary
+file is deleted.
+*/
+func downloadToCache(ctx context.Context, cacheFilepath string, expectedSize int64,
+	download func(w *os.File) error) error {
+	cacheDirectory := filepath.Dir(cacheFilepath)
+	if err := os.MkdirAll(cacheDirectory, 0777); err != nil {
+		log.Errorf("Couldn't create cache directory %s for cacheFilepath %s: %s",
+			cacheDirectory, cacheFilepath, err)
+		return err
+	}
+	w, err := ioutil.TempFile(cacheDirectory, filepath.Base(cacheFilepath)+".*"+CACHE_PARTIAL_SUFFIX)
+	if err != nil {
+		log.Errorf("Couldn't create cache file for cacheFilepath %s: %s", cacheFilepath, err)
+		return err
+	}
+	partialFilepath := w.Name()
+	err = download(w)
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err == nil {
+		err = w.Sync()
+	}
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && expectedSize >= 0 {
+		var fileInfo os.FileInfo
+		if fileInfo, err = os.Stat(partialFilepath); err == nil && fileInfo.Size() != expectedSize {
+			err = &cacheSizeError{cacheFilepath: cacheFilepath, expected: expectedSize, actual: fileInfo.Size()}
+		}
+	}
+	var checksum string
+	if err == nil {
+		checksum, err = checksumFile(partialFilepath)
+	}
+	if err == nil {
+		if err = os.Remove(checksumFilepathFor(cacheFilepath)); os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err == nil {
+		err = os.Rename(partialFilepath, cacheFilepath)
+	}
+	if err == nil {
+		// Written last, as isCached doesn't trust a cache file without one
+		err = writeChecksumFile(cacheFilepath, checksum)
+	}
+	if err != nil {
+		log.Errorf("Failed to write cache file %s: %s", cacheFilepath, err)
+		os.Remove(partialFilepath)
+		return err
+	}
+	return nil
+}
+
+/*
+Stream r into the cache file at cacheFilepath. See downloadToCache.
+*/
+func writeCacheFile(ctx context.Context, cacheFilepath string, r io.Reader, expectedSize int64) error {
+	return downloadToCache(ctx, cacheFilepath, expectedSize, func(w *os.File) error {
+		wBuffered := bufio.NewWriter(w)
+		if _, err := io.Copy(progress.NewTransferWriter(wBuffered, progress.Current()), newContextReader(ctx, r)); err != nil {
+			return err
+		}
+		return wBuffered.Flush()
+	})
+}
+
+/*
+The size of the object r reads, or -1 if it isn't known.
+*/
+func readerSize(r io.Reader) int64 {
+	if sized, ok := r.(interface{ Size() int64 }); ok {
+		return sized.Size()
+	}
+	return -1
+}
+
+func checksumFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Debugf("checksumFile failed to open %s: %s", path, err)
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, bufio.NewReader(f)); err != nil {
+		log.Debugf("checksumFile failed to read %s: %s", path, err)
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+/*
+Atomically write the checksum sidecar of cacheFilepath. It's written once the cache file is in place,
+so a cache file without one was never completely written.
+*/
+func writeChecksumFile(cacheFilepath string, checksum string) error {
+	w, err := ioutil.TempFile(filepath.Dir(cacheFilepath),
+		filepath.Base(checksumFilepathFor(cacheFilepath))+".*"+CACHE_PARTIAL_SUFFIX)
+	if err != nil {
+		log.Debugf("writeChecksumFile failed to create temporary file for %s: %s", cacheFilepath, err)
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s  %s\n", checksum, filepath.Base(cacheFilepath))
+	if err == nil {
+		err = w.Sync()
+	}
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(w.Name(), checksumFilepathFor(cacheFilepath))
+	}
+	if err != nil {
+		log.Debugf("writeChecksumFile failed for %s: %s", cacheFilepath, err)
+		os.Remove(w.Name())
+		return err
+	}
+	return nil
+}
+
+/*
+Check that the cache file at cacheFilepath still matches the checksum recorded when it was downloaded.
+Returns ErrorCacheChecksumMismatch if it doesn't, and an error satisfying os.IsNotExist if it has no
+checksum, e.g. because a Connection outside this package put it there.
+*/
+func VerifyCacheFile(cacheFilepath string) error {
+	contents, err := ioutil.ReadFile(checksumFilepathFor(cacheFilepath))
+	if err != nil {
+		log.Debugf("VerifyCacheFile failed to read checksum of %s: %s", cacheFilepath, err)
+		return err
+	}
+	fields := bytes.Fields(contents)
+	if len(fields) == 0 {
+		log.Debugf("VerifyCacheFile: checksum of %s is empty", cacheFilepath)
+		return ErrorCacheChecksumMismatch
+	}
+	checksum, err := checksumFile(cacheFilepath)
+	if err != nil {
+		return err
+	}
+	if checksum != string(fields[0]) {
+		log.Debugf("VerifyCacheFile: %s has checksum %s, expected %s", cacheFilepath, checksum, fields[0])
+		return ErrorCacheChecksumMismatch
+	}
+	return nil
+}
+
+/*
+Delete the cache file at cacheFilepath and its checksum, so that it's downloaded again. The checksum
+goes first, so the cache file stops being trusted even if removing it fails.
+*/
+func RemoveCacheFile(cacheFilepath string) error {
+	err := os.Remove(checksumFilepathFor(cacheFilepath))
+	if err != nil && !os.IsNotExist(err) {
+		log.Debugf("RemoveCacheFile failed to remove checksum of %s: %s", cacheFilepath, err)
+		return err
+	}
+	err = os.Remove(cacheFilepath)
+	if err != nil && !os.IsNotExist(err) {
+		log.Debugf("RemoveCacheFile failed to remove %s: %s", cacheFilepath, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+/*
+arqinator: connector/cache_lock.go
+Implements locking cache files between processes that share a cache directory.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package connector
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// Lock files are kept in this directory of the cache directory.
+	CACHE_LOCK_DIRECTORY = ".locks"
+
+	// Keys are spread over this many lock files, so that there aren't as many lock files as cache files.
+	CACHE_LOCK_STRIPES = 256
+
+	CACHE_LOCK_POLL_INTERVAL = 100 * time.Millisecond
+)
+
+/*
+Take an exclusive lock on the cache file of key, shared with other processes and goroutines using the
+same cache directory, waiting until it's free or ctx is done. Returns a function that releases the lock.
+Unrelated keys occasionally share a lock file and wait for each other. Locks aren't reentrant.
+*/
+func LockCacheFile(ctx context.Context, cacheDirectory string, key string) (func(), error) {
+	f, err := openCacheLockFile(cacheDirectory, key)
+	if err != nil {
+		return nil, err
+	}
+	// Polled rather than blocking, so that waiting can be cancelled.
+	for isWaiting := false; ; isWaiting = true {
+		isLocked, err := tryLockFile(f)
+		if err != nil {
+			log.Debugf("LockCacheFile failed to lock %s for key %s: %s", f.Name(), key, err)
+			f.Close()
+			return nil, err
+		}
+		if isLocked {
+			return newCacheUnlock(f, key), nil
+		}
+		if !isWaiting {
+			log.Debugf("Waiting for another download of %s to finish", key)
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, ctx.Err()
+		case <-time.After(CACHE_LOCK_POLL_INTERVAL):
+		}
+	}
+}
+
+/*
+Like LockCacheFile, but returns a nil function rather than waiting if the lock is taken.
+*/
+func tryLockCacheFile(cacheDirectory string, key string) (func(), error) {
+	f, err := openCacheLockFile(cacheDirectory, key)
+	if err != nil {
+		return nil, err
+	}
+	isLocked, err := tryLockFile(f)
+	if err != nil || !isLocked {
+		if err != nil {
+			log.Debugf("tryLockCacheFile failed to lock %s for key %s: %s", f.Name(), key, err)
+		}
+		f.Close()
+		return nil, err
+	}
+	return newCacheUnlock(f, key), nil
+}
+
+func openCacheLockFile(cacheDirectory string, key string) (*os.File, error) {
+	lockDirectory := filepath.Join(cacheDirectory, CACHE_LOCK_DIRECTORY)
+	if err := os.MkdirAll(lockDirectory, 0777); err != nil {
+		log.Debugf("LockCacheFile failed to create lock directory %s: %s", lockDirectory, err)
+		return nil, err
+	}
+	h := fnv.New32a()
+	h.Write([]byte(path.Clean(filepath.ToSlash(key))))
+	lockFilepath := filepath.Join(lockDirectory, fmt.Sprintf("%02x.lock", h.Sum32()%CACHE_LOCK_STRIPES))
+	f, err := os.OpenFile(lockFilepath, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		log.Debugf("LockCacheFile failed to open lock file %s: %s", lockFilepath, err)
+		return nil, err
+	}
+	return f, nil
+}
+
+func newCacheUnlock(f *os.File, key string) func() {
+	return func() {
+		if err := unlockFile(f); err != nil {
+			log.Debugf("LockCacheFile failed to unlock %s for key %s: %s", f.Name(), key, err)
+		}
+		f.Close()
+	}
+}
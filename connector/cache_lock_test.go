@@ -0,0 +1,170 @@
+/*
+arqinator: connector/cache_lock_test.go
+Tests that processes sharing a cache directory download each key once, by running copies of the test
+binary as helper processes.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package connector
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	CACHE_LOCK_TEST_HELPER_ENV    = "ARQINATOR_CACHE_LOCK_HELPER"
+	CACHE_LOCK_TEST_PROCESSES     = 5
+	CACHE_LOCK_TEST_KEY           = "backup/objects/a.pack"
+	CACHE_LOCK_TEST_DOWNLOAD_TIME = 200 * time.Millisecond
+)
+
+/*
+A Connection whose objects are files in remoteDirectory. Each download appends a line to downloadsFilepath,
+which processes share, and takes CACHE_LOCK_TEST_DOWNLOAD_TIME so that they overlap.
+*/
+type fileConnection struct {
+	remoteDirectory   string
+	cacheDirectory    string
+	downloadsFilepath string
+}
+
+func (c *fileConnection) String() string            { return "file://" + c.remoteDirectory }
+func (c *fileConnection) GetCacheDirectory() string { return c.cacheDirectory }
+func (c *fileConnection) Close() error              { return nil }
+
+func (c *fileConnection) ListObjectsAsFolders(ctx context.Context, prefix string) ([]Object, error) {
+	return nil, nil
+}
+
+func (c *fileConnection) ListObjectsAsAll(ctx context.Context, prefix string) ([]Object, error) {
+	return nil, nil
+}
+
+func (c *fileConnection) Get(ctx context.Context, key string) (string, error) {
+	f, err := os.OpenFile(c.downloadsFilepath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(f, "%d %s\n", os.Getpid(), key)
+	f.Close()
+	r, err := os.Open(filepath.Join(c.remoteDirectory, key))
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	time.Sleep(CACHE_LOCK_TEST_DOWNLOAD_TIME)
+	cacheFilepath, err := cacheFilepathFor(c.cacheDirectory, key)
+	if err != nil {
+		return "", err
+	}
+	return cacheFilepath, writeCacheFile(ctx, cacheFilepath, r, -1)
+}
+
+func (c *fileConnection) CachedGet(ctx context.Context, key string) (string, error) {
+	return cachedGet(ctx, c, key)
+}
+
+func newTestFileConnection(directory string) *fileConnection {
+	return &fileConnection{
+		remoteDirectory:   filepath.Join(directory, "remote"),
+		cacheDirectory:    filepath.Join(directory, "cache"),
+		downloadsFilepath: filepath.Join(directory, "downloads.log"),
+	}
+}
+
+/*
+Not a test, but run by TestCachedGetDownloadsOnceAcrossProcesses as a helper process. The environment
+variable gives the directory and the time to start at, so that the helpers all ask at once.
+*/
+func TestCachedGetHelperProcess(t *testing.T) {
+	value := os.Getenv(CACHE_LOCK_TEST_HELPER_ENV)
+	if value == "" {
+		t.Skip("only run as a helper process")
+	}
+	parts := strings.SplitN(value, ":", 2)
+	startNanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		t.Fatalf("Invalid %s %s", CACHE_LOCK_TEST_HELPER_ENV, value)
+	}
+	time.Sleep(time.Until(time.Unix(0, startNanos)))
+	conn := newTestFileConnection(parts[1])
+	cacheFilepath, err := conn.CachedGet(context.Background(), CACHE_LOCK_TEST_KEY)
+	if err != nil {
+		t.Fatalf("CachedGet failed: %s", err)
+	}
+	if err := VerifyCacheFile(cacheFilepath); err != nil {
+		t.Fatalf("VerifyCacheFile failed: %s", err)
+	}
+}
+
+func TestCachedGetDownloadsOnceAcrossProcesses(t *testing.T) {
+	directory := t.TempDir()
+	conn := newTestFileConnection(directory)
+	contents := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	remoteFilepath := filepath.Join(conn.remoteDirectory, CACHE_LOCK_TEST_KEY)
+	if err := os.MkdirAll(filepath.Dir(remoteFilepath), 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %s", err)
+	}
+	if err := ioutil.WriteFile(remoteFilepath, contents, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	start := time.Now().Add(500 * time.Millisecond)
+	helpers := make([]*exec.Cmd, CACHE_LOCK_TEST_PROCESSES)
+	outputs := make([]*bytes.Buffer, CACHE_LOCK_TEST_PROCESSES)
+	for i := range helpers {
+		helpers[i] = exec.Command(os.Args[0], "-test.run=^TestCachedGetHelperProcess$", "-test.v")
+		helpers[i].Env = append(os.Environ(),
+			fmt.Sprintf("%s=%d:%s", CACHE_LOCK_TEST_HELPER_ENV, start.UnixNano(), directory))
+		outputs[i] = &bytes.Buffer{}
+		helpers[i].Stdout = outputs[i]
+		helpers[i].Stderr = outputs[i]
+		if err := helpers[i].Start(); err != nil {
+			t.Fatalf("Failed to start helper process: %s", err)
+		}
+	}
+	for i, helper := range helpers {
+		if err := helper.Wait(); err != nil {
+			t.Errorf("Helper process %d failed: %s\n%s", i, err, outputs[i])
+		}
+	}
+
+	downloads, err := ioutil.ReadFile(conn.downloadsFilepath)
+	if err != nil {
+		t.Fatalf("Failed to read downloads: %s", err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(downloads)), "\n"); len(lines) != 1 {
+		t.Errorf("Expected 1 download, got %d:\n%s", len(lines), downloads)
+	}
+	cacheFilepath, _ := cacheFilepathFor(conn.cacheDirectory, CACHE_LOCK_TEST_KEY)
+	cached, err := ioutil.ReadFile(cacheFilepath)
+	if err != nil || !bytes.Equal(cached, contents) {
+		t.Errorf("Expected the cache file to be intact, got %d bytes, %v", len(cached), err)
+	}
+	if err := VerifyCacheFile(cacheFilepath); err != nil {
+		t.Errorf("VerifyCacheFile failed: %s", err)
+	}
+}
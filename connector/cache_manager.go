@@ -0,0 +1,428 @@
+/*
+arqinator: connector/cache_manager.go
+Implements keeping the cache directory under a size limit by evicting the least recently used files.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package connector
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// Partial downloads are only pruned once they're this old, as they could belong to a download that
+	// another process is still running.
+	CACHE_STALE_PARTIAL_AGE = time.Hour
+)
+
+/*
+Keeps a cache directory under a size limit by deleting the least recently used of the files that
+isEvictable allows, after each download. Files that can't be evicted count towards the limit but are
+never deleted, so the limit can be exceeded if they alone are bigger than it.
+
+Last use is recorded in each file's modification time, so the order carries over between runs. Files
+that other processes add to the cache directory are only noticed when it's next scanned.
+*/
+type CacheManager struct {
+	Directory string
+
+	// In bytes. 0 means no limit.
+	MaxSize int64
+
+	isEvictable func(key string) bool
+
+	mutex sync.Mutex
+	// By key, relative to Directory with forward slashes. nil until the directory is first scanned.
+	entries   map[string]*cacheEntry
+	totalSize int64
+}
+
+type cacheEntry struct {
+	// Including the checksum sidecar
+	size     int64
+	lastUsed time.Time
+}
+
+/*
+What's in a cache directory. Leftovers are partial downloads and checksums without a cache file.
+*/
+type CacheStats struct {
+	Files          int
+	Size           int64
+	EvictableFiles int
+	EvictableSize  int64
+	LeftoverFiles  int
+	LeftoverSize   int64
+}
+
+type cacheLeftover struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+func NewCacheManager(directory string, maxSize int64, isEvictable func(key string) bool) (*CacheManager, error) {
+	directory, err := filepath.Abs(directory)
+	if err != nil {
+		log.Debugf("NewCacheManager failed to make cache directory %s absolute: %s", directory, err)
+		return nil, err
+	}
+	return &CacheManager{
+		Directory:   directory,
+		MaxSize:     maxSize,
+		isEvictable: isEvictable,
+	}, nil
+}
+
+func (m *CacheManager) keyFor(cacheFilepath string) (string, bool) {
+	key, err := filepath.Rel(m.Directory, cacheFilepath)
+	if err != nil || key == ".." || strings.HasPrefix(key, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(key), true
+}
+
+/*
+Rebuild entries from what's on disk, and return what was found.
+*/
+func (m *CacheManager) scanLocked() (CacheStats, []cacheLeftover, error) {
+	var (
+		stats     CacheStats
+		leftovers []cacheLeftover
+		checksums = make(map[string]os.FileInfo)
+	)
+	entries := make(map[string]*cacheEntry)
+	err := filepath.Walk(m.Directory, func(p string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fileInfo.IsDir() {
+			if p == filepath.Join(m.Directory, CACHE_LOCK_DIRECTORY) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		key, ok := m.keyFor(p)
+		if !ok {
+			return nil
+		}
+		switch {
+		case strings.HasSuffix(key, CACHE_PARTIAL_SUFFIX):
+			leftovers = append(leftovers, cacheLeftover{path: p, size: fileInfo.Size(), modTime: fileInfo.ModTime()})
+		case strings.HasSuffix(key, CACHE_CHECKSUM_SUFFIX):
+			checksums[strings.TrimSuffix(key, CACHE_CHECKSUM_SUFFIX)] = fileInfo
+		default:
+			entries[key] = &cacheEntry{size: fileInfo.Size(), lastUsed: fileInfo.ModTime()}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Debugf("Failed to scan cache directory %s: %s", m.Directory, err)
+		return stats, nil, err
+	}
+	for key, fileInfo := range checksums {
+		if entry, ok := entries[key]; ok {
+			entry.size += fileInfo.Size()
+		} else {
+			leftovers = append(leftovers, cacheLeftover{path: filepath.Join(m.Directory, filepath.FromSlash(key)) +
+				CACHE_CHECKSUM_SUFFIX, size: fileInfo.Size(), modTime: fileInfo.ModTime()})
+		}
+	}
+	m.entries = entries
+	m.totalSize = 0
+	for key, entry := range entries {
+		m.totalSize += entry.size
+		stats.Files++
+		stats.Size += entry.size
+		if m.isEvictable(key) {
+			stats.EvictableFiles++
+			stats.EvictableSize += entry.size
+		}
+	}
+	for _, leftover := range leftovers {
+		stats.LeftoverFiles++
+		stats.LeftoverSize += leftover.size
+	}
+	return stats, leftovers, nil
+}
+
+/*
+Mark a file that's about to be read as used, so that it isn't evicted by a concurrent download.
+*/
+func (m *CacheManager) touch(cacheFilepath string) {
+	key, ok := m.keyFor(cacheFilepath)
+	if !ok {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if entry, ok := m.entries[key]; ok {
+		entry.lastUsed = time.Now()
+	}
+}
+
+/*
+Record that cacheFilepath was read or downloaded, then evict other files if the cache is over its limit.
+*/
+func (m *CacheManager) used(cacheFilepath string) {
+	key, ok := m.keyFor(cacheFilepath)
+	if !ok {
+		log.Debugf("CacheManager: %s is outside cache directory %s", cacheFilepath, m.Directory)
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.entries == nil {
+		if _, _, err := m.scanLocked(); err != nil {
+			log.Warnf("Failed to scan cache directory %s, not limiting its size: %s", m.Directory, err)
+			return
+		}
+	}
+	fileInfo, err := os.Stat(cacheFilepath)
+	if err != nil {
+		log.Debugf("CacheManager failed to stat %s: %s", cacheFilepath, err)
+		return
+	}
+	size := fileInfo.Size()
+	if checksumInfo, err := os.Stat(checksumFilepathFor(cacheFilepath)); err == nil {
+		size += checksumInfo.Size()
+	}
+	entry, ok := m.entries[key]
+	if ok {
+		m.totalSize -= entry.size
+	} else {
+		entry = &cacheEntry{}
+		m.entries[key] = entry
+	}
+	now := time.Now()
+	entry.size = size
+	entry.lastUsed = now
+	m.totalSize += size
+	if err := os.Chtimes(cacheFilepath, now, now); err != nil {
+		log.Debugf("CacheManager failed to update last use of %s: %s", cacheFilepath, err)
+	}
+	m.evictLocked(key)
+}
+
+/*
+Delete the least recently used evictable files, other than the one with key keep, until the cache is
+under its limit. Returns how many files and bytes were freed. Other processes may share the cache
+directory, so a file that's being downloaded is skipped, and so is one whose modification time shows
+it was used since it was last scanned.
+*/
+func (m *CacheManager) evictLocked(keep string) (int, int64) {
+	if m.MaxSize <= 0 || m.totalSize <= m.MaxSize {
+		return 0, 0
+	}
+	var candidates []string
+	for key := range m.entries {
+		if key != keep && m.isEvictable(key) {
+			candidates = append(candidates, key)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return m.entries[candidates[i]].lastUsed.Before(m.entries[candidates[j]].lastUsed)
+	})
+	var (
+		freedFiles int
+		freedSize  int64
+	)
+	for _, key := range candidates {
+		if m.totalSize <= m.MaxSize {
+			break
+		}
+		entry := m.entries[key]
+		if m.evictEntryLocked(key, entry) {
+			freedFiles++
+			freedSize += entry.size
+		}
+	}
+	if m.totalSize > m.MaxSize {
+		log.Debugf("Cache directory %s is %d bytes, over its limit of %d, with nothing left to evict",
+			m.Directory, m.totalSize, m.MaxSize)
+	}
+	return freedFiles, freedSize
+}
+
+/*
+Delete the file with key, unless it's in use. Returns whether it was deleted.
+*/
+func (m *CacheManager) evictEntryLocked(key string, entry *cacheEntry) bool {
+	unlock, err := tryLockCacheFile(m.Directory, key)
+	if err != nil || unlock == nil {
+		log.Debugf("CacheManager not evicting %s, it's being downloaded: %v", key, err)
+		return false
+	}
+	defer unlock()
+	cacheFilepath := filepath.Join(m.Directory, filepath.FromSlash(key))
+	fileInfo, err := os.Stat(cacheFilepath)
+	if os.IsNotExist(err) {
+		log.Debugf("CacheManager found %s already evicted", key)
+		delete(m.entries, key)
+		m.totalSize -= entry.size
+		return false
+	}
+	if err == nil && fileInfo.ModTime().After(entry.lastUsed) {
+		log.Debugf("CacheManager not evicting %s, it was used at %s", key, fileInfo.ModTime())
+		entry.lastUsed = fileInfo.ModTime()
+		return false
+	}
+	// On Windows this fails for files that are still open, which are then evicted later.
+	if err := RemoveCacheFile(cacheFilepath); err != nil {
+		log.Debugf("CacheManager failed to evict %s: %s", key, err)
+		return false
+	}
+	log.Debugf("CacheManager evicted %s, last used %s", key, entry.lastUsed)
+	delete(m.entries, key)
+	m.totalSize -= entry.size
+	return true
+}
+
+/*
+Scan the cache directory and return what's in it.
+*/
+func (m *CacheManager) Stats() (CacheStats, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	stats, _, err := m.scanLocked()
+	return stats, err
+}
+
+/*
+Delete stale partial downloads and checksums without a cache file, then evict files until the cache is
+under MaxSize. Returns how many files and bytes were freed.
+*/
+func (m *CacheManager) Prune() (int, int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	_, leftovers, err := m.scanLocked()
+	if err != nil {
+		return 0, 0, err
+	}
+	var (
+		freedFiles int
+		freedSize  int64
+	)
+	for _, leftover := range leftovers {
+		if time.Since(leftover.modTime) < CACHE_STALE_PARTIAL_AGE {
+			continue
+		}
+		if err := os.Remove(leftover.path); err != nil && !os.IsNotExist(err) {
+			log.Debugf("CacheManager failed to remove leftover %s: %s", leftover.path, err)
+			continue
+		}
+		freedFiles++
+		freedSize += leftover.size
+	}
+	evictedFiles, evictedSize := m.evictLocked("")
+	return freedFiles + evictedFiles, freedSize + evictedSize, nil
+}
+
+/*
+Delete everything in the cache directory.
+*/
+func (m *CacheManager) Clear() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.entries = nil
+	m.totalSize = 0
+	if err := os.RemoveAll(m.Directory); err != nil {
+		log.Debugf("CacheManager failed to clear %s: %s", m.Directory, err)
+		return err
+	}
+	return nil
+}
+
+/*
+Records the files a connection downloads or reads from the cache with a CacheManager.
+*/
+type cacheManagedConnection struct {
+	conn    Connection
+	manager *CacheManager
+}
+
+type cacheManagedRangeConnection struct {
+	cacheManagedConnection
+	rangeConn RangeConnection
+}
+
+/*
+Wrap conn so that manager keeps its cache directory under manager's size limit. The result is a
+RangeConnection if conn is one.
+*/
+func NewCacheManagedConnection(conn Connection, manager *CacheManager) Connection {
+	c := cacheManagedConnection{conn: conn, manager: manager}
+	if rangeConn, ok := conn.(RangeConnection); ok {
+		return cacheManagedRangeConnection{cacheManagedConnection: c, rangeConn: rangeConn}
+	}
+	return c
+}
+
+func (c cacheManagedConnection) String() string {
+	return c.conn.String()
+}
+
+func (c cacheManagedConnection) GetCacheDirectory() string {
+	return c.conn.GetCacheDirectory()
+}
+
+func (c cacheManagedConnection) Close() error {
+	return c.conn.Close()
+}
+
+func (c cacheManagedConnection) ListObjectsAsFolders(ctx context.Context, prefix string) ([]Object, error) {
+	return c.conn.ListObjectsAsFolders(ctx, prefix)
+}
+
+func (c cacheManagedConnection) ListObjectsAsAll(ctx context.Context, prefix string) ([]Object, error) {
+	return c.conn.ListObjectsAsAll(ctx, prefix)
+}
+
+func (c cacheManagedConnection) Get(ctx context.Context, key string) (string, error) {
+	cacheFilepath, err := c.conn.Get(ctx, key)
+	if err == nil {
+		c.manager.used(cacheFilepath)
+	}
+	return cacheFilepath, err
+}
+
+func (c cacheManagedConnection) CachedGet(ctx context.Context, key string) (string, error) {
+	if cacheFilepath, err := cacheFilepathFor(c.conn.GetCacheDirectory(), key); err == nil {
+		c.manager.touch(cacheFilepath)
+	}
+	cacheFilepath, err := c.conn.CachedGet(ctx, key)
+	if err == nil {
+		c.manager.used(cacheFilepath)
+	}
+	return cacheFilepath, err
+}
+
+func (c cacheManagedRangeConnection) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error) {
+	return c.rangeConn.GetRange(ctx, key, offset, length)
+}
@@ -0,0 +1,90 @@
+/*
+arqinator: connector/cache_manager_test.go
+Tests evicting cache files that other processes sharing the cache directory may be using.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package connector
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+/*
+Put a 10 byte file and its checksum in the cache, last used age ago.
+*/
+func writeTestCacheFile(t *testing.T, directory string, key string, age time.Duration) string {
+	cacheFilepath := filepath.Join(directory, key)
+	if err := downloadToCache(context.Background(), cacheFilepath, 10, func(w *os.File) error {
+		_, err := w.WriteString("0123456789")
+		return err
+	}); err != nil {
+		t.Fatalf("downloadToCache failed: %s", err)
+	}
+	lastUsed := time.Now().Add(-age)
+	if err := os.Chtimes(cacheFilepath, lastUsed, lastUsed); err != nil {
+		t.Fatalf("Chtimes failed: %s", err)
+	}
+	return cacheFilepath
+}
+
+func isTestCacheFilePresent(cacheFilepath string) bool {
+	_, err := os.Stat(cacheFilepath)
+	return err == nil
+}
+
+func TestCacheManagerEvictsOnlyUnusedFiles(t *testing.T) {
+	directory := t.TempDir()
+	manager, err := NewCacheManager(directory, 200, func(key string) bool { return true })
+	if err != nil {
+		t.Fatalf("NewCacheManager failed: %s", err)
+	}
+	oldest := writeTestCacheFile(t, directory, "objects/a", 3*time.Hour)
+	usedElsewhere := writeTestCacheFile(t, directory, "objects/b", 2*time.Hour)
+	locked := writeTestCacheFile(t, directory, "objects/c", time.Hour)
+	newest := writeTestCacheFile(t, directory, "objects/d", time.Minute)
+	if _, err := manager.Stats(); err != nil {
+		t.Fatalf("Stats failed: %s", err)
+	}
+
+	// Another process reads b after the scan, and is downloading c.
+	now := time.Now()
+	if err := os.Chtimes(usedElsewhere, now, now); err != nil {
+		t.Fatalf("Chtimes failed: %s", err)
+	}
+	unlock, err := LockCacheFile(context.Background(), directory, "objects/c")
+	if err != nil {
+		t.Fatalf("LockCacheFile failed: %s", err)
+	}
+	defer unlock()
+
+	// Using d evicts everything else it can, as the cache is over its limit.
+	manager.MaxSize = 1
+	manager.used(newest)
+	if isTestCacheFilePresent(oldest) {
+		t.Errorf("Expected a to be evicted")
+	}
+	if _, err := os.Stat(checksumFilepathFor(oldest)); !os.IsNotExist(err) {
+		t.Errorf("Expected the checksum of an evicted file to be removed too, got %v", err)
+	}
+	if !isTestCacheFilePresent(usedElsewhere) || !isTestCacheFilePresent(locked) || !isTestCacheFilePresent(newest) {
+		t.Errorf("Expected b, used since the scan, c, being downloaded, and d, just used, to be kept")
+	}
+}
@@ -19,16 +19,47 @@ Copyright 2015 Asim Ihsan
 
 package connector
 
+import (
+	"context"
+	"io"
+	"os"
+)
+
 type Object interface {
 	GetPath() string
+
+	// Size in bytes of the object, or zero for folders and if the backup type doesn't know.
+	GetSize() int64
 }
 
+/*
+Calls that talk to the backup's storage stop and return the context's error once ctx is done, leaving
+nothing partially downloaded in the cache. Downloading a key that doesn't exist returns an error
+satisfying os.IsNotExist.
+*/
 type Connection interface {
 	String() string
 	GetCacheDirectory() string
-	ListObjectsAsFolders(prefix string) ([]Object, error)
-	ListObjectsAsAll(prefix string) ([]Object, error)
-	Get(key string) (string, error)
-	CachedGet(key string) (string, error)
+	ListObjectsAsFolders(ctx context.Context, prefix string) ([]Object, error)
+	ListObjectsAsAll(ctx context.Context, prefix string) ([]Object, error)
+	Get(ctx context.Context, key string) (string, error)
+	CachedGet(ctx context.Context, key string) (string, error)
 	Close() error
 }
+
+/*
+Optionally implemented by connections whose backup type can download part of an object without
+downloading all of it, e.g. using an HTTP Range header. length of -1 means until the end of the
+object.
+*/
+type RangeConnection interface {
+	Connection
+	GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error)
+}
+
+/*
+Returned for a key that doesn't exist. os.IsNotExist only sees through an os.PathError.
+*/
+func newObjectNotExistError(key string) error {
+	return &os.PathError{Op: "get", Path: key, Err: os.ErrNotExist}
+}
@@ -0,0 +1,80 @@
+/*
+arqinator: connector/context.go
+Implements helpers shared by connectors for stopping work when a context is cancelled.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package connector
+
+import (
+	"context"
+	"io"
+)
+
+/*
+Fails reads once ctx is done, so that copying a download stops between reads.
+*/
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func newContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return contextReader{ctx: ctx, r: r}
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+/*
+Fails writes once ctx is done, for downloaders that write rather than hand back a reader.
+*/
+type contextWriterAt struct {
+	ctx context.Context
+	w   io.WriterAt
+}
+
+func newContextWriterAt(ctx context.Context, w io.WriterAt) io.WriterAt {
+	return contextWriterAt{ctx: ctx, w: w}
+}
+
+func (w contextWriterAt) WriteAt(p []byte, offset int64) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.w.WriteAt(p, offset)
+}
+
+/*
+A context that is cancelled with ctx but has the values of values, for libraries that keep credentials
+in a context.
+*/
+type valuesContext struct {
+	context.Context
+	values context.Context
+}
+
+func withValuesOf(ctx context.Context, values context.Context) context.Context {
+	return valuesContext{Context: ctx, values: values}
+}
+
+func (c valuesContext) Value(key interface{}) interface{} {
+	return c.values.Value(key)
+}
@@ -20,24 +20,24 @@ Copyright 2015 Asim Ihsan
 package connector
 
 import (
-	"bufio"
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
-	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/cloud"
 	"google.golang.org/cloud/storage"
 )
 
 type GoogleCloudStorageConnection struct {
+	// Holds the credentials, calls are cancelled by the context passed to them
 	Context        context.Context
 	BucketName     string
 	CacheDirectory string
@@ -85,6 +85,7 @@ func NewGoogleCloudStorageConnection(jsonPrivateKeyFilepath string, projectID st
 
 type GoogleCloudStorageObject struct {
 	Name string
+	Size int64
 }
 
 func (o GoogleCloudStorageObject) String() string {
@@ -95,15 +96,37 @@ func (o GoogleCloudStorageObject) GetPath() string {
 	return o.Name
 }
 
-func (conn GoogleCloudStorageConnection) ListObjectsAsFolders(prefix string) ([]Object, error) {
-	return conn.listObjects(prefix, "/")
+func (o GoogleCloudStorageObject) GetSize() int64 {
+	return o.Size
 }
 
-func (conn GoogleCloudStorageConnection) ListObjectsAsAll(prefix string) ([]Object, error) {
-	return conn.listObjects(prefix, ",")
+/*
+Listing fails with a googleapi.Error, but storage.NewReader only gives the status code in its message.
+*/
+func (conn GoogleCloudStorageConnection) isRetryableError(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return isRetryableStatusCode(apiErr.Code)
+	}
+	message := err.Error()
+	if i := strings.LastIndex(message, "status code: "); i != -1 {
+		var statusCode int
+		if _, err := fmt.Sscanf(message[i:], "status code: %d", &statusCode); err == nil {
+			return isRetryableStatusCode(statusCode)
+		}
+	}
+	return false
+}
+
+func (conn GoogleCloudStorageConnection) ListObjectsAsFolders(ctx context.Context, prefix string) ([]Object, error) {
+	return conn.listObjects(ctx, prefix, "/")
 }
 
-func (conn GoogleCloudStorageConnection) listObjects(prefix string, delimiter string) ([]Object, error) {
+func (conn GoogleCloudStorageConnection) ListObjectsAsAll(ctx context.Context, prefix string) ([]Object, error) {
+	return conn.listObjects(ctx, prefix, ",")
+}
+
+func (conn GoogleCloudStorageConnection) listObjects(ctx context.Context, prefix string, delimiter string) ([]Object, error) {
 	log.Debugf("GoogleCloudStorageConnection listObjects. prefix: %s, delimeter: %s", prefix, delimiter)
 	objects := make([]Object, 0)
 	query := &storage.Query{
@@ -111,7 +134,7 @@ func (conn GoogleCloudStorageConnection) listObjects(prefix string, delimiter st
 		Delimiter: delimiter,
 	}
 	for {
-		gcsObjects, err := storage.ListObjects(conn.Context, conn.BucketName, query)
+		gcsObjects, err := storage.ListObjects(withValuesOf(ctx, conn.Context), conn.BucketName, query)
 		if err != nil {
 			return objects, err
 		}
@@ -127,6 +150,7 @@ func (conn GoogleCloudStorageConnection) listObjects(prefix string, delimiter st
 			for _, gcsObject := range gcsObjects.Results {
 				object := GoogleCloudStorageObject{
 					Name: gcsObject.Name,
+					Size: gcsObject.Size,
 				}
 				objects = append(objects, object)
 			}
@@ -151,64 +175,36 @@ func (conn GoogleCloudStorageConnection) getCacheFilepath(key string) (string, e
 	return cacheFilepath, nil
 }
 
-func (conn GoogleCloudStorageConnection) CachedGet(name string) (string, error) {
-	cacheFilepath, err := conn.getCacheFilepath(name)
-	if err != nil {
-		log.Debugf("Failed to getCacheFilepath in CachedGet: %s", err)
-		return "", err
-	}
-	fileInfo, err := os.Stat(cacheFilepath)
-	if err == nil && fileInfo.Size() != 0 {
-		// file exists, so if it's zero-byte then we don't need to retrieve it again
-		// however the file could still be corrupted. a connector cannot know if a file is corrupted or not,
-		// it's up to callers to verify that downloaded files are uncorrupted.
-		return cacheFilepath, nil
-	}
-	cacheFilepath, err = conn.Get(name)
-	if err != nil {
-		log.Debugln("Failed to cachedGet key: ", name)
-		return cacheFilepath, err
-	}
-	return cacheFilepath, nil
+func (conn GoogleCloudStorageConnection) CachedGet(ctx context.Context, name string) (string, error) {
+	return cachedGet(ctx, conn, name)
 }
 
-func (conn GoogleCloudStorageConnection) Get(name string) (string, error) {
+func (conn GoogleCloudStorageConnection) Get(ctx context.Context, name string) (string, error) {
 	log.Debugf("GoogleCloudStorageConnection Get. name: %s", name)
 	cacheFilepath, err := conn.getCacheFilepath(name)
 	if err != nil {
 		log.Errorf("Failed to getCacheFilepath in Get: %s", err)
 		return cacheFilepath, err
 	}
-	cacheDirectory := filepath.Dir(cacheFilepath)
-	err = os.MkdirAll(cacheDirectory, 0777)
+	storageCtx := withValuesOf(ctx, conn.Context)
+	object, err := storage.StatObject(storageCtx, conn.BucketName, name)
 	if err != nil {
-		log.Errorf("Couldn't create cache directory for cacheFilepath %s: %s", cacheFilepath, err)
-		return cacheFilepath, err
-	}
-	if _, err = os.Stat(cacheDirectory); err != nil {
-		log.Errorf("Cache directory %s doesn't exist!", cacheDirectory)
-		return cacheFilepath, err
-	}
-	w, err := os.Create(cacheFilepath)
-	if err != nil {
-		log.Errorf("Couldn't create cache file for cacheFilepath %s: %s", cacheFilepath, err)
+		log.Errorf("Failed to get size of name %s: %s", name, err)
+		if err == storage.ErrObjectNotExist {
+			return cacheFilepath, newObjectNotExistError(name)
+		}
 		return cacheFilepath, err
 	}
-	defer w.Close()
-	wBuffered := bufio.NewWriter(w)
-	defer wBuffered.Flush()
-	r, err := storage.NewReader(conn.Context, conn.BucketName, name)
+	r, err := storage.NewReader(storageCtx, conn.BucketName, name)
 	if err != nil {
 		log.Errorf("Failed to download name %s during initialization: %s", name, err)
-		defer os.Remove(cacheFilepath)
 		return cacheFilepath, err
 	}
 	defer r.Close()
-	_, err = io.Copy(wBuffered, r)
+	err = writeCacheFile(ctx, cacheFilepath, r, object.Size)
 	time.Sleep(100 * time.Millisecond)
 	if err != nil {
 		log.Errorf("Failed to download name %s during download: %s", name, err)
-		defer os.Remove(cacheFilepath)
 		return cacheFilepath, err
 	}
 	return cacheFilepath, nil
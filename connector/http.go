@@ -0,0 +1,148 @@
+/*
+arqinator: connector/http.go
+Implements helpers shared by connectors for backup types that are accessed over HTTP.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package connector
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	MAX_ERROR_BODY_BYTES = 4096
+)
+
+/*
+Build an HTTP client for talking to servers with self-signed or privately issued certificates, e.g. an
+on-premise S3-compatible store. caBundleFilepath is a PEM file of extra root certificates to trust, and
+may be empty.
+*/
+func NewHTTPClient(insecureSkipVerify bool, caBundleFilepath string) (*http.Client, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+	if insecureSkipVerify {
+		log.Warnf("TLS certificate verification is disabled, connections are vulnerable to interception.")
+	}
+	if caBundleFilepath != "" {
+		pem, err := ioutil.ReadFile(caBundleFilepath)
+		if err != nil {
+			log.Debugf("NewHTTPClient failed to read CA bundle %s: %s", caBundleFilepath, err)
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			log.Debugf("NewHTTPClient couldn't load system root certificates, only trusting CA bundle: %s", err)
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New(fmt.Sprintf("No PEM certificates found in CA bundle %s", caBundleFilepath))
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
+
+/*
+Returned when a server responds with an unexpected HTTP status code.
+*/
+type HTTPStatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Body       string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("%s %s returned HTTP %d: %s", e.Method, e.URL, e.StatusCode, e.Body)
+}
+
+/*
+Build an HTTPStatusError from a response, and close the response body.
+*/
+func newHTTPStatusError(resp *http.Response) error {
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, MAX_ERROR_BODY_BYTES))
+	return &HTTPStatusError{
+		Method:     resp.Request.Method,
+		URL:        resp.Request.URL.String(),
+		StatusCode: resp.StatusCode,
+		Body:       string(body),
+	}
+}
+
+type rangeReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+/*
+The body of a response for a whole object, which knows how long the object is so that downloads of it
+can be checked for truncation.
+*/
+type sizedReadCloser struct {
+	io.ReadCloser
+	size int64
+}
+
+func (r sizedReadCloser) Size() int64 {
+	return r.size
+}
+
+/*
+Return the body of a response to a request for a range of an object. Servers are allowed to ignore the
+Range header and return the whole object, in which case we skip to the range ourselves.
+*/
+func getRangeBody(resp *http.Response, offset int64, length int64) (io.ReadCloser, error) {
+	if offset == 0 && length < 0 {
+		return sizedReadCloser{ReadCloser: resp.Body, size: resp.ContentLength}, nil
+	}
+	if resp.StatusCode == http.StatusPartialContent {
+		return resp.Body, nil
+	}
+	if offset > 0 {
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	}
+	if length < 0 {
+		return resp.Body, nil
+	}
+	return rangeReadCloser{Reader: io.LimitReader(resp.Body, length), Closer: resp.Body}, nil
+}
+
+/*
+Format an HTTP Range header value. length of -1 means until the end of the object.
+*/
+func formatRange(offset int64, length int64) string {
+	if length < 0 {
+		return fmt.Sprintf("bytes=%d-", offset)
+	}
+	return fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+}
@@ -0,0 +1,257 @@
+/*
+arqinator: connector/retry.go
+Implements retrying connector operations that fail with transient errors.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package connector
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	DEFAULT_RETRY_ATTEMPTS        = 5
+	DEFAULT_RETRY_INITIAL_BACKOFF = 500 * time.Millisecond
+	DEFAULT_RETRY_MAX_BACKOFF     = 30 * time.Second
+)
+
+type RetryPolicy struct {
+	// Tries of an operation, including the first. 1 or less means don't retry.
+	Attempts int
+
+	// The wait before the first retry, which doubles for each retry after it up to MaxBackoff. A random
+	// part of each wait is taken off, so that concurrent downloads that failed together don't retry
+	// together.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// Whether an error is worth retrying, by default IsRetryableError.
+	IsRetryable func(err error) bool
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		Attempts:       DEFAULT_RETRY_ATTEMPTS,
+		InitialBackoff: DEFAULT_RETRY_INITIAL_BACKOFF,
+		MaxBackoff:     DEFAULT_RETRY_MAX_BACKOFF,
+	}
+}
+
+/*
+Implemented by connections whose storage library has its own transient errors, e.g. throttling.
+*/
+type retryableErrorClassifier interface {
+	isRetryableError(err error) bool
+}
+
+/*
+Whether err looks transient: a timeout, a dropped or refused connection, or an HTTP status that asks the
+client to try again. Cancellation and missing objects are never retried, nor are other network errors,
+e.g. an unknown host or a failed TLS handshake, which trying again won't fix.
+*/
+func IsRetryableError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || os.IsNotExist(err) {
+		return false
+	}
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return isRetryableStatusCode(statusErr.StatusCode)
+	}
+	// e.g. the S3 SDK's awserr.RequestFailure
+	var statusCoder interface{ StatusCode() int }
+	if errors.As(err, &statusCoder) {
+		return isRetryableStatusCode(statusCoder.StatusCode())
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.EPIPE)
+}
+
+func isRetryableStatusCode(statusCode int) bool {
+	return statusCode == http.StatusRequestTimeout || statusCode == http.StatusTooManyRequests ||
+		statusCode >= 500
+}
+
+/*
+Wait before retry number retry, counting from 1, or until ctx is done.
+*/
+func (p RetryPolicy) backoff(ctx context.Context, retry int) error {
+	wait := p.InitialBackoff
+	for i := 1; i < retry && wait < p.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > p.MaxBackoff {
+		wait = p.MaxBackoff
+	}
+	if wait > 0 {
+		wait -= time.Duration(rand.Int63n(int64(wait)/2 + 1))
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/*
+Run operation until it succeeds, fails with an error that isn't retryable, or runs out of attempts.
+description names the operation in logs.
+*/
+func (p RetryPolicy) do(ctx context.Context, description string, isRetryable func(err error) bool,
+	operation func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := operation()
+		if err == nil {
+			if attempt > 1 {
+				log.Debugf("%s succeeded on attempt %d", description, attempt)
+			}
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !isRetryable(err) {
+			return err
+		}
+		if attempt >= p.Attempts {
+			log.Warnf("%s failed after %d attempts, giving up: %s", description, attempt, err)
+			return err
+		}
+		log.Warnf("%s failed, retrying (attempt %d of %d): %s", description, attempt+1, p.Attempts, err)
+		if err := p.backoff(ctx, attempt); err != nil {
+			return err
+		}
+	}
+}
+
+/*
+Retries the operations of a connection. Returned readers of GetRange aren't retried once reading has
+started.
+*/
+type retryingConnection struct {
+	conn   Connection
+	policy RetryPolicy
+}
+
+type retryingRangeConnection struct {
+	retryingConnection
+	rangeConn RangeConnection
+}
+
+/*
+Wrap conn so that its operations are retried according to policy. The result is a RangeConnection if
+conn is one.
+*/
+func NewRetryingConnection(conn Connection, policy RetryPolicy) Connection {
+	c := retryingConnection{conn: conn, policy: policy}
+	if rangeConn, ok := conn.(RangeConnection); ok {
+		return retryingRangeConnection{retryingConnection: c, rangeConn: rangeConn}
+	}
+	return c
+}
+
+func (c retryingConnection) isRetryable(err error) bool {
+	if c.policy.IsRetryable != nil {
+		return c.policy.IsRetryable(err)
+	}
+	if classifier, ok := c.conn.(retryableErrorClassifier); ok && classifier.isRetryableError(err) {
+		return true
+	}
+	return IsRetryableError(err)
+}
+
+func (c retryingConnection) String() string {
+	return c.conn.String()
+}
+
+func (c retryingConnection) GetCacheDirectory() string {
+	return c.conn.GetCacheDirectory()
+}
+
+func (c retryingConnection) Close() error {
+	return c.conn.Close()
+}
+
+func (c retryingConnection) ListObjectsAsFolders(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	err := c.policy.do(ctx, "Listing "+prefix, c.isRetryable, func() error {
+		var err error
+		objects, err = c.conn.ListObjectsAsFolders(ctx, prefix)
+		return err
+	})
+	return objects, err
+}
+
+func (c retryingConnection) ListObjectsAsAll(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	err := c.policy.do(ctx, "Listing "+prefix, c.isRetryable, func() error {
+		var err error
+		objects, err = c.conn.ListObjectsAsAll(ctx, prefix)
+		return err
+	})
+	return objects, err
+}
+
+func (c retryingConnection) Get(ctx context.Context, key string) (string, error) {
+	var cacheFilepath string
+	err := c.policy.do(ctx, "Downloading "+key, c.isRetryable, func() error {
+		var err error
+		cacheFilepath, err = c.conn.Get(ctx, key)
+		return err
+	})
+	return cacheFilepath, err
+}
+
+func (c retryingConnection) CachedGet(ctx context.Context, key string) (string, error) {
+	var cacheFilepath string
+	err := c.policy.do(ctx, "Downloading "+key, c.isRetryable, func() error {
+		var err error
+		cacheFilepath, err = c.conn.CachedGet(ctx, key)
+		return err
+	})
+	return cacheFilepath, err
+}
+
+func (c retryingRangeConnection) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error) {
+	var r io.ReadCloser
+	err := c.policy.do(ctx, "Downloading part of "+key, c.isRetryable, func() error {
+		var err error
+		r, err = c.rangeConn.GetRange(ctx, key, offset, length)
+		return err
+	})
+	return r, err
+}
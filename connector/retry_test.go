@@ -0,0 +1,194 @@
+/*
+arqinator: connector/retry_test.go
+Tests which errors are retried, and how often, against a connection that fails on demand.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package connector
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+/*
+Fails each call with the next of errs, then succeeds once they run out.
+*/
+type failingConnection struct {
+	mutex    sync.Mutex
+	errs     []error
+	attempts int
+}
+
+func (c *failingConnection) fail() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.attempts++
+	if len(c.errs) == 0 {
+		return nil
+	}
+	err := c.errs[0]
+	c.errs = c.errs[1:]
+	return err
+}
+
+func (c *failingConnection) getAttempts() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.attempts
+}
+
+func (c *failingConnection) String() string            { return "failing" }
+func (c *failingConnection) GetCacheDirectory() string { return "" }
+func (c *failingConnection) Close() error              { return nil }
+
+func (c *failingConnection) ListObjectsAsFolders(ctx context.Context, prefix string) ([]Object, error) {
+	return nil, c.fail()
+}
+
+func (c *failingConnection) ListObjectsAsAll(ctx context.Context, prefix string) ([]Object, error) {
+	return nil, c.fail()
+}
+
+func (c *failingConnection) Get(ctx context.Context, key string) (string, error) {
+	if err := c.fail(); err != nil {
+		return "", err
+	}
+	return "/cache/" + key, nil
+}
+
+func (c *failingConnection) CachedGet(ctx context.Context, key string) (string, error) {
+	return c.Get(ctx, key)
+}
+
+func (c *failingConnection) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error) {
+	if err := c.fail(); err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(strings.NewReader(key)), nil
+}
+
+func repeatError(err error, n int) []error {
+	errs := make([]error, n)
+	for i := range errs {
+		errs[i] = err
+	}
+	return errs
+}
+
+func newTestRetryPolicy() RetryPolicy {
+	return RetryPolicy{Attempts: 4, InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestRetryAttempts(t *testing.T) {
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+	tests := []struct {
+		name     string
+		errs     []error
+		attempts int
+		isErr    bool
+	}{
+		{"success", nil, 1, false},
+		{"connection reset then success", repeatError(reset, 2), 3, false},
+		{"timeouts then success", repeatError(&net.OpError{Op: "dial", Err: timeoutError{}}, 3), 4, false},
+		{"HTTP 503 until out of attempts", repeatError(&HTTPStatusError{StatusCode: http.StatusServiceUnavailable}, 10), 4, true},
+		{"unexpected EOF until out of attempts", repeatError(io.ErrUnexpectedEOF, 10), 4, true},
+	}
+	for _, test := range tests {
+		conn := &failingConnection{errs: test.errs}
+		retrying := NewRetryingConnection(conn, newTestRetryPolicy())
+		cacheFilepath, err := retrying.Get(context.Background(), "a")
+		if conn.getAttempts() != test.attempts {
+			t.Errorf("%s: expected %d attempts, got %d", test.name, test.attempts, conn.getAttempts())
+		}
+		if test.isErr && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		} else if !test.isErr && (err != nil || cacheFilepath != "/cache/a") {
+			t.Errorf("%s: expected /cache/a, got %s, %v", test.name, cacheFilepath, err)
+		}
+	}
+}
+
+func TestRetryNotRetryableErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{"unknown error", errors.New("unknown")},
+		{"HTTP 403", &HTTPStatusError{StatusCode: http.StatusForbidden}},
+		{"missing object", newObjectNotExistError("a")},
+		{"unknown host", &net.OpError{Op: "dial", Net: "tcp",
+			Err: &net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}}},
+		{"TLS alert", &net.OpError{Op: "remote error", Err: errors.New("tls: handshake failure")}},
+		{"cancelled", context.Canceled},
+	}
+	for _, test := range tests {
+		conn := &failingConnection{errs: repeatError(test.err, 10)}
+		retrying := NewRetryingConnection(conn, newTestRetryPolicy())
+		_, err := retrying.Get(context.Background(), "a")
+		if err != test.err {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+		if conn.getAttempts() != 1 {
+			t.Errorf("%s: expected 1 attempt, got %d", test.name, conn.getAttempts())
+		}
+	}
+
+	conn := &failingConnection{errs: repeatError(newObjectNotExistError("a"), 10)}
+	retrying := NewRetryingConnection(conn, newTestRetryPolicy()).(RangeConnection)
+	if _, err := retrying.GetRange(context.Background(), "a", 0, -1); !os.IsNotExist(err) {
+		t.Errorf("Expected GetRange of a missing key to fail with a not exist error, got %v", err)
+	}
+	if conn.getAttempts() != 1 {
+		t.Errorf("Expected GetRange of a missing key to be tried once, got %d attempts", conn.getAttempts())
+	}
+}
+
+func TestRetryCancelInterruptsBackoff(t *testing.T) {
+	conn := &failingConnection{errs: repeatError(io.ErrUnexpectedEOF, 10)}
+	policy := RetryPolicy{Attempts: 4, InitialBackoff: time.Hour, MaxBackoff: time.Hour}
+	retrying := NewRetryingConnection(conn, policy)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := retrying.ListObjectsAsAll(ctx, "a/")
+	if err != context.Canceled {
+		t.Errorf("Expected %v, got %v", context.Canceled, err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Expected cancelling to interrupt the backoff, took %s", elapsed)
+	}
+	if conn.getAttempts() != 1 {
+		t.Errorf("Expected 1 attempt, got %d", conn.getAttempts())
+	}
+}
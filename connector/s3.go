@@ -20,16 +20,22 @@ Copyright 2015 Asim Ihsan
 package connector
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
+	"net/http"
 	"os"
 	"path/filepath"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"strings"
+
+	"github.com/asimihsan/arqinator/progress"
 )
 
 type S3Connection struct {
@@ -65,6 +71,7 @@ func (c S3Connection) Close() error {
 
 type S3Object struct {
 	S3FullPath string
+	Size       int64
 }
 
 func (s3Obj S3Object) String() string {
@@ -75,19 +82,46 @@ func (s3Obj S3Object) GetPath() string {
 	return s3Obj.S3FullPath
 }
 
-func (conn S3Connection) ListObjectsAsFolders(prefix string) ([]Object, error) {
-	return conn.listObjects(prefix, "/")
+func (s3Obj S3Object) GetSize() int64 {
+	return s3Obj.Size
+}
+
+/*
+The SDK wraps network errors in an awserr.Error, which IsRetryableError can't see through, and reports
+throttling by error code.
+*/
+func (conn S3Connection) isRetryableError(err error) bool {
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) {
+		return false
+	}
+	switch awsErr.Code() {
+	case "RequestError", "RequestTimeout", "RequestTimeoutException", "SlowDown", "Throttling",
+		"ThrottlingException", "InternalError", "ServiceUnavailable":
+		return true
+	}
+	return awsErr.OrigErr() != nil && IsRetryableError(awsErr.OrigErr())
+}
+
+func (conn S3Connection) ListObjectsAsFolders(ctx context.Context, prefix string) ([]Object, error) {
+	return conn.listObjects(ctx, prefix, "/")
 }
 
-func (conn S3Connection) ListObjectsAsAll(prefix string) ([]Object, error) {
-	return conn.listObjects(prefix, ",")
+func (conn S3Connection) ListObjectsAsAll(ctx context.Context, prefix string) ([]Object, error) {
+	return conn.listObjects(ctx, prefix, ",")
 }
 
-func (conn S3Connection) listObjects(prefix string, delimiter string) ([]Object, error) {
+/*
+The SDK doesn't take a context, so cancellation is checked between pages.
+*/
+func (conn S3Connection) listObjects(ctx context.Context, prefix string, delimiter string) ([]Object, error) {
 	s3Objs := make([]Object, 0)
 	moreResults := false
 	nextMarker := aws.String("")
 	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		input := s3.ListObjectsInput{
 			Bucket:    aws.String(conn.BucketName),
 			Prefix:    aws.String(prefix),
@@ -113,6 +147,9 @@ func (conn S3Connection) listObjects(prefix string, delimiter string) ([]Object,
 				s3Obj := S3Object{
 					S3FullPath: *contents.Key,
 				}
+				if contents.Size != nil {
+					s3Obj.Size = *contents.Size
+				}
 				s3Objs = append(s3Objs, s3Obj)
 			}
 		}
@@ -138,58 +175,41 @@ func (conn S3Connection) getCacheFilepath(key string) (string, error) {
 	return cacheFilepath, nil
 }
 
-func (conn S3Connection) CachedGet(key string) (string, error) {
-	cacheFilepath, err := conn.getCacheFilepath(key)
-	if err != nil {
-		log.Debugf("Failed to getCacheFilepath in CachedGet: %s", err)
-		return "", err
-	}
-	fileInfo, err := os.Stat(cacheFilepath)
-	if err == nil && fileInfo.Size() != 0 {
-		// file exists, so if it's zero-byte then we don't need to retrieve it again
-		// however the file could still be corrupted. a connector cannot know if a file is corrupted or not,
-		// it's up to callers to verify that downloaded files are uncorrupted.
-		return cacheFilepath, nil
-	}
-	cacheFilepath, err = conn.Get(key)
-	if err != nil {
-		log.Debugln("Failed to cachedGet key: ", key)
-		return cacheFilepath, err
-	}
-	return cacheFilepath, nil
+func (conn S3Connection) CachedGet(ctx context.Context, key string) (string, error) {
+	return cachedGet(ctx, conn, key)
 }
 
-func (conn S3Connection) Get(key string) (string, error) {
+func (conn S3Connection) Get(ctx context.Context, key string) (string, error) {
 	cacheFilepath, err := conn.getCacheFilepath(key)
 	if err != nil {
 		log.Errorf("Failed to getCacheFilepath in Get: %s", err)
 		return cacheFilepath, err
 	}
-	cacheDirectory := filepath.Dir(cacheFilepath)
-	if err = os.MkdirAll(cacheDirectory, 0777); err != nil {
-		log.Errorf("Couldn't create cache directory %s for cacheFilepath %s: %s",
-			cacheDirectory, cacheFilepath, err)
-		return cacheFilepath, err
-	}
-	if _, err = os.Stat(cacheDirectory); err != nil {
-		log.Errorf("Cache directory %s doesn't exist!", cacheDirectory)
+	if err = ctx.Err(); err != nil {
 		return cacheFilepath, err
 	}
-	w, err := os.Create(cacheFilepath)
+	head, err := conn.Connection.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(conn.BucketName),
+		Key:    aws.String(key),
+	})
 	if err != nil {
-		log.Errorf("Couldn't create cache file for cacheFilepath %s: %s",
-			cacheFilepath, err)
+		log.Errorf("Failed to get size of key %s: %s", key, err)
+		var requestFailure awserr.RequestFailure
+		if errors.As(err, &requestFailure) && requestFailure.StatusCode() == http.StatusNotFound {
+			return cacheFilepath, newObjectNotExistError(key)
+		}
 		return cacheFilepath, err
 	}
-	defer w.Close()
-	_, err = conn.Downloader.Download(w, &s3.GetObjectInput{
-		Bucket: aws.String(conn.BucketName),
-		Key:    aws.String(key),
+	err = downloadToCache(ctx, cacheFilepath, aws.Int64Value(head.ContentLength), func(w *os.File) error {
+		_, err := conn.Downloader.Download(newContextWriterAt(ctx, progress.NewTransferWriterAt(w, progress.Current())), &s3.GetObjectInput{
+			Bucket: aws.String(conn.BucketName),
+			Key:    aws.String(key),
+		})
+		return err
 	})
 	time.Sleep(100 * time.Millisecond)
 	if err != nil {
 		log.Errorf("Failed to download key: %s", err)
-		defer os.Remove(cacheFilepath)
 		return cacheFilepath, err
 	}
 	return cacheFilepath, nil
@@ -28,13 +28,14 @@ package connector
 
 import (
 	"fmt"
-	"bufio"
-	"io"
+	"context"
+	"errors"
 	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -83,7 +84,8 @@ func DialSSHTimeout(network, addr string, config *ssh.ClientConfig, timeout time
 	client := ssh.NewClient(c, chans, reqs)
 
 	// this sends keepalive packets every 3 seconds
-	// there's no useful response from these, so we can just abort if there's an error
+	// there's no useful response from these, so if one fails the connection is closed, which fails calls
+	// in progress so that they can be retried on a new connection
 	go func() {
 		t := time.NewTicker(KEEPALIVE_INTERVAL)
 		defer t.Stop()
@@ -91,7 +93,8 @@ func DialSSHTimeout(network, addr string, config *ssh.ClientConfig, timeout time
 			<-t.C
 			_, _, err := client.Conn.SendRequest("keepalive@golang.org", true, nil)
 			if err != nil {
-				log.Fatalf("Remote server did not respond to keepalive.")
+				log.Debugf("Remote server did not respond to keepalive, closing connection: %s", err)
+				client.Close()
 				return
 			}
 		}
@@ -125,10 +128,84 @@ func KeyAuth(file string) (ssh.AuthMethod, error) {
 }
 
 type SFTPConnection struct {
-	SSHClient      *ssh.Client
-	SFTPClient     *sftp.Client
 	RemotePath     string
 	CacheDirectory string
+
+	// Shared by copies of the connection
+	session *sftpSession
+}
+
+/*
+The SSH session of a connection. If it drops, it's closed, and the next call dials a new one.
+*/
+type sftpSession struct {
+	mutex      sync.Mutex
+	addr       string
+	config     *ssh.ClientConfig
+	sshClient  *ssh.Client
+	sftpClient *sftp.Client
+}
+
+func (s *sftpSession) getClient() (*sftp.Client, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.sftpClient != nil {
+		return s.sftpClient, nil
+	}
+	log.Debugf("sftpSession connecting to %s", s.addr)
+	sshClient, err := DialSSHTimeout("tcp", s.addr, s.config, TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	sftpClient, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, err
+	}
+	s.sshClient = sshClient
+	s.sftpClient = sftpClient
+	return sftpClient, nil
+}
+
+/*
+Close the session if err means client's connection was lost, unless it's already been replaced.
+*/
+func (s *sftpSession) dropIfLost(client *sftp.Client, err error) {
+	if !IsRetryableError(err) && !isSFTPConnectionLost(err) {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.sftpClient != client {
+		return
+	}
+	log.Debugf("sftpSession dropping connection to %s: %s", s.addr, err)
+	s.closeLocked()
+}
+
+func (s *sftpSession) close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closeLocked()
+}
+
+func (s *sftpSession) closeLocked() error {
+	var err error
+	if s.sftpClient != nil {
+		err = s.sftpClient.Close()
+		s.sftpClient = nil
+	}
+	if s.sshClient != nil {
+		if closeErr := s.sshClient.Close(); err == nil {
+			err = closeErr
+		}
+		s.sshClient = nil
+	}
+	return err
+}
+
+func isSFTPConnectionLost(err error) bool {
+	return errors.Is(err, sftp.ErrSSHFxConnectionLost) || errors.Is(err, sftp.ErrSSHFxNoConnection)
 }
 
 func (c SFTPConnection) String() string {
@@ -136,13 +213,8 @@ func (c SFTPConnection) String() string {
 }
 
 func (c SFTPConnection) Close() error {
-	if c.SFTPClient != nil {
-		if err := c.SFTPClient.Close(); err != nil {
-			return err
-		}
-	}
-	if c.SSHClient != nil {
-		if err := c.SSHClient.Close(); err != nil {
+	if c.session != nil {
+		if err := c.session.close(); err != nil {
 			return err
 		}
 	}
@@ -150,8 +222,15 @@ func (c SFTPConnection) Close() error {
 	return nil
 }
 
+/*
+A dropped connection is reconnected by the next call, so retrying is worthwhile.
+*/
+func (c SFTPConnection) isRetryableError(err error) bool {
+	return isSFTPConnectionLost(err)
+}
+
 func NewSFTPConnection(host string, port int, remotePath string, username string, password *string,
-	privateKeyFilepath *string, cacheDirectory string) (*SFTPConnection, error) {
+	privateKeyFilepath *string, hostKeyVerifier SFTPHostKeyVerifier, cacheDirectory string) (*SFTPConnection, error) {
 	log.Debugf("NewSFTPConnection entry. host: %s, port: %d, remotePath: %s, username: %s, privateKeyFilepath: %s, cacheDirectory: %s",
 		host, port, remotePath, username, privateKeyFilepath, cacheDirectory)
 	var (
@@ -178,14 +257,18 @@ func NewSFTPConnection(host string, port int, remotePath string, username string
 		Auth: auths,
 	}
 	addr := fmt.Sprintf("%s:%d", host, port)
+	if err = hostKeyVerifier.configure(config, addr); err != nil {
+		return nil, err
+	}
 	conn := SFTPConnection{
 		RemotePath:     remotePath,
 		CacheDirectory: cacheDirectory,
+		session: &sftpSession{
+			addr:   addr,
+			config: config,
+		},
 	}
-	if conn.SSHClient, err = DialSSHTimeout("tcp", addr, config, TIMEOUT); err != nil {
-		return nil, err
-	}
-	if conn.SFTPClient, err = sftp.NewClient(conn.SSHClient); err != nil {
+	if _, err = conn.session.getClient(); err != nil {
 		return nil, err
 	}
 	return &conn, nil
@@ -202,65 +285,47 @@ func (conn SFTPConnection) getCacheFilepath(key string) (string, error) {
 	return cacheFilepath, nil
 }
 
-func (conn SFTPConnection) CachedGet(key string) (string, error) {
-	cacheFilepath, err := conn.getCacheFilepath(key)
-	if err != nil {
-		log.Debugf("Failed to getCacheFilepath in CachedGet: %s", err)
-		return "", err
-	}
-	log.Debugf("CachedGet key: %s, cacheFilepath: %s", key, cacheFilepath)
-	fileInfo, err := os.Stat(cacheFilepath)
-	if err == nil && fileInfo.Size() != 0 {
-		// file exists, so if it's zero-byte then we don't need to retrieve it again
-		// however the file could still be corrupted. a connector cannot know if a file is corrupted or not,
-		// it's up to callers to verify that downloaded files are uncorrupted.
-		return cacheFilepath, nil
-	}
-	cacheFilepath, err = conn.Get(key)
-	if err != nil {
-		log.Debugln("Failed to cachedGet key: ", key)
-		return cacheFilepath, err
-	}
-	return cacheFilepath, nil
+func (conn SFTPConnection) CachedGet(ctx context.Context, key string) (string, error) {
+	return cachedGet(ctx, conn, key)
 }
 
-func (conn SFTPConnection) Get(key string) (string, error) {
+/*
+pkg/sftp calls can't be cancelled, so a cancelled context stops the download between reads. Reads of
+an unresponsive server already time out.
+*/
+func (conn SFTPConnection) Get(ctx context.Context, key string) (string, error) {
 	cacheFilepath, err := conn.getCacheFilepath(key)
 	if err != nil {
 		log.Errorf("Failed to getCacheFilepath in Get: %s", err)
 		return cacheFilepath, err
 	}
-	cacheDirectory := filepath.Dir(cacheFilepath)
-	if err = os.MkdirAll(cacheDirectory, 0777); err != nil {
-		log.Errorf("Couldn't create cache directory %s for cacheFilepath %s: %s",
-			cacheDirectory, cacheFilepath, err)
-		return cacheFilepath, err
-	}
-	if _, err = os.Stat(cacheDirectory); err != nil {
-		log.Errorf("Cache directory %s doesn't exist!", cacheDirectory)
-		return cacheFilepath, err
-	}
-	w, err := os.Create(cacheFilepath)
+	client, err := conn.session.getClient()
 	if err != nil {
-		log.Errorf("Couldn't create cache file for cacheFilepath %s: %s",
-			cacheFilepath, err)
+		log.Errorf("Failed to connect to download key %s: %s", key, err)
 		return cacheFilepath, err
 	}
-	defer w.Close()
-	wBuffered := bufio.NewWriter(w)
-	defer wBuffered.Flush()
-	remoteFullpath := conn.SFTPClient.Join(conn.RemotePath, key)
-	r, err := conn.SFTPClient.Open(remoteFullpath)
-	if err != nil{
+	remoteFullpath := client.Join(conn.RemotePath, key)
+	r, err := client.Open(remoteFullpath)
+	if err != nil {
 		log.Errorf("Failed to open remote file %s: %s", remoteFullpath, err)
+		conn.session.dropIfLost(client, err)
 		return cacheFilepath, err
 	}
 	defer r.Close()
-	io.Copy(wBuffered, r)
+	fileInfo, err := r.Stat()
+	if err != nil {
+		log.Errorf("Failed to get size of remote file %s: %s", remoteFullpath, err)
+		conn.session.dropIfLost(client, err)
+		return cacheFilepath, err
+	}
+	err = writeCacheFile(ctx, cacheFilepath, r, fileInfo.Size())
 	time.Sleep(100 * time.Millisecond)
 	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		conn.session.dropIfLost(client, err)
 		log.Errorf("Failed to download key: %s", err)
-		defer os.Remove(cacheFilepath)
 		return cacheFilepath, err
 	}
 	return cacheFilepath, nil
@@ -272,6 +337,7 @@ func (c SFTPConnection) GetCacheDirectory() string {
 
 type SFTPObject struct {
 	Fullpath string
+	Size     int64
 }
 
 func (o SFTPObject) String() string {
@@ -282,28 +348,43 @@ func (o SFTPObject) GetPath() string {
 	return o.Fullpath
 }
 
-func (conn SFTPConnection) ListObjectsAsFolders(prefix string) ([]Object, error) {
-	return conn.listObjects(prefix)
+func (o SFTPObject) GetSize() int64 {
+	return o.Size
 }
 
-func (conn SFTPConnection) ListObjectsAsAll(prefix string) ([]Object, error) {
-	return conn.listObjects(prefix)
+func (conn SFTPConnection) ListObjectsAsFolders(ctx context.Context, prefix string) ([]Object, error) {
+	return conn.listObjects(ctx, prefix)
 }
 
-func (conn SFTPConnection) listObjects(key string) ([]Object, error) {
-	remoteFullpath := conn.SFTPClient.Join(conn.RemotePath, key)
-	files, err := conn.SFTPClient.ReadDir(remoteFullpath)
+func (conn SFTPConnection) ListObjectsAsAll(ctx context.Context, prefix string) ([]Object, error) {
+	return conn.listObjects(ctx, prefix)
+}
+
+func (conn SFTPConnection) listObjects(ctx context.Context, key string) ([]Object, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	client, err := conn.session.getClient()
 	if err != nil {
 		return nil, err
 	}
+	remoteFullpath := client.Join(conn.RemotePath, key)
+	files, err := client.ReadDir(remoteFullpath)
+	if err != nil {
+		conn.session.dropIfLost(client, err)
+		return nil, err
+	}
 	objects := make([]Object, len(files))
 	for i, file := range files {
-		fileFullpath := conn.SFTPClient.Join(remoteFullpath, file.Name())
+		fileFullpath := client.Join(remoteFullpath, file.Name())
 		fileFullpath = strings.TrimPrefix(fileFullpath, conn.RemotePath)
 		fileFullpath = strings.TrimPrefix(fileFullpath, "/")
 		object := SFTPObject{
 			Fullpath: fileFullpath,
 		}
+		if !file.IsDir() {
+			object.Size = file.Size()
+		}
 		objects[i] = object
 	}
 	return objects, nil
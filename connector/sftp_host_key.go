@@ -0,0 +1,229 @@
+/*
+arqinator: connector/sftp_host_key.go
+Verifies the host key of SFTP servers against known_hosts or a pinned fingerprint.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package connector
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	SHA256_FINGERPRINT_PREFIX = "SHA256:"
+	MD5_FINGERPRINT_PREFIX    = "MD5:"
+)
+
+/*
+How to decide whether to trust the key an SFTP server presents. If Fingerprint is set the server's key
+must have that fingerprint, as printed by `ssh-keygen -lf`, and KnownHostsFilepath is ignored. Otherwise
+the key must be in KnownHostsFilepath. If TrustOnFirstUse is set a host that isn't in KnownHostsFilepath
+yet is trusted and added to it, but a host whose key has changed is still refused.
+*/
+type SFTPHostKeyVerifier struct {
+	KnownHostsFilepath string
+	Fingerprint        string
+	TrustOnFirstUse    bool
+}
+
+/*
+Set the host key callback of config, and restrict the host key algorithms it negotiates for addr to the
+types of key known_hosts already has, so that a server with several keys isn't refused for presenting a
+different one.
+*/
+func (v SFTPHostKeyVerifier) configure(config *ssh.ClientConfig, addr string) error {
+	if v.Fingerprint != "" {
+		fingerprint, err := normalizeFingerprint(v.Fingerprint)
+		if err != nil {
+			return err
+		}
+		config.HostKeyCallback = pinnedHostKeyCallback(fingerprint)
+		return nil
+	}
+	if v.KnownHostsFilepath == "" {
+		return errors.New("SFTP host key can't be verified without a known_hosts file or a host key fingerprint")
+	}
+	if _, err := os.Stat(v.KnownHostsFilepath); os.IsNotExist(err) && v.TrustOnFirstUse {
+		log.Debugf("SFTPHostKeyVerifier known_hosts %s doesn't exist, creating it", v.KnownHostsFilepath)
+		if err := appendKnownHost(v.KnownHostsFilepath, ""); err != nil {
+			return err
+		}
+	}
+	callback, err := knownhosts.New(v.KnownHostsFilepath)
+	if err != nil {
+		log.Debugf("SFTPHostKeyVerifier failed to read known_hosts %s: %s", v.KnownHostsFilepath, err)
+		if os.IsNotExist(err) {
+			return errors.New(fmt.Sprintf("known_hosts file %s doesn't exist. Connect to the server once with "+
+				"ssh, pass --sftp-host-key-fingerprint, or pass --sftp-trust-on-first-use", v.KnownHostsFilepath))
+		}
+		return err
+	}
+	config.HostKeyAlgorithms = knownHostKeyAlgorithms(callback, addr)
+	config.HostKeyCallback = v.knownHostsCallback(callback)
+	return nil
+}
+
+func (v SFTPHostKeyVerifier) knownHostsCallback(callback ssh.HostKeyCallback) ssh.HostKeyCallback {
+	var mutex sync.Mutex
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		err := callback(hostname, remote, key)
+		if err == nil {
+			return nil
+		}
+		fingerprint := ssh.FingerprintSHA256(key)
+		var revokedError *knownhosts.RevokedError
+		if errors.As(err, &revokedError) {
+			return errors.New(fmt.Sprintf("SFTP host key %s %s of %s is revoked in %s",
+				key.Type(), fingerprint, hostname, v.KnownHostsFilepath))
+		}
+		var keyError *knownhosts.KeyError
+		if !errors.As(err, &keyError) {
+			return err
+		}
+		if len(keyError.Want) > 0 {
+			want := keyError.Want[0]
+			return errors.New(fmt.Sprintf("SFTP host key mismatch for %s: server presented %s %s but %s:%d "+
+				"expects %s %s. The server may have been reinstalled, or someone may be intercepting the "+
+				"connection. If the new key is expected remove the old one with `ssh-keygen -R '%s' -f %s`",
+				hostname, key.Type(), fingerprint, want.Filename, want.Line, want.Key.Type(),
+				ssh.FingerprintSHA256(want.Key), knownhosts.Normalize(hostname), v.KnownHostsFilepath))
+		}
+		if !v.TrustOnFirstUse {
+			return errors.New(fmt.Sprintf("SFTP host %s is not in %s, it presented %s %s. Verify the "+
+				"fingerprint with the server's administrator, then connect once with ssh, pass "+
+				"--sftp-host-key-fingerprint %s, or pass --sftp-trust-on-first-use",
+				hostname, v.KnownHostsFilepath, key.Type(), fingerprint, fingerprint))
+		}
+		log.Warnf("Trusting previously unknown SFTP host %s with %s key %s, adding it to %s",
+			hostname, key.Type(), fingerprint, v.KnownHostsFilepath)
+		line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)
+		if err := appendKnownHost(v.KnownHostsFilepath, line); err != nil {
+			return err
+		}
+		// Reload so reconnecting later checks against the key that was just trusted.
+		if reloaded, err := knownhosts.New(v.KnownHostsFilepath); err == nil {
+			callback = reloaded
+		}
+		return nil
+	}
+}
+
+func pinnedHostKeyCallback(fingerprint string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		var presented string
+		if strings.HasPrefix(fingerprint, MD5_FINGERPRINT_PREFIX) {
+			presented = MD5_FINGERPRINT_PREFIX + ssh.FingerprintLegacyMD5(key)
+		} else {
+			presented = ssh.FingerprintSHA256(key)
+		}
+		if presented != fingerprint {
+			return errors.New(fmt.Sprintf("SFTP host key mismatch for %s: server presented %s %s but "+
+				"--sftp-host-key-fingerprint is %s", hostname, key.Type(), presented, fingerprint))
+		}
+		return nil
+	}
+}
+
+/*
+Accept fingerprints as printed by `ssh-keygen -lf`, i.e. "SHA256:<base64>" or "MD5:<hex>", as well as bare
+colon separated MD5 hex.
+*/
+func normalizeFingerprint(fingerprint string) (string, error) {
+	fingerprint = strings.TrimSpace(fingerprint)
+	if strings.HasPrefix(fingerprint, SHA256_FINGERPRINT_PREFIX) {
+		return fingerprint, nil
+	}
+	if strings.HasPrefix(fingerprint, MD5_FINGERPRINT_PREFIX) {
+		return MD5_FINGERPRINT_PREFIX + strings.ToLower(strings.TrimPrefix(fingerprint, MD5_FINGERPRINT_PREFIX)), nil
+	}
+	if strings.Count(fingerprint, ":") == 15 {
+		return MD5_FINGERPRINT_PREFIX + strings.ToLower(fingerprint), nil
+	}
+	return "", errors.New(fmt.Sprintf("Invalid SFTP host key fingerprint %s, expected e.g. SHA256:... as printed "+
+		"by ssh-keygen -lf", fingerprint))
+}
+
+/*
+Ask callback about a key no host can have, so the error lists the keys known_hosts has for addr. Returns
+nil, i.e. the default algorithms, if the host is unknown.
+*/
+func knownHostKeyAlgorithms(callback ssh.HostKeyCallback, addr string) []string {
+	probe, err := ssh.NewPublicKey(ed25519.PublicKey(make([]byte, ed25519.PublicKeySize)))
+	if err != nil {
+		return nil
+	}
+	var keyError *knownhosts.KeyError
+	if err := callback(addr, &net.TCPAddr{}, probe); !errors.As(err, &keyError) {
+		return nil
+	}
+	var algorithms []string
+	seen := make(map[string]bool)
+	for _, known := range keyError.Want {
+		for _, algorithm := range hostKeyAlgorithmsFor(known.Key.Type()) {
+			if !seen[algorithm] {
+				seen[algorithm] = true
+				algorithms = append(algorithms, algorithm)
+			}
+		}
+	}
+	log.Debugf("knownHostKeyAlgorithms for %s: %v", addr, algorithms)
+	return algorithms
+}
+
+func hostKeyAlgorithmsFor(keyType string) []string {
+	switch keyType {
+	case ssh.KeyAlgoRSA:
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	case ssh.CertAlgoRSAv01:
+		return []string{ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01, ssh.CertAlgoRSAv01}
+	}
+	return []string{keyType}
+}
+
+func appendKnownHost(knownHostsFilepath string, line string) error {
+	if err := os.MkdirAll(filepath.Dir(knownHostsFilepath), 0700); err != nil {
+		log.Debugf("appendKnownHost failed to create directory for %s: %s", knownHostsFilepath, err)
+		return err
+	}
+	f, err := os.OpenFile(knownHostsFilepath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Debugf("appendKnownHost failed to open %s: %s", knownHostsFilepath, err)
+		return err
+	}
+	defer f.Close()
+	if line == "" {
+		return nil
+	}
+	if _, err := f.WriteString(line + "\n"); err != nil {
+		log.Debugf("appendKnownHost failed to write to %s: %s", knownHostsFilepath, err)
+		return err
+	}
+	return f.Sync()
+}
@@ -0,0 +1,437 @@
+/*
+arqinator: connector/webdav.go
+Implements WebDAV backup type for Arq, e.g. Nextcloud or ownCloud.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+/*
+References:
+-	https://tools.ietf.org/html/rfc4918#section-9.1
+-	https://tools.ietf.org/html/rfc7616
+-	https://docs.nextcloud.com/server/latest/user_manual/en/files/access_webdav.html
+*/
+
+package connector
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	WEBDAV_PROPFIND_BODY = `<?xml version="1.0" encoding="utf-8"?>` +
+		`<d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/><d:getcontentlength/></d:prop></d:propfind>`
+	WEBDAV_AUTH_BASIC  = "Basic"
+	WEBDAV_AUTH_DIGEST = "Digest"
+)
+
+/*
+The authentication scheme the server asked for, and for digest the latest challenge. Shared between
+copies of a WebDAVConnection so that we only need to be challenged once.
+*/
+type webdavAuth struct {
+	mutex      sync.Mutex
+	scheme     string
+	challenge  map[string]string
+	nonceCount uint32
+}
+
+type WebDAVConnection struct {
+	HTTPClient     *http.Client
+	BaseURL        *url.URL
+	Username       string
+	Password       string
+	CacheDirectory string
+	auth           *webdavAuth
+}
+
+func (c WebDAVConnection) String() string {
+	return fmt.Sprintf("{WebDAVConnection: BaseURL=%s, CacheDirectory=%s}",
+		c.BaseURL, c.CacheDirectory)
+}
+
+/*
+rawURL is the folder Arq backs up into, e.g. https://cloud.example.com/remote.php/dav/files/alice/Arq.
+Basic or digest authentication is used depending on what the server asks for.
+*/
+func NewWebDAVConnection(rawURL string, username string, password string, insecureSkipVerify bool,
+	caBundleFilepath string, cacheDirectory string) (*WebDAVConnection, error) {
+	baseURL, err := url.Parse(rawURL)
+	if err != nil {
+		log.Debugf("NewWebDAVConnection failed to parse URL %s: %s", rawURL, err)
+		return nil, err
+	}
+	if baseURL.Scheme != "http" && baseURL.Scheme != "https" {
+		return nil, errors.New(fmt.Sprintf("WebDAV URL %s must be http or https", rawURL))
+	}
+	if !strings.HasSuffix(baseURL.Path, "/") {
+		baseURL.Path += "/"
+	}
+	conn := WebDAVConnection{
+		HTTPClient:     http.DefaultClient,
+		BaseURL:        baseURL,
+		Username:       username,
+		Password:       password,
+		CacheDirectory: cacheDirectory,
+		auth:           &webdavAuth{},
+	}
+	if insecureSkipVerify || caBundleFilepath != "" {
+		if conn.HTTPClient, err = NewHTTPClient(insecureSkipVerify, caBundleFilepath); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := conn.propfind(context.Background(), "", "0"); err != nil {
+		log.Debugf("NewWebDAVConnection failed to PROPFIND %s: %s", baseURL, err)
+		return nil, err
+	}
+	return &conn, nil
+}
+
+func (c WebDAVConnection) GetCacheDirectory() string {
+	return c.CacheDirectory
+}
+
+func (c WebDAVConnection) Close() error {
+	return nil
+}
+
+type WebDAVObject struct {
+	Fullpath string
+	Size     int64
+}
+
+func (o WebDAVObject) String() string {
+	return fmt.Sprintf("{WebDAVObject: Fullpath=%s}", o.Fullpath)
+}
+
+func (o WebDAVObject) GetPath() string {
+	return o.Fullpath
+}
+
+func (o WebDAVObject) GetSize() int64 {
+	return o.Size
+}
+
+type webdavMultistatus struct {
+	Responses []struct {
+		Href      string `xml:"DAV: href"`
+		Propstats []struct {
+			Status string `xml:"DAV: status"`
+			Prop   struct {
+				Collection    *struct{} `xml:"DAV: resourcetype>collection"`
+				ContentLength int64     `xml:"DAV: getcontentlength"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+func (conn WebDAVConnection) getURL(key string, isDirectory bool) *url.URL {
+	u := *conn.BaseURL
+	u.Path = path.Join(conn.BaseURL.Path, key)
+	if isDirectory && !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return &u
+}
+
+func parseDigestChallenge(header string) map[string]string {
+	challenge := make(map[string]string)
+	for _, part := range splitChallenge(strings.TrimSpace(header[len(WEBDAV_AUTH_DIGEST):])) {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		challenge[strings.ToLower(kv[0])] = strings.Trim(kv[1], `"`)
+	}
+	return challenge
+}
+
+/*
+Split on commas that aren't inside quotes, e.g. qop="auth,auth-int".
+*/
+func splitChallenge(s string) []string {
+	parts := make([]string, 0)
+	inQuotes := false
+	start := 0
+	for i, c := range s {
+		switch {
+		case c == '"':
+			inQuotes = !inQuotes
+		case c == ',' && !inQuotes:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+/*
+Remember the strongest scheme offered in a 401 response. Returns false if there's nothing we can use.
+*/
+func (conn WebDAVConnection) handleChallenge(resp *http.Response) bool {
+	conn.auth.mutex.Lock()
+	defer conn.auth.mutex.Unlock()
+	for _, header := range resp.Header["Www-Authenticate"] {
+		if strings.HasPrefix(strings.ToLower(header), strings.ToLower(WEBDAV_AUTH_DIGEST)+" ") {
+			conn.auth.scheme = WEBDAV_AUTH_DIGEST
+			conn.auth.challenge = parseDigestChallenge(header)
+			conn.auth.nonceCount = 0
+			return true
+		}
+	}
+	for _, header := range resp.Header["Www-Authenticate"] {
+		if strings.HasPrefix(strings.ToLower(header), strings.ToLower(WEBDAV_AUTH_BASIC)) {
+			conn.auth.scheme = WEBDAV_AUTH_BASIC
+			return true
+		}
+	}
+	return false
+}
+
+func (conn WebDAVConnection) authorize(req *http.Request) error {
+	conn.auth.mutex.Lock()
+	defer conn.auth.mutex.Unlock()
+	switch conn.auth.scheme {
+	case WEBDAV_AUTH_BASIC:
+		req.SetBasicAuth(conn.Username, conn.Password)
+	case WEBDAV_AUTH_DIGEST:
+		challenge := conn.auth.challenge
+		var newHash func() hash.Hash
+		switch strings.ToUpper(challenge["algorithm"]) {
+		case "", "MD5", "MD5-SESS":
+			newHash = md5.New
+		case "SHA-256", "SHA-256-SESS":
+			newHash = sha256.New
+		default:
+			return errors.New(fmt.Sprintf("Unsupported WebDAV digest algorithm %s", challenge["algorithm"]))
+		}
+		h := func(s string) string {
+			hasher := newHash()
+			io.WriteString(hasher, s)
+			return hex.EncodeToString(hasher.Sum(nil))
+		}
+		cnonceBytes := make([]byte, 16)
+		if _, err := rand.Read(cnonceBytes); err != nil {
+			return err
+		}
+		cnonce := hex.EncodeToString(cnonceBytes)
+		conn.auth.nonceCount++
+		nc := fmt.Sprintf("%08x", conn.auth.nonceCount)
+		uri := req.URL.RequestURI()
+
+		ha1 := h(fmt.Sprintf("%s:%s:%s", conn.Username, challenge["realm"], conn.Password))
+		if strings.HasSuffix(strings.ToUpper(challenge["algorithm"]), "-SESS") {
+			ha1 = h(fmt.Sprintf("%s:%s:%s", ha1, challenge["nonce"], cnonce))
+		}
+		ha2 := h(fmt.Sprintf("%s:%s", req.Method, uri))
+		qop := ""
+		for _, offered := range strings.Split(challenge["qop"], ",") {
+			if strings.TrimSpace(offered) == "auth" {
+				qop = "auth"
+			}
+		}
+		var response string
+		if qop == "" {
+			response = h(fmt.Sprintf("%s:%s:%s", ha1, challenge["nonce"], ha2))
+		} else {
+			response = h(fmt.Sprintf("%s:%s:%s:%s:%s:%s", ha1, challenge["nonce"], nc, cnonce, qop, ha2))
+		}
+
+		fields := []string{
+			fmt.Sprintf(`username="%s"`, conn.Username),
+			fmt.Sprintf(`realm="%s"`, challenge["realm"]),
+			fmt.Sprintf(`nonce="%s"`, challenge["nonce"]),
+			fmt.Sprintf(`uri="%s"`, uri),
+			fmt.Sprintf(`response="%s"`, response),
+		}
+		if challenge["algorithm"] != "" {
+			fields = append(fields, fmt.Sprintf("algorithm=%s", challenge["algorithm"]))
+		}
+		if challenge["opaque"] != "" {
+			fields = append(fields, fmt.Sprintf(`opaque="%s"`, challenge["opaque"]))
+		}
+		if qop != "" {
+			fields = append(fields, fmt.Sprintf("qop=%s", qop), fmt.Sprintf("nc=%s", nc),
+				fmt.Sprintf(`cnonce="%s"`, cnonce))
+		}
+		req.Header.Set("Authorization", WEBDAV_AUTH_DIGEST+" "+strings.Join(fields, ", "))
+	}
+	return nil
+}
+
+/*
+Send a request, answering an authentication challenge if there is one. newRequest is called again for
+the retry because a request body can only be read once.
+*/
+func (conn WebDAVConnection) do(newRequest func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		if err := conn.authorize(req); err != nil {
+			return nil, err
+		}
+		resp, err := conn.HTTPClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 && conn.Username != "" &&
+			conn.handleChallenge(resp) {
+			log.Debugf("WebDAVConnection %s %s needs authentication, retrying", req.Method, req.URL)
+			resp.Body.Close()
+			continue
+		}
+		return resp, nil
+	}
+}
+
+func (conn WebDAVConnection) propfind(ctx context.Context, key string, depth string) (*webdavMultistatus, error) {
+	u := conn.getURL(key, true)
+	resp, err := conn.do(func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "PROPFIND", u.String(), strings.NewReader(WEBDAV_PROPFIND_BODY))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Depth", depth)
+		req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+		return req, nil
+	})
+	if err != nil {
+		log.Debugf("WebDAVConnection PROPFIND %s failed: %s", u, err)
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, newHTTPStatusError(resp)
+	}
+	defer resp.Body.Close()
+	var multistatus webdavMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&multistatus); err != nil {
+		log.Debugf("WebDAVConnection failed to parse PROPFIND %s response: %s", u, err)
+		return nil, err
+	}
+	return &multistatus, nil
+}
+
+func (conn WebDAVConnection) ListObjectsAsFolders(ctx context.Context, prefix string) ([]Object, error) {
+	return conn.listObjects(ctx, prefix)
+}
+
+func (conn WebDAVConnection) ListObjectsAsAll(ctx context.Context, prefix string) ([]Object, error) {
+	return conn.listObjects(ctx, prefix)
+}
+
+/*
+Like SFTP, list the immediate children of the directory key.
+*/
+func (conn WebDAVConnection) listObjects(ctx context.Context, key string) ([]Object, error) {
+	multistatus, err := conn.propfind(ctx, key, "1")
+	if err != nil {
+		return nil, err
+	}
+	directoryPath := strings.TrimSuffix(conn.getURL(key, true).Path, "/")
+	objects := make([]Object, 0, len(multistatus.Responses))
+	for _, response := range multistatus.Responses {
+		href, err := url.Parse(response.Href)
+		if err != nil {
+			log.Debugf("WebDAVConnection skipping unparseable href %s: %s", response.Href, err)
+			continue
+		}
+		hrefPath := strings.TrimSuffix(href.Path, "/")
+		if hrefPath == directoryPath {
+			continue
+		}
+		object := WebDAVObject{
+			Fullpath: strings.TrimPrefix(path.Join(key, path.Base(hrefPath)), "/"),
+		}
+		for _, propstat := range response.Propstats {
+			if !strings.Contains(propstat.Status, " 200 ") {
+				continue
+			}
+			if propstat.Prop.Collection == nil {
+				object.Size = propstat.Prop.ContentLength
+			}
+		}
+		objects = append(objects, object)
+	}
+	return objects, nil
+}
+
+func (conn WebDAVConnection) CachedGet(ctx context.Context, key string) (string, error) {
+	return cachedGet(ctx, conn, key)
+}
+
+func (conn WebDAVConnection) Get(ctx context.Context, key string) (string, error) {
+	cacheFilepath, err := cacheFilepathFor(conn.GetCacheDirectory(), key)
+	if err != nil {
+		log.Errorf("Failed to getCacheFilepath in Get: %s", err)
+		return cacheFilepath, err
+	}
+	r, err := conn.GetRange(ctx, key, 0, -1)
+	if err != nil {
+		log.Errorf("Failed to download key %s: %s", key, err)
+		return cacheFilepath, err
+	}
+	defer r.Close()
+	if err = writeCacheFile(ctx, cacheFilepath, r, readerSize(r)); err != nil {
+		log.Errorf("Failed to download key %s: %s", key, err)
+		return cacheFilepath, err
+	}
+	return cacheFilepath, nil
+}
+
+/*
+Download part of a file. Callers must close the returned reader.
+*/
+func (conn WebDAVConnection) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error) {
+	u := conn.getURL(key, false)
+	resp, err := conn.do(func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		if offset != 0 || length >= 0 {
+			req.Header.Set("Range", formatRange(offset, length))
+		}
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, newObjectNotExistError(key)
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return nil, newHTTPStatusError(resp)
+	}
+	return getRangeBody(resp, offset, length)
+}
@@ -0,0 +1,218 @@
+/*
+arqinator: connector/webdav_test.go
+Tests the WebDAV backup type against a local Go WebDAV server using basic and digest authentication.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package connector
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/webdav"
+)
+
+const (
+	WEBDAV_TEST_USERNAME = "alice"
+	WEBDAV_TEST_PASSWORD = "secret"
+	WEBDAV_TEST_REALM    = "arqinator"
+	WEBDAV_TEST_NONCE    = "dcd98b7102dd2f0e8b11d0f600bfb0c093"
+	WEBDAV_TEST_PREFIX   = "/remote.php/dav/files/alice"
+)
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+Check a digest Authorization header against RFC 7616 with MD5 and qop=auth.
+*/
+func isValidDigest(r *http.Request) bool {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, WEBDAV_AUTH_DIGEST+" ") {
+		return false
+	}
+	fields := parseDigestChallenge(header)
+	if fields["username"] != WEBDAV_TEST_USERNAME || fields["realm"] != WEBDAV_TEST_REALM ||
+		fields["nonce"] != WEBDAV_TEST_NONCE || fields["uri"] != r.URL.RequestURI() || fields["qop"] != "auth" {
+		return false
+	}
+	ha1 := md5Hex(WEBDAV_TEST_USERNAME + ":" + WEBDAV_TEST_REALM + ":" + WEBDAV_TEST_PASSWORD)
+	ha2 := md5Hex(r.Method + ":" + fields["uri"])
+	expected := md5Hex(strings.Join([]string{ha1, WEBDAV_TEST_NONCE, fields["nc"], fields["cnonce"], "auth", ha2}, ":"))
+	return fields["response"] == expected
+}
+
+/*
+Serve an in-memory WebDAV folder holding a small backup, behind basic or digest authentication.
+*/
+func newTestWebDAVServer(t *testing.T, scheme string) *httptest.Server {
+	fs := webdav.NewMemFS()
+	files := map[string]string{
+		"/Arq/backup/a.pack":          "contents of a",
+		"/Arq/backup/c d.pack":        "0123456789",
+		"/Arq/backup/objects/e":       "contents of e",
+		"/Arq/backup/treepacks/f/g.p": "contents of g",
+	}
+	ctx := context.Background()
+	for name, contents := range files {
+		dir := ""
+		for _, part := range strings.Split(path.Dir(name), "/")[1:] {
+			dir += "/" + part
+			if err := fs.Mkdir(ctx, dir, 0755); err != nil && !os.IsExist(err) {
+				t.Fatalf("Mkdir %s failed: %s", dir, err)
+			}
+		}
+		f, err := fs.OpenFile(ctx, name, os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatalf("OpenFile %s failed: %s", name, err)
+		}
+		f.Write([]byte(contents))
+		f.Close()
+	}
+	handler := &webdav.Handler{
+		Prefix:     WEBDAV_TEST_PREFIX,
+		FileSystem: fs,
+		LockSystem: webdav.NewMemLS(),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch scheme {
+		case WEBDAV_AUTH_BASIC:
+			if username, password, ok := r.BasicAuth(); !ok || username != WEBDAV_TEST_USERNAME ||
+				password != WEBDAV_TEST_PASSWORD {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, WEBDAV_TEST_REALM))
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		case WEBDAV_AUTH_DIGEST:
+			if !isValidDigest(r) {
+				w.Header().Add("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, WEBDAV_TEST_REALM))
+				w.Header().Add("WWW-Authenticate", fmt.Sprintf(`Digest realm="%s", qop="auth,auth-int", `+
+					`nonce="%s", opaque="5ccc069c403ebaf9f0171e9517f40e41"`, WEBDAV_TEST_REALM, WEBDAV_TEST_NONCE))
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestWebDAVListObjects(t *testing.T) {
+	server := newTestWebDAVServer(t, WEBDAV_AUTH_BASIC)
+	conn, err := NewWebDAVConnection(server.URL+WEBDAV_TEST_PREFIX+"/Arq", WEBDAV_TEST_USERNAME,
+		WEBDAV_TEST_PASSWORD, false, "", t.TempDir())
+	if err != nil {
+		t.Fatalf("NewWebDAVConnection failed: %s", err)
+	}
+	objects, err := conn.ListObjectsAsAll(context.Background(), "backup")
+	if err != nil {
+		t.Fatalf("ListObjectsAsAll failed: %s", err)
+	}
+	sizes := make(map[string]int64)
+	var paths []string
+	for _, object := range objects {
+		paths = append(paths, object.GetPath())
+		sizes[object.GetPath()] = object.GetSize()
+	}
+	sort.Strings(paths)
+	expected := "backup/a.pack,backup/c d.pack,backup/objects,backup/treepacks"
+	if strings.Join(paths, ",") != expected {
+		t.Errorf("Expected %s, got %s", expected, strings.Join(paths, ","))
+	}
+	if sizes["backup/c d.pack"] != 10 || sizes["backup/objects"] != 0 {
+		t.Errorf("Unexpected sizes %v", sizes)
+	}
+
+	objects, err = conn.ListObjectsAsFolders(context.Background(), "backup/treepacks/f")
+	if err != nil {
+		t.Fatalf("ListObjectsAsFolders failed: %s", err)
+	}
+	if len(objects) != 1 || objects[0].GetPath() != "backup/treepacks/f/g.p" {
+		t.Errorf("Expected backup/treepacks/f/g.p, got %v", objects)
+	}
+}
+
+func TestWebDAVGetRange(t *testing.T) {
+	for _, scheme := range []string{WEBDAV_AUTH_BASIC, WEBDAV_AUTH_DIGEST} {
+		server := newTestWebDAVServer(t, scheme)
+		conn, err := NewWebDAVConnection(server.URL+WEBDAV_TEST_PREFIX+"/Arq/", WEBDAV_TEST_USERNAME,
+			WEBDAV_TEST_PASSWORD, false, "", t.TempDir())
+		if err != nil {
+			t.Fatalf("NewWebDAVConnection with %s authentication failed: %s", scheme, err)
+		}
+		if conn.auth.scheme != scheme {
+			t.Errorf("Expected %s authentication, got %s", scheme, conn.auth.scheme)
+		}
+		tests := []struct {
+			offset   int64
+			length   int64
+			expected string
+		}{
+			{0, -1, "0123456789"},
+			{3, 4, "3456"},
+			{7, -1, "789"},
+		}
+		for _, test := range tests {
+			r, err := conn.GetRange(context.Background(), "backup/c d.pack", test.offset, test.length)
+			if err != nil {
+				t.Fatalf("%s GetRange(%d, %d) failed: %s", scheme, test.offset, test.length, err)
+			}
+			contents, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil || string(contents) != test.expected {
+				t.Errorf("%s GetRange(%d, %d) expected %s, got %s, %v", scheme, test.offset, test.length,
+					test.expected, contents, err)
+			}
+		}
+
+		cacheFilepath, err := conn.CachedGet(context.Background(), "backup/objects/e")
+		if err != nil {
+			t.Fatalf("%s CachedGet failed: %s", scheme, err)
+		}
+		if contents, _ := ioutil.ReadFile(cacheFilepath); string(contents) != "contents of e" {
+			t.Errorf("%s unexpected cached contents %s", scheme, contents)
+		}
+
+		if _, err := conn.CachedGet(context.Background(), "backup/missing"); !os.IsNotExist(err) {
+			t.Errorf("%s expected CachedGet of a missing key to fail with a not exist error, got %v", scheme, err)
+		}
+	}
+}
+
+func TestWebDAVWrongPassword(t *testing.T) {
+	for _, scheme := range []string{WEBDAV_AUTH_BASIC, WEBDAV_AUTH_DIGEST} {
+		server := newTestWebDAVServer(t, scheme)
+		_, err := NewWebDAVConnection(server.URL+WEBDAV_TEST_PREFIX+"/Arq", WEBDAV_TEST_USERNAME, "wrong",
+			false, "", t.TempDir())
+		if statusErr, ok := err.(*HTTPStatusError); !ok || statusErr.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Expected %s authentication with the wrong password to fail with HTTP 401, got %v", scheme, err)
+		}
+	}
+}
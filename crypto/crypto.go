@@ -72,24 +72,23 @@ func (s *CryptoState) Decrypt(data []byte) ([]byte, error) {
 	dec.CryptBlocks(data, data)
 	//log.Debugf("% x\n", data)
 	//log.Debugf("%s\n", data)
+	return unpad(data)
+}
 
-	// unpad
-	{
-		n := len(data)
-		p := int(data[n-1])
-		if p == 0 || p > aes.BlockSize {
-			err := errors.New("Decrypt impossible padding, bad password?")
+func unpad(data []byte) ([]byte, error) {
+	n := len(data)
+	p := int(data[n-1])
+	if p == 0 || p > aes.BlockSize {
+		err := &WrongPasswordError{"Decrypt impossible padding"}
+		return nil, err
+	}
+	for i := 0; i < p; i++ {
+		if data[n-1-i] != byte(p) {
+			err := &WrongPasswordError{"Decrypt bad padding"}
 			return nil, err
 		}
-		for i := 0; i < p; i++ {
-			if data[n-1-i] != byte(p) {
-				err := errors.New("Decrypt bad padding, bad password?")
-				return nil, err
-			}
-		}
-		data = data[:n-p]
 	}
-	return data, nil
+	return data[:n-p], nil
 }
 
 func bytesToKey(hf func() hash.Hash, salt, data []byte, iter int, keySize,
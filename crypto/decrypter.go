@@ -0,0 +1,68 @@
+/*
+arqinator: crypto/decrypter.go
+Implements choosing between Arq encryption schemes on a per-object basis.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package crypto
+
+import (
+	"bytes"
+	"errors"
+)
+
+/*
+A password check failed. Arq 4 has no password check as such, so bad padding on the first object
+decrypted is reported this way too.
+*/
+type WrongPasswordError struct {
+	Reason string
+}
+
+func (e *WrongPasswordError) Error() string {
+	return e.Reason + ", bad password?"
+}
+
+func IsWrongPassword(err error) bool {
+	_, ok := err.(*WrongPasswordError)
+	return ok
+}
+
+type Decrypter interface {
+	Decrypt(data []byte) ([]byte, error)
+}
+
+/*
+Arq 5 backup sets that were upgraded from Arq 4 contain both "encrypted" objects, using the password
+and salt file, and ARQO objects, using the encryptionv3.dat master keys. Either field may be nil.
+*/
+type VersionedDecrypter struct {
+	Legacy *CryptoState
+	V3     *EncryptionV3
+}
+
+func (d VersionedDecrypter) Decrypt(data []byte) ([]byte, error) {
+	if bytes.HasPrefix(data, []byte(ARQO_HEADER)) {
+		if d.V3 == nil {
+			return nil, errors.New("Decrypt ARQO object but backup set has no master keys")
+		}
+		return d.V3.Decrypt(data)
+	}
+	if d.Legacy == nil {
+		return nil, errors.New("Decrypt object isn't ARQO but backup set has no salt file")
+	}
+	return d.Legacy.Decrypt(data)
+}
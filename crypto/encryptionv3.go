@@ -0,0 +1,165 @@
+/*
+arqinator: crypto/encryptionv3.go
+Implements the Arq 5 encryptionv3.dat master keys and HMAC-verified ARQO objects.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+/*
+References:
+-	https://www.arqbackup.com/arq_data_format.txt
+-	https://github.com/arqbackup/arq_restore/blob/master/cocoastack/crypto/EncryptionDatFile.m
+
+encryptionv3.dat:
+
+	header "ENCRYPTIONV2"          [12 bytes]
+	salt                           [8 bytes]
+	HMAC-SHA256                    [32 bytes]
+	IV                             [16 bytes]
+	AES-256-CBC encrypted master keys
+
+The password and salt are stretched with PBKDF2-SHA1 into a 32-byte AES key and a 32-byte HMAC key. The
+HMAC covers the IV and the encrypted master keys. There are three 32-byte master keys: an AES key, an
+HMAC key, and a salt for blob SHA1s.
+
+ARQO object:
+
+	header "ARQO"                  [4 bytes]
+	HMAC-SHA256                    [32 bytes]
+	master IV                      [16 bytes]
+	encrypted data IV + session key [64 bytes]
+	AES-256-CBC ciphertext
+
+The HMAC is keyed with the second master key and covers everything after it. The data IV and session
+key are encrypted with the first master key and the master IV; the ciphertext is encrypted with the
+session key and the data IV.
+*/
+
+package crypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	ENCRYPTIONV3_HEADER            = "ENCRYPTIONV2"
+	ENCRYPTIONV3_SALT_LEN          = 8
+	ENCRYPTIONV3_PBKDF2_ITERATIONS = 200000
+	ARQO_HEADER                    = "ARQO"
+	HMAC_SHA256_LEN                = 32
+	AES_256_KEY_LEN                = 32
+	ENCRYPTED_SESSION_KEY_LEN      = 64
+)
+
+type EncryptionV3 struct {
+	encryptionKey []byte
+	hmacKey       []byte
+	BlobSHA1Salt  []byte
+}
+
+/*
+Decrypt the master keys in the contents of an encryptionv3.dat file.
+*/
+func NewEncryptionV3(password []byte, data []byte) (*EncryptionV3, error) {
+	headerLen := len(ENCRYPTIONV3_HEADER)
+	minLen := headerLen + ENCRYPTIONV3_SALT_LEN + HMAC_SHA256_LEN + aes.BlockSize + aes.BlockSize
+	if len(data) < minLen || !bytes.HasPrefix(data, []byte(ENCRYPTIONV3_HEADER)) {
+		return nil, errors.New("encryptionv3.dat has an unexpected header or is truncated")
+	}
+	salt := data[headerLen : headerLen+ENCRYPTIONV3_SALT_LEN]
+	expectedMAC := data[headerLen+ENCRYPTIONV3_SALT_LEN : headerLen+ENCRYPTIONV3_SALT_LEN+HMAC_SHA256_LEN]
+	ivAndKeys := data[headerLen+ENCRYPTIONV3_SALT_LEN+HMAC_SHA256_LEN:]
+
+	derived := pbkdf2.Key(password, salt, ENCRYPTIONV3_PBKDF2_ITERATIONS, 2*AES_256_KEY_LEN, sha1.New)
+	if !verifyHMAC(derived[AES_256_KEY_LEN:], ivAndKeys, expectedMAC) {
+		return nil, &WrongPasswordError{"encryptionv3.dat HMAC mismatch"}
+	}
+	masterKeys, err := decryptCBC(derived[:AES_256_KEY_LEN], ivAndKeys[:aes.BlockSize], ivAndKeys[aes.BlockSize:])
+	if err != nil {
+		log.Debugf("NewEncryptionV3 failed to decrypt master keys: %s", err)
+		return nil, err
+	}
+	if len(masterKeys) < 3*AES_256_KEY_LEN {
+		return nil, errors.New(fmt.Sprintf("encryptionv3.dat has %d bytes of master keys, expected %d",
+			len(masterKeys), 3*AES_256_KEY_LEN))
+	}
+	return &EncryptionV3{
+		encryptionKey: masterKeys[:AES_256_KEY_LEN],
+		hmacKey:       masterKeys[AES_256_KEY_LEN : 2*AES_256_KEY_LEN],
+		BlobSHA1Salt:  masterKeys[2*AES_256_KEY_LEN : 3*AES_256_KEY_LEN],
+	}, nil
+}
+
+/*
+Verify the HMAC of an ARQO object, then decrypt it.
+*/
+func (e *EncryptionV3) Decrypt(data []byte) ([]byte, error) {
+	headerLen := len(ARQO_HEADER)
+	if len(data) < headerLen+HMAC_SHA256_LEN+aes.BlockSize+ENCRYPTED_SESSION_KEY_LEN ||
+		!bytes.HasPrefix(data, []byte(ARQO_HEADER)) {
+		return nil, errors.New("Decrypt object doesn't have an ARQO header or is truncated")
+	}
+	expectedMAC := data[headerLen : headerLen+HMAC_SHA256_LEN]
+	body := data[headerLen+HMAC_SHA256_LEN:]
+	if !verifyHMAC(e.hmacKey, body, expectedMAC) {
+		return nil, errors.New("Decrypt object HMAC mismatch, corrupted object or bad password?")
+	}
+	masterIV := body[:aes.BlockSize]
+	encryptedSession := body[aes.BlockSize : aes.BlockSize+ENCRYPTED_SESSION_KEY_LEN]
+	ciphertext := body[aes.BlockSize+ENCRYPTED_SESSION_KEY_LEN:]
+
+	session, err := decryptCBC(e.encryptionKey, masterIV, encryptedSession)
+	if err != nil {
+		log.Debugf("EncryptionV3 failed to decrypt session key: %s", err)
+		return nil, err
+	}
+	if len(session) != aes.BlockSize+AES_256_KEY_LEN {
+		return nil, errors.New(fmt.Sprintf("Decrypt session key is %d bytes, expected %d",
+			len(session), aes.BlockSize+AES_256_KEY_LEN))
+	}
+	return decryptCBC(session[aes.BlockSize:], session[:aes.BlockSize], ciphertext)
+}
+
+func verifyHMAC(key []byte, data []byte, expectedMAC []byte) bool {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hmac.Equal(mac.Sum(nil), expectedMAC)
+}
+
+/*
+Decrypt AES-256-CBC with PKCS#7 padding into a new slice, leaving data untouched.
+*/
+func decryptCBC(key []byte, iv []byte, data []byte) ([]byte, error) {
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("Decrypt data length not a non-zero multiple of AES block size")
+	}
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, len(data))
+	cipher.NewCBCDecrypter(c, iv).CryptBlocks(plaintext, data)
+	return unpad(plaintext)
+}
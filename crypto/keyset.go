@@ -0,0 +1,104 @@
+/*
+arqinator: crypto/keyset.go
+Implements the Arq 6/7 encryptedkeyset.dat master keys.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+/*
+References:
+-	https://www.arqbackup.com/documentation/arq7/English.lproj/dataFormat.html
+
+encryptedkeyset.dat has the same layout as encryptionv3.dat, with a different header and PBKDF2-SHA256:
+
+	header "ARQ_ENCRYPTED_MASTER_KEYS" [25 bytes]
+	salt                             [8 bytes]
+	HMAC-SHA256                      [32 bytes]
+	IV                               [16 bytes]
+	AES-256-CBC encrypted keyset
+
+The decrypted keyset is:
+
+	[UInt32:encryptionVersion]
+	[UInt64:length] [encryption key]
+	[UInt64:length] [HMAC key]
+	[UInt64:length] [blob identifier salt]
+
+Objects are then encrypted in the same ARQO format as Arq 5.
+*/
+
+package crypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	KEYSET_HEADER            = "ARQ_ENCRYPTED_MASTER_KEYS"
+	KEYSET_PBKDF2_ITERATIONS = 200000
+)
+
+/*
+Decrypt the master keys in the contents of an encryptedkeyset.dat file.
+*/
+func NewEncryptedKeySet(password []byte, data []byte) (*EncryptionV3, error) {
+	headerLen := len(KEYSET_HEADER)
+	minLen := headerLen + ENCRYPTIONV3_SALT_LEN + HMAC_SHA256_LEN + aes.BlockSize + aes.BlockSize
+	if len(data) < minLen || !bytes.HasPrefix(data, []byte(KEYSET_HEADER)) {
+		return nil, errors.New("encryptedkeyset.dat has an unexpected header or is truncated")
+	}
+	salt := data[headerLen : headerLen+ENCRYPTIONV3_SALT_LEN]
+	expectedMAC := data[headerLen+ENCRYPTIONV3_SALT_LEN : headerLen+ENCRYPTIONV3_SALT_LEN+HMAC_SHA256_LEN]
+	ivAndKeys := data[headerLen+ENCRYPTIONV3_SALT_LEN+HMAC_SHA256_LEN:]
+
+	derived := pbkdf2.Key(password, salt, KEYSET_PBKDF2_ITERATIONS, 2*AES_256_KEY_LEN, sha256.New)
+	if !verifyHMAC(derived[AES_256_KEY_LEN:], ivAndKeys, expectedMAC) {
+		return nil, &WrongPasswordError{"encryptedkeyset.dat HMAC mismatch"}
+	}
+	plaintext, err := decryptCBC(derived[:AES_256_KEY_LEN], ivAndKeys[:aes.BlockSize], ivAndKeys[aes.BlockSize:])
+	if err != nil {
+		log.Debugf("NewEncryptedKeySet failed to decrypt keyset: %s", err)
+		return nil, err
+	}
+
+	p := bytes.NewBuffer(plaintext)
+	var encryptionVersion uint32
+	binary.Read(p, binary.BigEndian, &encryptionVersion)
+	keys := make([][]byte, 3)
+	for i := range keys {
+		var length uint64
+		if err := binary.Read(p, binary.BigEndian, &length); err != nil || length > uint64(p.Len()) {
+			return nil, errors.New(fmt.Sprintf("encryptedkeyset.dat keyset version %d is truncated", encryptionVersion))
+		}
+		keys[i] = p.Next(int(length))
+	}
+	if len(keys[0]) != AES_256_KEY_LEN {
+		return nil, errors.New(fmt.Sprintf("encryptedkeyset.dat encryption key is %d bytes, expected %d",
+			len(keys[0]), AES_256_KEY_LEN))
+	}
+	return &EncryptionV3{
+		encryptionKey: keys[0],
+		hmacKey:       keys[1],
+		BlobSHA1Salt:  keys[2],
+	}, nil
+}
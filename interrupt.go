@@ -0,0 +1,63 @@
+/*
+arqinator: interrupt.go
+Implements stopping commands cleanly on Ctrl-C.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	EXIT_CODE_INTERRUPTED = 130
+)
+
+/*
+Returns a context that is cancelled by Ctrl-C, and a function to stop listening for Ctrl-C. Downloads
+stop and leave nothing half-written behind, so running the command again carries on from where it was
+interrupted. If that doesn't happen quickly enough, a second Ctrl-C exits straight away.
+*/
+func withInterrupt(parent context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(parent)
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-interrupts:
+		case <-stopped:
+			return
+		}
+		log.Printf("Interrupted, stopping. Press Ctrl-C again to quit immediately.")
+		cancel()
+		select {
+		case <-interrupts:
+			os.Exit(EXIT_CODE_INTERRUPTED)
+		case <-stopped:
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(interrupts)
+		close(stopped)
+		cancel()
+	}
+}
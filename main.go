@@ -20,6 +20,7 @@ Copyright 2015 Asim Ihsan
 package main
 
 import (
+	"context"
 	"os"
 
 	log "github.com/Sirupsen/logrus"
@@ -28,54 +29,88 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/codegangsta/cli"
+	"github.com/dustin/go-humanize"
 	"github.com/mitchellh/go-homedir"
 
 	"errors"
 	"fmt"
 	"github.com/asimihsan/arqinator/arq"
 	"github.com/asimihsan/arqinator/connector"
+	"github.com/asimihsan/arqinator/progress"
 	"runtime"
+	"strings"
+	"text/tabwriter"
+	"time"
 )
 
 const (
 	VERSION = "v0.1.7"
 )
 
+/*
+Load the profile and logging settings that every command uses.
+*/
+func settingsSetup(c *cli.Context) error {
+	configFilepath, err := homedir.Expand(c.GlobalString("config"))
+	if err != nil {
+		return errors.New(fmt.Sprintf("Failed to expand config file path %s: %s", c.GlobalString("config"), err))
+	}
+	if profile, err = loadProfile(configFilepath, c.GlobalString("profile"), c.App.Flags); err != nil {
+		return err
+	}
+	if globalBool(c, "verbose") {
+		log.SetLevel(log.DebugLevel)
+	}
+	return nil
+}
+
 func cliSetup(c *cli.Context) error {
-	switch c.GlobalString("backup-type") {
+	if err := settingsSetup(c); err != nil {
+		return err
+	}
+	switch globalString(c, "backup-type") {
+	case "azure":
+	case "b2":
 	case "googlecloudstorage":
 	case "s3":
 	case "sftp":
+	case "webdav":
 	default:
-		return errors.New("Currently only support backup-type of: ['googlecloudstorage', 's3', 'sftp']")
-	}
-	if c.GlobalBool("verbose") {
-		log.SetLevel(log.DebugLevel)
-	}
-	if c.GlobalBool("delete-cache-directory") {
-		cacheDirectory := c.GlobalString("cache-directory")
-		log.Debugf("Deleting cache directory %s...", cacheDirectory)
-		fileInfo, err := os.Stat(cacheDirectory)
-		if err != nil {
-			return errors.New(fmt.Sprintf("Can't delete cache directory %s, it doesn't exist", cacheDirectory))
-		}
-		if !fileInfo.IsDir() {
-			return errors.New(fmt.Sprintf("Won't delete cache directory %s, it isn't a directory", cacheDirectory))
-		}
-		if err := os.RemoveAll(cacheDirectory); err != nil {
-			return errors.New(fmt.Sprintf("Failed to delete cache directory %s: %s", cacheDirectory, err))
-		}
-		log.Debugf("Deleted cache directory %s.", cacheDirectory)
+		return errors.New("Currently only support backup-type of: ['azure', 'b2', 'googlecloudstorage', 's3', 'sftp', 'webdav']")
 	}
 	return nil
 }
 
 func awsSetup(c *cli.Context) (connector.Connection, error) {
-	region := c.GlobalString("s3-region")
-	s3BucketName := c.GlobalString("s3-bucket-name")
-	cacheDirectory := c.GlobalString("cache-directory")
+	region := globalString(c, "s3-region")
+	s3BucketName := globalString(c, "s3-bucket-name")
+	endpoint := globalString(c, "s3-endpoint")
+	insecureSkipVerify := globalBool(c, "s3-insecure-skip-verify")
+	caBundleFilepath := globalString(c, "s3-ca-bundle")
+	cacheDirectory := globalString(c, "cache-directory")
 
+	if endpoint != "" {
+		// S3-compatible stores usually ignore the region, but requests still need to be signed with one.
+		if region == "" {
+			region = "us-east-1"
+		}
+		log.Debugf("Using S3-compatible endpoint %s", endpoint)
+		defaults.DefaultConfig.Endpoint = aws.String(endpoint)
+	}
 	defaults.DefaultConfig.Region = aws.String(region)
+	// Retried by connector.NewRetryingConnection instead, so that --retry-attempts counts every try.
+	defaults.DefaultConfig.MaxRetries = aws.Int(0)
+	if globalBool(c, "s3-path-style") {
+		defaults.DefaultConfig.S3ForcePathStyle = aws.Bool(true)
+	}
+	if insecureSkipVerify || caBundleFilepath != "" {
+		httpClient, err := connector.NewHTTPClient(insecureSkipVerify, caBundleFilepath)
+		if err != nil {
+			log.Errorf("Error while configuring S3 TLS: %s", err)
+			return nil, err
+		}
+		defaults.DefaultConfig.HTTPClient = httpClient
+	}
 	svc := s3.New(nil)
 	log.Debugln("Setting concurrency of S3 downloader to: ", runtime.GOMAXPROCS(0))
 	opts := &s3manager.DownloadOptions{
@@ -87,10 +122,10 @@ func awsSetup(c *cli.Context) (connector.Connection, error) {
 }
 
 func googleCloudStorageSetup(c *cli.Context) (connector.Connection, error) {
-	jsonPrivateKeyFilepath := c.GlobalString("gcs-json-private-key-filepath")
-	projectID := c.GlobalString("gcs-project-id")
-	bucketName := c.GlobalString("gcs-bucket-name")
-	cacheDirectory := c.GlobalString("cache-directory")
+	jsonPrivateKeyFilepath := globalString(c, "gcs-json-private-key-filepath")
+	projectID := globalString(c, "gcs-project-id")
+	bucketName := globalString(c, "gcs-bucket-name")
+	cacheDirectory := globalString(c, "cache-directory")
 
 	connection, err := connector.NewGoogleCloudStorageConnection(jsonPrivateKeyFilepath, projectID, bucketName, cacheDirectory)
 	if err != nil {
@@ -104,26 +139,35 @@ func sftpSetup(c *cli.Context) (connector.Connection, error) {
 		password           *string
 		privateKeyFilepath *string
 	)
-	host := c.GlobalString("sftp-host")
-	port := c.GlobalInt("sftp-port")
-	remotePath := c.GlobalString("sftp-remote-path")
-	username := c.GlobalString("sftp-username")
+	host := globalString(c, "sftp-host")
+	port := globalInt(c, "sftp-port")
+	remotePath := globalString(c, "sftp-remote-path")
+	username := globalString(c, "sftp-username")
 	passwordInput := os.Getenv("ARQ_SFTP_PASSWORD")
 	if passwordInput != "" {
 		password = &passwordInput
 	} else {
 		password = nil
 	}
-	if c.GlobalIsSet("sftp-private-key-filepath") {
-		privateKey := c.GlobalString("sftp-private-key-filepath")
+	if privateKey := globalString(c, "sftp-private-key-filepath"); privateKey != "" {
 		privateKeyFilepath = &privateKey
 	} else {
 		privateKeyFilepath = nil
 	}
-	cacheDirectory := c.GlobalString("cache-directory")
+	knownHostsFilepath, err := homedir.Expand(globalString(c, "sftp-known-hosts"))
+	if err != nil {
+		log.Errorf("Couldn't expand SFTP known_hosts filepath: %s", err)
+		return connector.SFTPConnection{}, err
+	}
+	hostKeyVerifier := connector.SFTPHostKeyVerifier{
+		KnownHostsFilepath: knownHostsFilepath,
+		Fingerprint:        globalString(c, "sftp-host-key-fingerprint"),
+		TrustOnFirstUse:    globalBool(c, "sftp-trust-on-first-use"),
+	}
+	cacheDirectory := globalString(c, "cache-directory")
 
 	connection, err := connector.NewSFTPConnection(host, port, remotePath,
-		username, password, privateKeyFilepath, cacheDirectory)
+		username, password, privateKeyFilepath, hostKeyVerifier, cacheDirectory)
 	if err != nil {
 		log.Errorf("Error while establishing SFTP connection: %s", err)
 		return connector.SFTPConnection{}, err
@@ -131,181 +175,432 @@ func sftpSetup(c *cli.Context) (connector.Connection, error) {
 	return *connection, nil
 }
 
+func b2Setup(c *cli.Context) (connector.Connection, error) {
+	apiURL := globalString(c, "b2-api-url")
+	bucketName := globalString(c, "b2-bucket-name")
+	cacheDirectory := globalString(c, "cache-directory")
+	keyID := os.Getenv("B2_APPLICATION_KEY_ID")
+	applicationKey := os.Getenv("B2_APPLICATION_KEY")
+	if keyID == "" || applicationKey == "" {
+		return nil, errors.New("B2_APPLICATION_KEY_ID and B2_APPLICATION_KEY environment variables are mandatory for backup-type b2")
+	}
+
+	connection, err := connector.NewB2Connection(apiURL, keyID, applicationKey, bucketName, cacheDirectory)
+	if err != nil {
+		log.Errorf("Error while establishing B2 connection: %s", err)
+		return nil, err
+	}
+	return *connection, nil
+}
+
+func azureSetup(c *cli.Context) (connector.Connection, error) {
+	accountName := globalString(c, "azure-account-name")
+	containerName := globalString(c, "azure-container-name")
+	endpoint := globalString(c, "azure-endpoint")
+	cacheDirectory := globalString(c, "cache-directory")
+	accountKey := os.Getenv("AZURE_STORAGE_KEY")
+	sasToken := os.Getenv("AZURE_STORAGE_SAS_TOKEN")
+	if accountKey == "" && sasToken == "" {
+		return nil, errors.New("One of AZURE_STORAGE_KEY or AZURE_STORAGE_SAS_TOKEN environment variables is mandatory for backup-type azure")
+	}
+
+	connection, err := connector.NewAzureConnection(accountName, accountKey, sasToken, containerName, endpoint, cacheDirectory)
+	if err != nil {
+		log.Errorf("Error while establishing Azure connection: %s", err)
+		return nil, err
+	}
+	return *connection, nil
+}
+
+func webdavSetup(c *cli.Context) (connector.Connection, error) {
+	rawURL := globalString(c, "webdav-url")
+	username := globalString(c, "webdav-username")
+	password := os.Getenv("ARQ_WEBDAV_PASSWORD")
+	insecureSkipVerify := globalBool(c, "webdav-insecure-skip-verify")
+	caBundleFilepath := globalString(c, "webdav-ca-bundle")
+	cacheDirectory := globalString(c, "cache-directory")
+
+	connection, err := connector.NewWebDAVConnection(rawURL, username, password, insecureSkipVerify,
+		caBundleFilepath, cacheDirectory)
+	if err != nil {
+		log.Errorf("Error while establishing WebDAV connection: %s", err)
+		return nil, err
+	}
+	return *connection, nil
+}
+
 func getConnection(c *cli.Context) (connector.Connection, error) {
 	var (
 		connection connector.Connection
 		err        error
 	)
-	switch c.GlobalString("backup-type") {
+	switch globalString(c, "backup-type") {
+	case "azure":
+		connection, err = azureSetup(c)
+	case "b2":
+		connection, err = b2Setup(c)
 	case "googlecloudstorage":
 		connection, err = googleCloudStorageSetup(c)
 	case "s3":
 		connection, err = awsSetup(c)
 	case "sftp":
 		connection, err = sftpSetup(c)
+	case "webdav":
+		connection, err = webdavSetup(c)
 	}
 	if err != nil {
 		log.Debugf("%s", err)
 		return nil, err
 	}
-	return connection, nil
+	policy, err := getRetryPolicy(c)
+	if err != nil {
+		connection.Close()
+		return nil, err
+	}
+	cacheManager, err := getCacheManager(c)
+	if err != nil {
+		connection.Close()
+		return nil, err
+	}
+	return connector.NewCacheManagedConnection(connector.NewRetryingConnection(connection, policy), cacheManager), nil
 }
 
-func getArqBackupSets(c *cli.Context, connection connector.Connection) ([]*arq.ArqBackupSet, error) {
-	password := []byte(os.Getenv("ARQ_ENCRYPTION_PASSWORD"))
+func getRetryPolicy(c *cli.Context) (connector.RetryPolicy, error) {
+	policy := connector.DefaultRetryPolicy()
+	policy.Attempts = globalInt(c, "retry-attempts")
+	for _, setting := range []struct {
+		name  string
+		value *time.Duration
+	}{
+		{"retry-initial-backoff", &policy.InitialBackoff},
+		{"retry-max-backoff", &policy.MaxBackoff},
+	} {
+		value, err := time.ParseDuration(globalString(c, setting.name))
+		if err != nil || value < 0 {
+			return policy, errors.New(fmt.Sprintf("Invalid %s %s, expected a duration like '500ms' or '30s'",
+				setting.name, globalString(c, setting.name)))
+		}
+		*setting.value = value
+	}
+	return policy, nil
+}
 
-	arqBackupSets, err := arq.GetArqBackupSets(connection, password)
+/*
+ARQ_ENCRYPTION_PASSWORD, if set, is tried first against backup sets that the password file doesn't map.
+*/
+func getPasswords(c *cli.Context) (*arq.Passwords, error) {
+	passwords := arq.NewPasswords()
+	if password := os.Getenv("ARQ_ENCRYPTION_PASSWORD"); password != "" {
+		passwords.Add("", []byte(password))
+	}
+	if passwordFile := globalString(c, "password-file"); passwordFile != "" {
+		if err := passwords.AddFile(passwordFile); err != nil {
+			log.Debugf("Error during getPasswords: %s", err)
+			return nil, err
+		}
+	}
+	return passwords, nil
+}
+
+func openRepository(ctx context.Context, c *cli.Context, connection connector.Connection) (*arq.Repository, error) {
+	passwords, err := getPasswords(c)
 	if err != nil {
-		log.Debugf("Error during getArqBackupSets: %s", err)
 		return nil, err
 	}
-	return arqBackupSets, nil
+	repository, err := arq.Open(ctx, connection, passwords)
+	if err != nil {
+		log.Debugf("Error during openRepository: %s", err)
+		return nil, err
+	}
+	return repository, nil
 }
 
-func listBackupSets(c *cli.Context, connection connector.Connection) error {
-	arqBackupSets, err := getArqBackupSets(c, connection)
+func listBackupSets(ctx context.Context, c *cli.Context, connection connector.Connection) error {
+	if c.Bool("all") {
+		return listAllBackupSets(ctx, c, connection)
+	}
+	repository, err := openRepository(ctx, c, connection)
 	if err != nil {
 		log.Debugf("Error during listBackupSets: %s", err)
 		return nil
 	}
-	for _, arqBackupSet := range arqBackupSets {
-		fmt.Printf("ArqBackupSet\n")
-		fmt.Printf("    UUID %s\n", arqBackupSet.UUID)
-		fmt.Printf("    ComputerName %s\n", arqBackupSet.ComputerInfo.ComputerName)
-		fmt.Printf("    UserName %s\n", arqBackupSet.ComputerInfo.UserName)
-		fmt.Printf("    Folders\n")
-		for _, bucket := range arqBackupSet.Buckets {
-			fmt.Printf("        LocalPath %s\n", bucket.LocalPath)
-			fmt.Printf("        UUID %s\n", bucket.UUID)
-		}
+	for _, arqBackupSet := range repository.BackupSets() {
+		printBackupSet(arqBackupSet, "")
 	}
 	return nil
 }
 
-func findBucket(c *cli.Context, connection connector.Connection, backupSetUUID string, folderUUID string) (*arq.ArqBucket, error) {
-	arqBackupSets, err := getArqBackupSets(c, connection)
+func listAllBackupSets(ctx context.Context, c *cli.Context, connection connector.Connection) error {
+	passwords, err := getPasswords(c)
 	if err != nil {
-		log.Debugf("Error during findBucket: %s", err)
-		return nil, err
+		return err
 	}
-	var bucket *arq.ArqBucket
-	for _, arqBackupSet := range arqBackupSets {
-		if arqBackupSet.UUID == backupSetUUID {
-			for _, folder := range arqBackupSet.Buckets {
-				if folder.UUID == folderUUID {
-					bucket = folder
-				}
-			}
+	results, err := arq.GetAllArqBackupSets(ctx, connection, passwords)
+	if err != nil {
+		log.Debugf("Error during listAllBackupSets: %s", err)
+		return err
+	}
+	for _, result := range results {
+		if result.Status == arq.BACKUP_SET_STATUS_DECRYPTED {
+			printBackupSet(result.BackupSet, result.Status)
+			continue
 		}
+		fmt.Printf("ArqBackupSet\n")
+		fmt.Printf("    UUID %s\n", result.UUID)
+		fmt.Printf("    Status %s\n", result.Status)
+		fmt.Printf("    Error %s\n", result.Err.Err)
+	}
+	return nil
+}
+
+/*
+status is only printed if non-empty, i.e. for 'list-backup-sets --all'.
+*/
+func printBackupSet(arqBackupSet *arq.ArqBackupSet, status arq.BackupSetStatus) {
+	fmt.Printf("ArqBackupSet\n")
+	fmt.Printf("    UUID %s\n", arqBackupSet.UUID)
+	if status != "" {
+		fmt.Printf("    Status %s\n", status)
+	}
+	fmt.Printf("    Format %s\n", arqBackupSet.FormatVersion())
+	fmt.Printf("    ComputerName %s\n", arqBackupSet.ComputerInfo.ComputerName)
+	fmt.Printf("    UserName %s\n", arqBackupSet.ComputerInfo.UserName)
+	fmt.Printf("    Folders\n")
+	for _, bucket := range arqBackupSet.Buckets {
+		fmt.Printf("        LocalPath %s\n", bucket.LocalPath)
+		fmt.Printf("        UUID %s\n", bucket.UUID)
+	}
+}
+
+/*
+Which folder of which backup set a command is about. Backup sets are chosen by UUID or computer name, and
+folders by UUID or local path. Names may be given as unique prefixes. Empty fields match anything.
+*/
+type bucketSelector struct {
+	BackupSetUUID string
+	Computer      string
+	FolderUUID    string
+	Folder        string
+}
+
+func getBucketSelector(c *cli.Context) bucketSelector {
+	return bucketSelector{
+		BackupSetUUID: commandString(c, "backup-set-uuid"),
+		Computer:      commandString(c, "computer"),
+		FolderUUID:    commandString(c, "folder-uuid"),
+		Folder:        commandString(c, "folder"),
+	}
+}
+
+func (s bucketSelector) String() string {
+	parts := make([]string, 0)
+	if s.BackupSetUUID != "" {
+		parts = append(parts, fmt.Sprintf("backup set UUID %s", s.BackupSetUUID))
+	}
+	if s.Computer != "" {
+		parts = append(parts, fmt.Sprintf("computer '%s'", s.Computer))
+	}
+	if s.FolderUUID != "" {
+		parts = append(parts, fmt.Sprintf("folder UUID %s", s.FolderUUID))
+	}
+	if s.Folder != "" {
+		parts = append(parts, fmt.Sprintf("folder '%s'", s.Folder))
+	}
+	if len(parts) == 0 {
+		return "any folder"
+	}
+	return strings.Join(parts, ", ")
+}
+
+/*
+Keep the folders whose name is query. If there are none keep those whose name starts with query, so
+that a unique prefix is enough.
+*/
+func filterFoldersByName(folders []*arq.Folder, query string, getName func(*arq.Folder) string) []*arq.Folder {
+	if query == "" {
+		return folders
+	}
+	exact := make([]*arq.Folder, 0)
+	prefixed := make([]*arq.Folder, 0)
+	for _, folder := range folders {
+		name := getName(folder)
+		if name == query {
+			exact = append(exact, folder)
+		} else if strings.HasPrefix(name, query) {
+			prefixed = append(prefixed, folder)
+		}
+	}
+	if len(exact) > 0 {
+		return exact
+	}
+	return prefixed
+}
+
+func selectFolders(folders []*arq.Folder, selector bucketSelector) []*arq.Folder {
+	folders = filterFoldersByName(folders, selector.BackupSetUUID, func(f *arq.Folder) string {
+		return f.BackupSet.UUID
+	})
+	folders = filterFoldersByName(folders, selector.Computer, func(f *arq.Folder) string {
+		return f.ComputerName
+	})
+	folders = filterFoldersByName(folders, selector.FolderUUID, func(f *arq.Folder) string {
+		return f.UUID
+	})
+	return filterFoldersByName(folders, selector.Folder, func(f *arq.Folder) string {
+		return f.LocalPath
+	})
+}
+
+func findFolder(ctx context.Context, c *cli.Context, connection connector.Connection, selector bucketSelector) (*arq.Folder, error) {
+	repository, err := openRepository(ctx, c, connection)
+	if err != nil {
+		log.Debugf("Error during findFolder: %s", err)
+		return nil, err
 	}
-	if bucket == nil {
-		err := errors.New(fmt.Sprintf("Couldn't find backup set UUID %s, folder UUID %s.", backupSetUUID, folderUUID))
+	folders := selectFolders(repository.Folders(), selector)
+	switch len(folders) {
+	case 0:
+		err := errors.New(fmt.Sprintf("Couldn't find %s. Use 'list-backup-sets' to see what's available.", selector))
 		log.Errorf("%s", err)
 		return nil, err
+	case 1:
+		return folders[0], nil
+	}
+	candidates := make([]string, len(folders))
+	for i, folder := range folders {
+		candidates[i] = fmt.Sprintf("    computer '%s' folder '%s' (--backup-set-uuid %s --folder-uuid %s)",
+			folder.ComputerName, folder.LocalPath, folder.BackupSet.UUID, folder.UUID)
 	}
-	return bucket, nil
+	err = errors.New(fmt.Sprintf("%s matches %d folders, be more specific:\n%s",
+		selector, len(folders), strings.Join(candidates, "\n")))
+	log.Errorf("%s", err)
+	return nil, err
 }
 
-func listDirectoryContents(c *cli.Context, connection connector.Connection) error {
-	backupSetUUID := c.String("backup-set-uuid")
-	if backupSetUUID == "" {
-		return errors.New("backup-set-uuid is mandatory for list-directory-contents")
+/*
+Find the folder chosen by the command flags, and its latest snapshot, caching the folder's tree pack sets
+and, if needed, blob pack sets with a progress report. Other folders' pack sets aren't touched.
+*/
+func findLatestSnapshot(ctx context.Context, c *cli.Context, connection connector.Connection, cacheBlobs bool) (*arq.Snapshot, error) {
+	folder, err := findFolder(ctx, c, connection, getBucketSelector(c))
+	if err != nil {
+		return nil, err
+	}
+	label := "Caching tree pack sets"
+	if cacheBlobs {
+		label = "Caching tree and blob pack sets"
+	}
+	log.Printf("%s. If this is your first run, will take a few minutes...", label)
+	reporter := progress.StartReporter(progress.NewTracker(label))
+	err = folder.CacheTrees(ctx)
+	if err == nil && cacheBlobs {
+		err = folder.CacheBlobs(ctx)
+	}
+	reporter.Stop()
+	if err != nil {
+		log.Errorf("Failed to cache pack sets of %s: %s", folder.LocalPath, err)
+		return nil, err
 	}
-	folderUUID := c.String("folder-uuid")
-	if folderUUID == "" {
-		return errors.New("folder-uuid is mandatory for list-directory-contents")
+	log.Printf("Cached pack sets.")
+	snapshot, err := folder.Latest(ctx)
+	if err != nil {
+		log.Errorf("Failed to get latest backup of %s: %s", folder.LocalPath, err)
+		return nil, err
 	}
+	return snapshot, nil
+}
+
+func listDirectoryContents(ctx context.Context, c *cli.Context, connection connector.Connection) error {
 	targetPath := c.String("path")
 	if targetPath == "" {
 		return errors.New("path is mandatory for list-directory-contents")
 	}
-	cacheDirectory := c.GlobalString("cache-directory")
-
-	bucket, err := findBucket(c, connection, backupSetUUID, folderUUID)
+	snapshot, err := findLatestSnapshot(ctx, c, connection, false)
+	if err != nil {
+		return err
+	}
+	p, err := snapshot.RelativePath(targetPath)
 	if err != nil {
-		err := errors.New(fmt.Sprintf("Couldn't find backup set UUID %s, folder UUID %s.", backupSetUUID, folderUUID))
 		log.Errorf("%s", err)
 		return err
 	}
-	log.Printf("Caching tree pack sets. If this is your first run, will take a few minutes...")
-	backupSet := bucket.ArqBackupSet
-	backupSet.CacheTreePackSets()
-	log.Printf("Cached tree pack sets.")
-
-	tree, node, err := arq.FindNode(cacheDirectory, backupSet, bucket, targetPath)
+	file, err := snapshot.Stat(ctx, p)
 	if err != nil {
 		log.Errorf("Failed to find target path %s: %s", targetPath, err)
 		return err
 	}
-	if node == nil || node.IsTree.IsTrue() {
-		if tree == nil {
-			err2 := errors.New(fmt.Sprintf("node is tree but no tree found: %s", node))
-			log.Errorf("%s", err2)
-			return err2
-		}
-		apsi, _ := arq.NewPackSetIndex(cacheDirectory, backupSet, bucket)
-		for _, node := range tree.Nodes {
-			if node.IsTree.IsTrue() {
-				tree, err := apsi.GetPackFileAsTree(backupSet, bucket, *node.DataBlobKeys[0].SHA1)
-				if err != nil {
-					log.Debugf("Failed to find tree for node %s: %s", node, err)
-					node.PrintOutput()
-				} else if tree == nil {
-					log.Debugf("directory node %s has no tree", node)
-					node.PrintOutput()
-				} else {
-					tree.PrintOutput(node)
-				}
-			} else {
-				node.PrintOutput()
-			}
-		}
-	} else {
-		node.PrintOutput()
+	if !file.IsDir() {
+		printFiles([]*arq.File{file})
+		return nil
+	}
+	files, err := snapshot.ReadDir(ctx, p)
+	if err != nil {
+		log.Errorf("Failed to list target path %s: %s", targetPath, err)
+		return err
 	}
+	printFiles(files)
 	return nil
 }
 
-func recover(c *cli.Context, connection connector.Connection) error {
-	cacheDirectory := c.GlobalString("cache-directory")
-	backupSetUUID := c.String("backup-set-uuid")
-	folderUUID := c.String("folder-uuid")
+func printFiles(files []*arq.File) {
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 0, 8, 0, '\t', 0)
+	for _, file := range files {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", file.Mode, file.ModTime, humanize.Bytes(uint64(file.Size)), file.Name)
+	}
+	w.Flush()
+}
+
+func recover(ctx context.Context, c *cli.Context, connection connector.Connection) error {
 	sourcePath := c.String("source-path")
 	destinationPath := c.String("destination-path")
 
-	if _, err := os.Stat(destinationPath); err == nil {
-		err := errors.New(fmt.Sprintf("Destination path %s already exists, won't overwrite.", destinationPath))
+	if _, err := os.Stat(destinationPath); err == nil && !c.Bool("resume") {
+		err := errors.New(fmt.Sprintf("Destination path %s already exists, won't overwrite. Use --resume to carry on with an interrupted recovery.", destinationPath))
 		log.Errorf("%s", err)
 		return err
 	}
-	bucket, err := findBucket(c, connection, backupSetUUID, folderUUID)
+	snapshot, err := findLatestSnapshot(ctx, c, connection, true)
+	if err != nil {
+		return err
+	}
+	p, err := snapshot.RelativePath(sourcePath)
 	if err != nil {
-		err := errors.New(fmt.Sprintf("Couldn't find backup set UUID %s, folder UUID %s.", backupSetUUID, folderUUID))
 		log.Errorf("%s", err)
 		return err
 	}
-	log.Printf("Caching tree and blob pack sets. If this is your first run, will take a few minutes...")
-	backupSet := bucket.ArqBackupSet
-	backupSet.CacheTreePackSets()
-	backupSet.CacheBlobPackSets()
-	log.Printf("Cached tree and blob pack sets.")
+	if err := restore(ctx, snapshot, p, destinationPath); err != nil {
+		if ctx.Err() != nil {
+			log.Printf("Stopped recovering %s. Run the same command with --resume to carry on.", sourcePath)
+			return nil
+		}
+		log.Errorf("Failed to recover %s: %s", sourcePath, err)
+		return err
+	}
+	return nil
+}
 
-	tree, node, err := arq.FindNode(cacheDirectory, backupSet, bucket, sourcePath)
-	log.Debugf("sourcePath: %s, tree: %s, node: %s", sourcePath, tree, node)
+/*
+Restore a file or directory of a snapshot while reporting progress.
+*/
+func restore(ctx context.Context, snapshot *arq.Snapshot, p string, destinationPath string) error {
+	file, err := snapshot.Stat(ctx, p)
 	if err != nil {
-		log.Errorf("Failed to find source path %s: %s", sourcePath, err)
 		return err
 	}
-	if node == nil || node.IsTree.IsTrue() {
-		err = arq.DownloadTree(tree, cacheDirectory, backupSet, bucket, sourcePath, destinationPath)
+	tracker := progress.NewTracker("Recovering")
+	reporter := progress.StartReporter(tracker)
+	if file.IsDir() {
+		tracker.Plan(0, file.Size)
 	} else {
-		err = arq.DownloadNode(node, cacheDirectory, backupSet, bucket, sourcePath, destinationPath)
+		tracker.Plan(1, file.Size)
 	}
-	if err != nil && err != arq.ErrorCouldNotRecoverTree {
-		log.Errorf("recover failed to download node: %s", err)
-		return err
+	err = snapshot.Restore(ctx, p, destinationPath)
+	reporter.Stop()
+	if err == arq.ErrorCouldNotRecoverTree {
+		return nil
 	}
-	return nil
+	return err
 }
 
 func main() {
@@ -319,9 +614,42 @@ func main() {
 	app.Usage = "restore folders and files from Arq backups"
 	app.Version = VERSION
 	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "config",
+			Value:  DEFAULT_CONFIG_FILEPATH,
+			Usage:  "Config file of named profiles. See README.",
+			EnvVar: "ARQINATOR_CONFIG",
+		},
+		cli.StringFlag{
+			Name:   "profile",
+			Usage:  "Name of profile in config file to use, by default 'default' if it exists.",
+			EnvVar: "ARQINATOR_PROFILE",
+		},
 		cli.StringFlag{
 			Name:  "backup-type",
-			Usage: "Method used for backup, one of: ['s3', 'googlecloudstorage']",
+			Usage: "Method used for backup, one of: ['azure', 'b2', 's3', 'googlecloudstorage', 'sftp', 'webdav']",
+		},
+		cli.StringFlag{
+			Name:   "azure-account-name",
+			Usage:  "Azure storage account name.",
+			EnvVar: "AZURE_STORAGE_ACCOUNT",
+		},
+		cli.StringFlag{
+			Name:  "azure-container-name",
+			Usage: "Azure Blob Storage container name.",
+		},
+		cli.StringFlag{
+			Name:  "azure-endpoint",
+			Usage: "Azure Blob Storage endpoint, e.g. 'http://127.0.0.1:10000/devstoreaccount1' for Azurite. Default: https://<account>.blob.core.windows.net",
+		},
+		cli.StringFlag{
+			Name:  "b2-bucket-name",
+			Usage: "Backblaze B2 bucket name.",
+		},
+		cli.StringFlag{
+			Name:  "b2-api-url",
+			Value: connector.B2_DEFAULT_API_URL,
+			Usage: "Backblaze B2 API URL to authorize against.",
 		},
 		cli.StringFlag{
 			Name:  "s3-region",
@@ -331,6 +659,23 @@ func main() {
 			Name:  "s3-bucket-name",
 			Usage: "AWS S3 bucket name, e.g. 'arq-akiaabdefg-us-west-2'.",
 		},
+		cli.StringFlag{
+			Name:  "s3-endpoint",
+			Usage: "Endpoint of an S3-compatible store, e.g. 'https://s3.wasabisys.com' or 'http://localhost:9000'. Default: AWS.",
+		},
+		cli.BoolFlag{
+			Name:  "s3-path-style",
+			Usage: "Use path-style S3 URLs (https://endpoint/bucket/key) rather than virtual-hosted style. Needed by MinIO and Ceph.",
+		},
+		cli.BoolFlag{
+			Name:  "s3-insecure-skip-verify",
+			Usage: "Don't verify the TLS certificate of the S3 endpoint. Only use this for testing.",
+		},
+		cli.StringFlag{
+			Name:   "s3-ca-bundle",
+			Usage:  "PEM file of extra root certificates to trust for the S3 endpoint.",
+			EnvVar: "AWS_CA_BUNDLE",
+		},
 		cli.StringFlag{
 			Name:  "gcs-json-private-key-filepath",
 			Usage: "Google Cloud Storage JSON private key filepath. See: https://goo.gl/SK5Rb7",
@@ -364,14 +709,63 @@ func main() {
 			Name:  "sftp-private-key-filepath",
 			Usage: "SFTP SSH private key filepath to use.",
 		},
+		cli.StringFlag{
+			Name:  "sftp-known-hosts",
+			Usage: "SSH known_hosts file to verify the SFTP server's host key against.",
+			Value: "~/.ssh/known_hosts",
+		},
+		cli.StringFlag{
+			Name:  "sftp-host-key-fingerprint",
+			Usage: "Fingerprint the SFTP server's host key must have, e.g. 'SHA256:...' as printed by 'ssh-keygen -lf'. Overrides --sftp-known-hosts.",
+		},
+		cli.BoolFlag{
+			Name:  "sftp-trust-on-first-use",
+			Usage: "Trust an SFTP server that isn't in --sftp-known-hosts yet, and add its host key there. A changed host key is still refused.",
+		},
+		cli.StringFlag{
+			Name:  "webdav-url",
+			Usage: "WebDAV URL of the folder Arq backs up into, e.g. 'https://cloud.example.com/remote.php/dav/files/alice/Arq'.",
+		},
+		cli.StringFlag{
+			Name:  "webdav-username",
+			Usage: "WebDAV username.",
+		},
+		cli.BoolFlag{
+			Name:  "webdav-insecure-skip-verify",
+			Usage: "Don't verify the TLS certificate of the WebDAV server. Only use this for testing.",
+		},
+		cli.StringFlag{
+			Name:  "webdav-ca-bundle",
+			Usage: "PEM file of extra root certificates to trust for the WebDAV server.",
+		},
+		cli.StringFlag{
+			Name:   "password-file",
+			Usage:  "File of encryption passwords, optionally mapped to backup set UUIDs or computer names. See README.",
+			EnvVar: "ARQ_PASSWORD_FILE",
+		},
+		cli.IntFlag{
+			Name:  "retry-attempts",
+			Value: connector.DEFAULT_RETRY_ATTEMPTS,
+			Usage: "How many times to try a request to the backup's storage that fails with a transient error, e.g. a timeout or HTTP 503. 1 means don't retry.",
+		},
+		cli.StringFlag{
+			Name:  "retry-initial-backoff",
+			Value: connector.DEFAULT_RETRY_INITIAL_BACKOFF.String(),
+			Usage: "How long to wait before the first retry. The wait doubles for each retry after it, with some randomness.",
+		},
+		cli.StringFlag{
+			Name:  "retry-max-backoff",
+			Value: connector.DEFAULT_RETRY_MAX_BACKOFF.String(),
+			Usage: "Longest wait between retries.",
+		},
 		cli.StringFlag{
 			Name:  "cache-directory",
 			Value: defaultCacheDirectory,
 			Usage: fmt.Sprintf("Where to cache Arq files for browsing. Default: %s", defaultCacheDirectory),
 		},
-		cli.BoolFlag{
-			Name:  "delete-cache-directory",
-			Usage: "Delete cache directory before starting. Useful if seeing errors that could be due to truncated downloads.",
+		cli.StringFlag{
+			Name:  "cache-max-size",
+			Usage: "Largest the cache directory may grow to, e.g. '20GB'. Least recently used packs and objects are deleted to stay under it. Default: no limit.",
 		},
 		cli.BoolFlag{
 			Name:  "verbose",
@@ -382,6 +776,12 @@ func main() {
 		{
 			Name:  "list-backup-sets",
 			Usage: "List backup sets in this account.",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "all",
+					Usage: "Also list backup sets that can't be read, with the reason why.",
+				},
+			},
 			Action: func(c *cli.Context) {
 				if err := cliSetup(c); err != nil {
 					log.Errorf("%s", err)
@@ -393,7 +793,9 @@ func main() {
 					return
 				}
 				defer connection.Close()
-				if err := listBackupSets(c, connection); err != nil {
+				ctx, stop := withInterrupt(context.Background())
+				defer stop()
+				if err := listBackupSets(ctx, c, connection); err != nil {
 					log.Errorf("%s", err)
 					return
 				}
@@ -407,10 +809,18 @@ func main() {
 					Name:  "backup-set-uuid",
 					Usage: "UUID of backup set. Use 'list-backup-sets' to determine this.",
 				},
+				cli.StringFlag{
+					Name:  "computer",
+					Usage: "Computer name of backup set, or a unique prefix of it. Alternative to backup-set-uuid.",
+				},
 				cli.StringFlag{
 					Name:  "folder-uuid",
 					Usage: "UUID of folder. Use 'list-backup-sets' to determine this.",
 				},
+				cli.StringFlag{
+					Name:  "folder",
+					Usage: "Local path of folder, or a unique prefix of it. Alternative to folder-uuid.",
+				},
 				cli.StringFlag{
 					Name:  "path",
 					Usage: "Path of directory or file in backup",
@@ -427,7 +837,9 @@ func main() {
 					return
 				}
 				defer connection.Close()
-				if err := listDirectoryContents(c, connection); err != nil {
+				ctx, stop := withInterrupt(context.Background())
+				defer stop()
+				if err := listDirectoryContents(ctx, c, connection); err != nil {
 					log.Errorf("%s", err)
 					return
 				}
@@ -441,17 +853,29 @@ func main() {
 					Name:  "backup-set-uuid",
 					Usage: "UUID of backup set. Use 'list-backup-sets' to determine this.",
 				},
+				cli.StringFlag{
+					Name:  "computer",
+					Usage: "Computer name of backup set, or a unique prefix of it. Alternative to backup-set-uuid.",
+				},
 				cli.StringFlag{
 					Name:  "folder-uuid",
 					Usage: "UUID of folder. Use 'list-backup-sets' to determine this.",
 				},
+				cli.StringFlag{
+					Name:  "folder",
+					Usage: "Local path of folder, or a unique prefix of it. Alternative to folder-uuid.",
+				},
 				cli.StringFlag{
 					Name:  "source-path",
 					Usage: "Path of directory or file in backup",
 				},
 				cli.StringFlag{
 					Name:  "destination-path",
-					Usage: "Path to recover directory or file into. Must not already exist.",
+					Usage: "Path to recover directory or file into. Must not already exist, unless resuming.",
+				},
+				cli.BoolFlag{
+					Name:  "resume",
+					Usage: "Carry on with an interrupted recovery into destination-path, skipping files that were already recovered.",
 				},
 			},
 			Action: func(c *cli.Context) {
@@ -465,12 +889,174 @@ func main() {
 					return
 				}
 				defer connection.Close()
-				if err := recover(c, connection); err != nil {
+				ctx, stop := withInterrupt(context.Background())
+				defer stop()
+				if err := recover(ctx, c, connection); err != nil {
 					log.Errorf("%s", err)
 					return
 				}
 			},
 		},
+		{
+			Name:  "shell",
+			Usage: "Interactively browse and restore a folder in a backup. Type 'help' in the shell for commands.",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "backup-set-uuid",
+					Usage: "UUID of backup set. Use 'list-backup-sets' to determine this.",
+				},
+				cli.StringFlag{
+					Name:  "computer",
+					Usage: "Computer name of backup set, or a unique prefix of it. Alternative to backup-set-uuid.",
+				},
+				cli.StringFlag{
+					Name:  "folder-uuid",
+					Usage: "UUID of folder. Use 'list-backup-sets' to determine this.",
+				},
+				cli.StringFlag{
+					Name:  "folder",
+					Usage: "Local path of folder, or a unique prefix of it. Alternative to folder-uuid.",
+				},
+			},
+			Action: func(c *cli.Context) {
+				if err := cliSetup(c); err != nil {
+					log.Errorf("%s", err)
+					return
+				}
+				connection, err := getConnection(c)
+				if err != nil {
+					log.Errorf("%s", err)
+					return
+				}
+				defer connection.Close()
+				if err := runShell(context.Background(), c, connection); err != nil {
+					log.Errorf("%s", err)
+					return
+				}
+			},
+		},
+		{
+			Name:  "serve",
+			Usage: "Serve a read-only web page and JSON API for browsing and downloading from backups.",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "listen",
+					Value: "localhost:8080",
+					Usage: "Address to listen on, e.g. ':8080' for all interfaces. There is no authentication.",
+				},
+			},
+			Action: func(c *cli.Context) {
+				if err := cliSetup(c); err != nil {
+					log.Errorf("%s", err)
+					return
+				}
+				connection, err := getConnection(c)
+				if err != nil {
+					log.Errorf("%s", err)
+					return
+				}
+				defer connection.Close()
+				ctx, stop := withInterrupt(context.Background())
+				defer stop()
+				if err := runServer(ctx, c, connection); err != nil {
+					log.Errorf("%s", err)
+					return
+				}
+			},
+		},
+		{
+			Name:  "webdav",
+			Usage: "Serve the folders of a backup set as a read-only WebDAV share, e.g. to mount in Finder or Windows Explorer.",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "backup-set-uuid",
+					Usage: "UUID of backup set. Use 'list-backup-sets' to determine this.",
+				},
+				cli.StringFlag{
+					Name:  "computer",
+					Usage: "Computer name of backup set, or a unique prefix of it. Alternative to backup-set-uuid.",
+				},
+				cli.StringFlag{
+					Name:  "folder-uuid",
+					Usage: "UUID of folder, to only share this folder.",
+				},
+				cli.StringFlag{
+					Name:  "folder",
+					Usage: "Local path of folder, or a unique prefix of it, to only share this folder.",
+				},
+				cli.StringFlag{
+					Name:  "listen",
+					Value: "localhost:8080",
+					Usage: "Address to listen on, e.g. ':8080' for all interfaces. There is no authentication.",
+				},
+			},
+			Action: func(c *cli.Context) {
+				if err := cliSetup(c); err != nil {
+					log.Errorf("%s", err)
+					return
+				}
+				connection, err := getConnection(c)
+				if err != nil {
+					log.Errorf("%s", err)
+					return
+				}
+				defer connection.Close()
+				ctx, stop := withInterrupt(context.Background())
+				defer stop()
+				if err := runWebDAV(ctx, c, connection); err != nil {
+					log.Errorf("%s", err)
+					return
+				}
+			},
+		},
+		{
+			Name:  "cache",
+			Usage: "Inspect, trim or clear the cache directory.",
+			Subcommands: []cli.Command{
+				{
+					Name:  "stats",
+					Usage: "Show how big the cache directory is and what's in it.",
+					Action: func(c *cli.Context) {
+						if err := settingsSetup(c); err != nil {
+							log.Errorf("%s", err)
+							return
+						}
+						if err := cacheStats(c); err != nil {
+							log.Errorf("%s", err)
+							return
+						}
+					},
+				},
+				{
+					Name:  "prune",
+					Usage: "Delete leftover partial downloads, and least recently used packs and objects until the cache is under --cache-max-size.",
+					Action: func(c *cli.Context) {
+						if err := settingsSetup(c); err != nil {
+							log.Errorf("%s", err)
+							return
+						}
+						if err := cachePrune(c); err != nil {
+							log.Errorf("%s", err)
+							return
+						}
+					},
+				},
+				{
+					Name:  "clear",
+					Usage: "Delete the cache directory. Useful if seeing errors that could be due to corrupt cached files.",
+					Action: func(c *cli.Context) {
+						if err := settingsSetup(c); err != nil {
+							log.Errorf("%s", err)
+							return
+						}
+						if err := cacheClear(c); err != nil {
+							log.Errorf("%s", err)
+							return
+						}
+					},
+				},
+			},
+		},
 	}
 	app.Run(os.Args)
 }
@@ -0,0 +1,267 @@
+/*
+arqinator: progress/progress.go
+Implements a Tracker, which counts planned and completed objects and bytes for long running operations.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package progress
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+var (
+	currentMutex sync.Mutex
+	current      *Tracker
+)
+
+/*
+A Tracker counts how much work is planned and how much has been completed, in both objects (e.g. pack
+indexes, recovered files) and bytes. Whoever plans some work is responsible for completing it.
+
+Separately a Tracker counts bytes transferred by connectors, which is only used to show download
+throughput; it doesn't contribute to the ETA because e.g. a recovered file and the pack files it was
+recovered from are different amounts of bytes.
+
+All methods are safe to call on a nil Tracker, in which case they do nothing.
+*/
+type Tracker struct {
+	Label string
+
+	mutex            sync.Mutex
+	started          time.Time
+	plannedObjects   int64
+	completedObjects int64
+	plannedBytes     int64
+	completedBytes   int64
+	transferredBytes int64
+}
+
+func NewTracker(label string) *Tracker {
+	return &Tracker{
+		Label:   label,
+		started: time.Now(),
+	}
+}
+
+func (t *Tracker) String() string {
+	if t == nil {
+		return "<nil>"
+	}
+	return fmt.Sprintf("{Tracker: %s}", t.Snapshot())
+}
+
+/*
+Set the tracker that connectors and restores report into. Pass nil to stop reporting.
+*/
+func SetCurrent(t *Tracker) {
+	currentMutex.Lock()
+	defer currentMutex.Unlock()
+	current = t
+}
+
+/*
+Get the tracker that connectors and restores report into. May be nil.
+*/
+func Current() *Tracker {
+	currentMutex.Lock()
+	defer currentMutex.Unlock()
+	return current
+}
+
+func (t *Tracker) Plan(objects int64, bytes int64) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.plannedObjects += objects
+	t.plannedBytes += bytes
+}
+
+func (t *Tracker) Complete(objects int64, bytes int64) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.completedObjects += objects
+	t.completedBytes += bytes
+}
+
+func (t *Tracker) Transferred(bytes int64) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.transferredBytes += bytes
+}
+
+func (t *Tracker) Snapshot() Snapshot {
+	if t == nil {
+		return Snapshot{}
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return Snapshot{
+		Label:            t.Label,
+		Elapsed:          time.Since(t.started),
+		PlannedObjects:   t.plannedObjects,
+		CompletedObjects: t.completedObjects,
+		PlannedBytes:     t.plannedBytes,
+		CompletedBytes:   t.completedBytes,
+		TransferredBytes: t.transferredBytes,
+	}
+}
+
+/*
+A point-in-time copy of a Tracker's counters.
+*/
+type Snapshot struct {
+	Label            string
+	Elapsed          time.Duration
+	PlannedObjects   int64
+	CompletedObjects int64
+	PlannedBytes     int64
+	CompletedBytes   int64
+	TransferredBytes int64
+}
+
+func (s Snapshot) String() string {
+	return fmt.Sprintf("{Snapshot: Label=%s, Elapsed=%s, Objects=%d/%d, Bytes=%d/%d, TransferredBytes=%d}",
+		s.Label, s.Elapsed, s.CompletedObjects, s.PlannedObjects, s.CompletedBytes, s.PlannedBytes,
+		s.TransferredBytes)
+}
+
+/*
+Completed bytes per second since the tracker was created.
+*/
+func (s Snapshot) Throughput() float64 {
+	seconds := s.Elapsed.Seconds()
+	if seconds <= 0 {
+		return 0
+	}
+	return float64(s.CompletedBytes) / seconds
+}
+
+/*
+Transferred bytes per second since the tracker was created.
+*/
+func (s Snapshot) TransferThroughput() float64 {
+	seconds := s.Elapsed.Seconds()
+	if seconds <= 0 {
+		return 0
+	}
+	return float64(s.TransferredBytes) / seconds
+}
+
+/*
+Fraction of planned work that is complete, between 0 and 1. Uses bytes if any bytes are planned,
+otherwise objects.
+*/
+func (s Snapshot) Fraction() float64 {
+	var fraction float64
+	if s.PlannedBytes > 0 {
+		fraction = float64(s.CompletedBytes) / float64(s.PlannedBytes)
+	} else if s.PlannedObjects > 0 {
+		fraction = float64(s.CompletedObjects) / float64(s.PlannedObjects)
+	}
+	if fraction > 1 {
+		fraction = 1
+	}
+	return fraction
+}
+
+/*
+Estimated time remaining, and whether an estimate is possible yet.
+*/
+func (s Snapshot) ETA() (time.Duration, bool) {
+	fraction := s.Fraction()
+	if fraction <= 0 || s.Elapsed <= 0 {
+		return 0, false
+	}
+	total := time.Duration(float64(s.Elapsed) / fraction)
+	return total - s.Elapsed, true
+}
+
+type trackingWriter struct {
+	w io.Writer
+	t *Tracker
+}
+
+func (tw trackingWriter) Write(p []byte) (int, error) {
+	n, err := tw.w.Write(p)
+	tw.t.Complete(0, int64(n))
+	return n, err
+}
+
+/*
+Wrap a writer such that every byte written counts as a completed byte. Useful for writing out
+recovered files.
+*/
+func NewCompletingWriter(w io.Writer, t *Tracker) io.Writer {
+	if t == nil {
+		return w
+	}
+	return trackingWriter{w: w, t: t}
+}
+
+type transferWriter struct {
+	w io.Writer
+	t *Tracker
+}
+
+func (tw transferWriter) Write(p []byte) (int, error) {
+	n, err := tw.w.Write(p)
+	tw.t.Transferred(int64(n))
+	return n, err
+}
+
+/*
+Wrap a writer such that every byte written counts as a transferred byte. Used by connectors when
+downloading into the cache.
+*/
+func NewTransferWriter(w io.Writer, t *Tracker) io.Writer {
+	if t == nil {
+		return w
+	}
+	return transferWriter{w: w, t: t}
+}
+
+type transferWriterAt struct {
+	w io.WriterAt
+	t *Tracker
+}
+
+func (tw transferWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	n, err := tw.w.WriteAt(p, off)
+	tw.t.Transferred(int64(n))
+	return n, err
+}
+
+/*
+Same as NewTransferWriter, but for connectors that download ranges concurrently.
+*/
+func NewTransferWriterAt(w io.WriterAt, t *Tracker) io.WriterAt {
+	if t == nil {
+		return w
+	}
+	return transferWriterAt{w: w, t: t}
+}
@@ -0,0 +1,161 @@
+/*
+arqinator: progress/reporter.go
+Implements a Reporter, which periodically renders a Tracker as a terminal progress bar or log lines.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package progress
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/dustin/go-humanize"
+)
+
+const (
+	BAR_REFRESH_INTERVAL time.Duration = time.Duration(200 * time.Millisecond)
+	LOG_REFRESH_INTERVAL time.Duration = time.Duration(10 * time.Second)
+	BAR_WIDTH                          = 30
+)
+
+type Reporter struct {
+	tracker    *Tracker
+	out        *os.File
+	isTerminal bool
+	done       chan struct{}
+	finished   chan struct{}
+	lastWidth  int
+}
+
+/*
+If f is a terminal then we can draw a live progress bar on it, else we fall back to periodic log lines.
+*/
+func IsTerminal(f *os.File) bool {
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fileInfo.Mode()&os.ModeCharDevice != 0
+}
+
+/*
+Make t the current tracker and start rendering it. If stdout is a terminal a live bar is drawn on it,
+otherwise a log line is written every LOG_REFRESH_INTERVAL. Callers must call Stop when done.
+*/
+func StartReporter(t *Tracker) *Reporter {
+	r := &Reporter{
+		tracker:    t,
+		out:        os.Stdout,
+		isTerminal: IsTerminal(os.Stdout),
+		done:       make(chan struct{}),
+		finished:   make(chan struct{}),
+	}
+	SetCurrent(t)
+	go r.run()
+	return r
+}
+
+func (r *Reporter) run() {
+	defer close(r.finished)
+	interval := LOG_REFRESH_INTERVAL
+	if r.isTerminal {
+		interval = BAR_REFRESH_INTERVAL
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.render()
+		case <-r.done:
+			return
+		}
+	}
+}
+
+func (r *Reporter) render() {
+	snapshot := r.tracker.Snapshot()
+	if !r.isTerminal {
+		log.Printf("%s", FormatLine(snapshot))
+		return
+	}
+	line := FormatBar(snapshot)
+	padding := ""
+	if r.lastWidth > len(line) {
+		padding = strings.Repeat(" ", r.lastWidth-len(line))
+	}
+	r.lastWidth = len(line)
+	fmt.Fprintf(r.out, "\r%s%s", line, padding)
+}
+
+/*
+Stop rendering, print a final summary, and clear the current tracker.
+*/
+func (r *Reporter) Stop() {
+	close(r.done)
+	<-r.finished
+	SetCurrent(nil)
+	snapshot := r.tracker.Snapshot()
+	if r.isTerminal {
+		fmt.Fprintf(r.out, "\r%s\r", strings.Repeat(" ", r.lastWidth))
+	}
+	log.Printf("%s", FormatLine(snapshot))
+}
+
+func formatCounts(s Snapshot) string {
+	objects := fmt.Sprintf("%d/%d", s.CompletedObjects, s.PlannedObjects)
+	bytes := fmt.Sprintf("%s/%s", humanize.Bytes(uint64(s.CompletedBytes)), humanize.Bytes(uint64(s.PlannedBytes)))
+	rate := fmt.Sprintf("%s/s", humanize.Bytes(uint64(s.Throughput())))
+	result := fmt.Sprintf("%s objects, %s, %s", objects, bytes, rate)
+	if s.TransferredBytes > 0 {
+		result += fmt.Sprintf(", downloaded %s at %s/s", humanize.Bytes(uint64(s.TransferredBytes)),
+			humanize.Bytes(uint64(s.TransferThroughput())))
+	}
+	return result
+}
+
+func formatETA(s Snapshot) string {
+	eta, ok := s.ETA()
+	if !ok {
+		return "ETA unknown"
+	}
+	return fmt.Sprintf("ETA %s", eta.Round(time.Second))
+}
+
+/*
+e.g. "Recovering [=========>          ] 32% 12/40 objects, 1.2 GB/3.6 GB, 12 MB/s, ETA 3m20s"
+*/
+func FormatBar(s Snapshot) string {
+	fraction := s.Fraction()
+	filled := int(fraction * BAR_WIDTH)
+	bar := strings.Repeat("=", filled)
+	if filled < BAR_WIDTH {
+		bar += ">" + strings.Repeat(" ", BAR_WIDTH-filled-1)
+	}
+	return fmt.Sprintf("%s [%s] %3.0f%% %s, %s", s.Label, bar, fraction*100, formatCounts(s), formatETA(s))
+}
+
+/*
+e.g. "Recovering: 32% complete, 12/40 objects, 1.2 GB/3.6 GB, 12 MB/s, elapsed 1m30s, ETA 3m20s"
+*/
+func FormatLine(s Snapshot) string {
+	return fmt.Sprintf("%s: %.0f%% complete, %s, elapsed %s, %s", s.Label, s.Fraction()*100, formatCounts(s),
+		s.Elapsed.Round(time.Second), formatETA(s))
+}
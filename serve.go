@@ -0,0 +1,645 @@
+/*
+arqinator: serve.go
+Implements a read-only HTTP server for browsing and downloading from backups.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+/*
+The server has the same URLs for HTML pages and, under /api, for JSON:
+
+	/                                                   backup sets and their folders
+	/browse/<backup set UUID>/<folder UUID>/            commits of a folder, newest first
+	/browse/<backup set UUID>/<folder UUID>/<commit>/   top of the folder as backed up by a commit
+
+<commit> is a snapshot ID or 'latest'. A file below a commit is downloaded, with Range support, and a
+directory is downloaded as an archive with '?archive=zip' or '?archive=tar'. Under /api a file is
+described rather than downloaded.
+
+Backup sets are read once when the server starts, so restart it to see newer backups. Requests read
+snapshots and files concurrently, as the arq package allows, and only take turns to look up or remember
+the snapshots of a folder.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	"github.com/dustin/go-humanize"
+
+	"github.com/asimihsan/arqinator/arq"
+	"github.com/asimihsan/arqinator/connector"
+)
+
+const (
+	SERVE_API_PREFIX    = "/api"
+	SERVE_BROWSE_PREFIX = "/browse/"
+	SERVE_LATEST_COMMIT = "latest"
+)
+
+var serveTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+td { padding: 0.2em 1em 0.2em 0; }
+.detail { color: #666; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{if .Parent}}<p><a href="{{.Parent}}">Up</a></p>{{end}}
+{{if .Archives}}<p>Download as {{range $i, $a := .Archives}}{{if $i}}, {{end}}<a href="{{$a.Href}}">{{$a.Name}}</a>{{end}}</p>{{end}}
+<table>
+{{range .Rows}}<tr><td><a href="{{.Href}}">{{.Name}}</a></td>{{range .Details}}<td class="detail">{{.}}</td>{{end}}</tr>
+{{else}}<tr><td>Nothing here.</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+type servePage struct {
+	Title    string
+	Parent   string
+	Archives []serveLink
+	Rows     []serveRow
+}
+
+type serveLink struct {
+	Name string
+	Href string
+}
+
+type serveRow struct {
+	Name    string
+	Href    string
+	Details []string
+}
+
+type apiBackupSet struct {
+	UUID         string      `json:"uuid"`
+	ComputerName string      `json:"computer_name"`
+	UserName     string      `json:"user_name"`
+	Format       string      `json:"format"`
+	Folders      []apiFolder `json:"folders"`
+}
+
+type apiFolder struct {
+	UUID      string `json:"uuid"`
+	LocalPath string `json:"local_path"`
+}
+
+type apiCommit struct {
+	ID           string    `json:"id"`
+	CreationDate time.Time `json:"creation_date"`
+	Path         string    `json:"path"`
+	IsComplete   bool      `json:"is_complete"`
+}
+
+type apiEntry struct {
+	Name             string    `json:"name"`
+	IsDirectory      bool      `json:"is_directory"`
+	Size             int64     `json:"size"`
+	Mode             string    `json:"mode"`
+	ModificationTime time.Time `json:"modification_time"`
+}
+
+type apiDirectory struct {
+	Commit  apiCommit  `json:"commit"`
+	Path    string     `json:"path"`
+	Entries []apiEntry `json:"entries"`
+}
+
+type server struct {
+	repository *arq.Repository
+
+	// Guards the maps below, which are keyed by folder UUID
+	mutex           sync.Mutex
+	latestSnapshots map[string]*arq.Snapshot
+	snapshots       map[string][]*arq.Snapshot
+}
+
+func runServer(ctx context.Context, c *cli.Context, connection connector.Connection) error {
+	repository, err := openRepository(ctx, c, connection)
+	if err != nil {
+		log.Errorf("Failed to get backup sets: %s", err)
+		return err
+	}
+	s := &server{
+		repository:      repository,
+		latestSnapshots: make(map[string]*arq.Snapshot),
+		snapshots:       make(map[string][]*arq.Snapshot),
+	}
+	listen := c.String("listen")
+	log.Printf("Serving backups on http://%s/", listen)
+	return listenAndServe(ctx, listen, s)
+}
+
+/*
+Serve until ctx is done. Requests have their own contexts, so reading stops when a client goes away.
+*/
+func listenAndServe(ctx context.Context, listen string, handler http.Handler) error {
+	httpServer := &http.Server{Addr: listen, Handler: handler}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			httpServer.Close()
+		case <-stop:
+		}
+	}()
+	err := httpServer.ListenAndServe()
+	if err == http.ErrServerClosed && ctx.Err() != nil {
+		log.Printf("Stopped serving.")
+		return nil
+	}
+	return err
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	log.Debugf("serve %s %s", r.Method, r.URL)
+
+	p := r.URL.Path
+	isAPI := p == SERVE_API_PREFIX || strings.HasPrefix(p, SERVE_API_PREFIX+"/")
+	if isAPI {
+		p = strings.TrimPrefix(p, SERVE_API_PREFIX)
+	}
+	switch {
+	case p == "/" || p == "":
+		s.serveBackupSets(w, r, isAPI)
+	case strings.HasPrefix(p, SERVE_BROWSE_PREFIX):
+		s.serveBrowse(w, r, isAPI, strings.TrimPrefix(p, SERVE_BROWSE_PREFIX))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *server) serveBackupSets(w http.ResponseWriter, r *http.Request, isAPI bool) {
+	backupSets := s.repository.BackupSets()
+	folders := s.repository.Folders()
+	if isAPI {
+		result := make([]apiBackupSet, 0)
+		for _, backupSet := range backupSets {
+			folders := make([]apiFolder, 0)
+			for _, bucket := range backupSet.Buckets {
+				folders = append(folders, apiFolder{UUID: bucket.UUID, LocalPath: bucket.LocalPath})
+			}
+			result = append(result, apiBackupSet{
+				UUID:         backupSet.UUID,
+				ComputerName: backupSet.ComputerInfo.ComputerName,
+				UserName:     backupSet.ComputerInfo.UserName,
+				Format:       backupSet.FormatVersion(),
+				Folders:      folders,
+			})
+		}
+		writeJSON(w, result)
+		return
+	}
+	page := servePage{Title: "Backup sets"}
+	for _, folder := range folders {
+		page.Rows = append(page.Rows, serveRow{
+			Name:    fmt.Sprintf("%s: %s", folder.ComputerName, folder.LocalPath),
+			Href:    SERVE_BROWSE_PREFIX + folder.BackupSet.UUID + "/" + folder.UUID + "/",
+			Details: []string{folder.BackupSet.FormatVersion(), folder.BackupSet.UUID},
+		})
+	}
+	writePage(w, page)
+}
+
+/*
+rest is the path after /browse/, i.e. <backup set UUID>/<folder UUID>/<commit>/<path>.
+*/
+func (s *server) serveBrowse(w http.ResponseWriter, r *http.Request, isAPI bool, rest string) {
+	parts := strings.SplitN(rest, "/", 4)
+	if len(parts) < 2 {
+		http.NotFound(w, r)
+		return
+	}
+	folder := s.findFolder(parts[0], parts[1])
+	if folder == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if len(parts) == 2 {
+		redirectToDirectory(w, r)
+		return
+	}
+	if parts[2] == "" {
+		s.serveSnapshots(w, r, isAPI, folder)
+		return
+	}
+	p := "/"
+	if len(parts) == 4 {
+		p = path.Clean("/" + parts[3])
+	}
+	snapshot, file, err := s.stat(r.Context(), folder, parts[2], p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if !file.IsDir() {
+		if isAPI {
+			writeJSON(w, newAPIEntry(file))
+			return
+		}
+		s.serveFile(w, r, snapshot, file)
+		return
+	}
+	if !isAPI && !strings.HasSuffix(r.URL.Path, "/") {
+		redirectToDirectory(w, r)
+		return
+	}
+	if format := r.URL.Query().Get("archive"); format != "" {
+		s.serveArchive(r.Context(), w, snapshot, file, format)
+		return
+	}
+	s.serveDirectory(r.Context(), w, isAPI, snapshot, file)
+}
+
+/*
+Directory pages link to their entries relative to themselves, so their URLs must end in a slash.
+*/
+func redirectToDirectory(w http.ResponseWriter, r *http.Request) {
+	location := url.URL{Path: r.URL.Path + "/", RawQuery: r.URL.RawQuery}
+	http.Redirect(w, r, location.String(), http.StatusMovedPermanently)
+}
+
+func (s *server) findFolder(backupSetUUID string, folderUUID string) *arq.Folder {
+	for _, folder := range s.repository.Folders() {
+		if folder.BackupSet.UUID == backupSetUUID && folder.UUID == folderUUID {
+			return folder
+		}
+	}
+	return nil
+}
+
+func (s *server) stat(ctx context.Context, folder *arq.Folder, id string, p string) (*arq.Snapshot, *arq.File, error) {
+	snapshot, err := s.findSnapshot(ctx, folder, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := snapshot.Stat(ctx, p)
+	if err != nil {
+		return nil, nil, err
+	}
+	return snapshot, file, nil
+}
+
+/*
+Requests that ask at once may both list the snapshots, but only the first list is kept, so that every
+request sees the same snapshots and the trees read from them.
+*/
+func (s *server) loadSnapshots(ctx context.Context, folder *arq.Folder) ([]*arq.Snapshot, error) {
+	s.mutex.Lock()
+	snapshots, ok := s.snapshots[folder.UUID]
+	s.mutex.Unlock()
+	if ok {
+		return snapshots, nil
+	}
+	snapshots, err := folder.Snapshots(ctx)
+	if err != nil {
+		log.Debugf("server failed to list snapshots of %s: %s", folder.LocalPath, err)
+		return nil, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if kept, ok := s.snapshots[folder.UUID]; ok {
+		return kept, nil
+	}
+	s.snapshots[folder.UUID] = snapshots
+	return snapshots, nil
+}
+
+/*
+Snapshots are kept, along with the trees read from them, for the life of the server.
+*/
+func (s *server) findSnapshot(ctx context.Context, folder *arq.Folder, id string) (*arq.Snapshot, error) {
+	if id == SERVE_LATEST_COMMIT {
+		s.mutex.Lock()
+		snapshot, ok := s.latestSnapshots[folder.UUID]
+		s.mutex.Unlock()
+		if ok {
+			return snapshot, nil
+		}
+		snapshot, err := folder.Latest(ctx)
+		if err != nil {
+			return nil, err
+		}
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if kept, ok := s.latestSnapshots[folder.UUID]; ok {
+			return kept, nil
+		}
+		s.latestSnapshots[folder.UUID] = snapshot
+		return snapshot, nil
+	}
+	snapshots, err := s.loadSnapshots(ctx, folder)
+	if err != nil {
+		return nil, err
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.ID == id {
+			return snapshot, nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("no commit %s of %s", id, folder.LocalPath))
+}
+
+func (s *server) serveSnapshots(w http.ResponseWriter, r *http.Request, isAPI bool, folder *arq.Folder) {
+	snapshots, err := s.loadSnapshots(r.Context(), folder)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if isAPI {
+		result := make([]apiCommit, 0)
+		for _, snapshot := range snapshots {
+			result = append(result, newAPICommit(snapshot))
+		}
+		writeJSON(w, result)
+		return
+	}
+	page := servePage{
+		Title:  fmt.Sprintf("%s: %s", folder.ComputerName, folder.LocalPath),
+		Parent: "/",
+		Rows:   []serveRow{{Name: SERVE_LATEST_COMMIT, Href: SERVE_LATEST_COMMIT + "/"}},
+	}
+	for _, snapshot := range snapshots {
+		row := serveRow{
+			Name:    snapshot.CreationDate.Format("2006-01-02 15:04:05 MST"),
+			Href:    url.PathEscape(snapshot.ID) + "/",
+			Details: []string{snapshot.ID},
+		}
+		if !snapshot.IsComplete {
+			row.Details = append(row.Details, "incomplete")
+		}
+		page.Rows = append(page.Rows, row)
+	}
+	writePage(w, page)
+}
+
+func (s *server) serveDirectory(ctx context.Context, w http.ResponseWriter, isAPI bool, snapshot *arq.Snapshot, directory *arq.File) {
+	files, err := snapshot.ReadDir(ctx, directory.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if isAPI {
+		result := apiDirectory{Commit: newAPICommit(snapshot), Path: directory.Path, Entries: make([]apiEntry, 0)}
+		for _, file := range files {
+			result.Entries = append(result.Entries, newAPIEntry(file))
+		}
+		writeJSON(w, result)
+		return
+	}
+	page := servePage{
+		Title:  path.Join(snapshot.Path, directory.Path),
+		Parent: "../",
+		Archives: []serveLink{
+			{Name: "zip", Href: "?archive=zip"},
+			{Name: "tar", Href: "?archive=tar"},
+		},
+	}
+	for _, file := range files {
+		// "./" stops a name with a colon being taken for a URL scheme.
+		row := serveRow{Name: file.Name, Href: "./" + url.PathEscape(file.Name)}
+		if file.IsDir() {
+			row.Name += "/"
+			row.Href += "/"
+		}
+		row.Details = []string{
+			humanize.Bytes(uint64(file.Size)),
+			file.ModTime.Format("2006-01-02 15:04:05 MST"),
+		}
+		page.Rows = append(page.Rows, row)
+	}
+	writePage(w, page)
+}
+
+/*
+http.ServeContent takes care of Range and conditional requests.
+*/
+func (s *server) serveFile(w http.ResponseWriter, r *http.Request, snapshot *arq.Snapshot, file *arq.File) {
+	reader, err := snapshot.Open(r.Context(), file.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Set the type up front, otherwise http.ServeContent reads the start of the file to guess it.
+	contentType := mime.TypeByExtension(path.Ext(file.Name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, file.Name, file.ModTime, reader)
+}
+
+/*
+Stream a directory as a zip or tar file. Headers are sent before the backup is read, so an error part
+way through can only be logged, and the client sees a truncated archive.
+*/
+func (s *server) serveArchive(ctx context.Context, w http.ResponseWriter, snapshot *arq.Snapshot, directory *arq.File, format string) {
+	var archive archiveWriter
+	switch format {
+	case "zip":
+		w.Header().Set("Content-Type", "application/zip")
+		archive = &zipArchive{zip.NewWriter(w)}
+	case "tar":
+		w.Header().Set("Content-Type", "application/x-tar")
+		archive = &tarArchive{tar.NewWriter(w)}
+	default:
+		http.Error(w, fmt.Sprintf("unknown archive format %s, use zip or tar", format), http.StatusBadRequest)
+		return
+	}
+	files, err := s.listArchive(ctx, snapshot, directory)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	name := directory.Name
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": name + "." + format}))
+
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			log.Errorf("serve failed to archive %s: %s", directory.Path, err)
+			return
+		}
+		archiveName := path.Join(name, strings.TrimPrefix(file.Path, directory.Path))
+		if file.IsDir() {
+			err = archive.addDirectory(archiveName, file)
+		} else if reader, openErr := snapshot.Open(ctx, file.Path); openErr != nil {
+			log.Warnf("serve leaving %s out of archive: %s", file.Path, openErr)
+			continue
+		} else {
+			err = archive.addFile(archiveName, file, reader)
+		}
+		if err != nil {
+			log.Errorf("serve failed to archive %s: %s", directory.Path, err)
+			return
+		}
+	}
+	if err := archive.Close(); err != nil {
+		log.Errorf("serve failed to finish archive of %s: %s", directory.Path, err)
+	}
+}
+
+/*
+The files and directories below directory, read before anything is sent so that an error listing them
+is a proper error response. Those that can't be read are left out with a warning, like 'recover' does.
+*/
+func (s *server) listArchive(ctx context.Context, snapshot *arq.Snapshot, directory *arq.File) ([]*arq.File, error) {
+	if err := snapshot.Folder.CacheBlobs(ctx); err != nil {
+		return nil, err
+	}
+	files := make([]*arq.File, 0)
+	err := snapshot.Walk(ctx, directory.Path, func(file *arq.File, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			log.Warnf("serve leaving %s out of archive: %s", file.Path, err)
+			return nil
+		}
+		if file.Path != directory.Path {
+			files = append(files, file)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Debugf("serve failed to list %s for archive: %s", directory.Path, err)
+		return nil, err
+	}
+	return files, nil
+}
+
+type archiveWriter interface {
+	addDirectory(name string, file *arq.File) error
+	addFile(name string, file *arq.File, r io.Reader) error
+	Close() error
+}
+
+type zipArchive struct {
+	*zip.Writer
+}
+
+func (a *zipArchive) addDirectory(name string, file *arq.File) error {
+	header := &zip.FileHeader{Name: name + "/"}
+	header.SetModTime(file.ModTime)
+	header.SetMode(file.Mode)
+	_, err := a.CreateHeader(header)
+	return err
+}
+
+func (a *zipArchive) addFile(name string, file *arq.File, r io.Reader) error {
+	header := &zip.FileHeader{Name: name, Method: zip.Deflate}
+	header.SetModTime(file.ModTime)
+	header.SetMode(file.Mode)
+	w, err := a.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+type tarArchive struct {
+	*tar.Writer
+}
+
+func (a *tarArchive) addDirectory(name string, file *arq.File) error {
+	return a.WriteHeader(&tar.Header{
+		Name:     name + "/",
+		Typeflag: tar.TypeDir,
+		Mode:     int64(file.Mode.Perm()),
+		ModTime:  file.ModTime,
+	})
+}
+
+func (a *tarArchive) addFile(name string, file *arq.File, r io.Reader) error {
+	err := a.WriteHeader(&tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     int64(file.Mode.Perm()),
+		Size:     file.Size,
+		ModTime:  file.ModTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(a, r)
+	return err
+}
+
+func newAPICommit(snapshot *arq.Snapshot) apiCommit {
+	return apiCommit{
+		ID:           snapshot.ID,
+		CreationDate: snapshot.CreationDate,
+		Path:         snapshot.Path,
+		IsComplete:   snapshot.IsComplete,
+	}
+}
+
+func newAPIEntry(file *arq.File) apiEntry {
+	return apiEntry{
+		Name:             file.Name,
+		IsDirectory:      file.IsDir(),
+		Size:             file.Size,
+		Mode:             fmt.Sprintf("%04o", uint32(file.Mode.Perm())),
+		ModificationTime: file.ModTime,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+	w.Write([]byte("\n"))
+}
+
+func writePage(w http.ResponseWriter, page servePage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := serveTemplate.Execute(w, page); err != nil {
+		log.Errorf("serve failed to render page %s: %s", page.Title, err)
+	}
+}
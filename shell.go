@@ -0,0 +1,557 @@
+/*
+arqinator: shell.go
+Implements an interactive shell for browsing and restoring a backed up folder.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+/*
+The shell keeps one connection, the cached pack sets and the snapshot it has checked out, with the
+trees it has already read, so that browsing doesn't re-list backup sets for every command. Paths in the
+shell are relative to the top of the backed up folder, which is "/".
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/asimihsan/arqinator/arq"
+	"github.com/asimihsan/arqinator/connector"
+	"github.com/asimihsan/arqinator/progress"
+)
+
+const (
+	SHELL_HELP = `Commands:
+    cd [path]                 change directory, to the top of the folder if no path
+    ls [-l] [path]            list directory contents, with details if -l
+    find [path] [pattern]     list files recursively, optionally only names matching a glob pattern
+    cat <path>                print a file
+    get <path> [destination]  restore a file or directory, by default into the current local directory
+    commits                   list backups of this folder, newest first
+    checkout <commit|latest>  browse the backup with this ID, or a unique prefix of it
+    pwd                       print current directory
+    help                      print this help
+    exit                      leave the shell`
+)
+
+var shellCommands = []string{"cat", "cd", "checkout", "commits", "exit", "find", "get", "help", "ls", "pwd", "quit"}
+
+type shell struct {
+	folder   *arq.Folder
+	snapshot *arq.Snapshot
+	cwd      string
+
+	// Loaded by the first 'commits' or 'checkout'
+	snapshots []*arq.Snapshot
+
+	hasCachedBlobPackSets bool
+}
+
+/*
+Ctrl-C stops the command that's running rather than the shell.
+*/
+func runShell(ctx context.Context, c *cli.Context, connection connector.Connection) error {
+	startCtx, stop := withInterrupt(ctx)
+	s, err := newShell(startCtx, c, connection)
+	stop()
+	if err != nil {
+		return err
+	}
+
+	readLine := s.getLineReader()
+	for {
+		line, err := readLine()
+		if err == io.EOF {
+			fmt.Println()
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		args, err := splitShellArgs(line)
+		if err != nil {
+			fmt.Printf("%s\n", err)
+			continue
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if args[0] == "exit" || args[0] == "quit" {
+			return nil
+		}
+		commandCtx, stop := withInterrupt(ctx)
+		err = s.run(commandCtx, args)
+		stop()
+		if err != nil {
+			fmt.Printf("%s: %s\n", args[0], err)
+		}
+	}
+}
+
+/*
+Start in the latest snapshot of the folder chosen by the command flags.
+*/
+func newShell(ctx context.Context, c *cli.Context, connection connector.Connection) (*shell, error) {
+	snapshot, err := findLatestSnapshot(ctx, c, connection, false)
+	if err != nil {
+		return nil, err
+	}
+	s := &shell{folder: snapshot.Folder}
+	if err := s.checkout(ctx, snapshot); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+/*
+Only put the terminal into raw mode while reading a line, so that commands can print as usual. If stdin
+isn't a terminal, e.g. commands are piped in, read plain lines.
+*/
+func (s *shell) getLineReader() func() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		scanner := bufio.NewScanner(os.Stdin)
+		return func() (string, error) {
+			if !scanner.Scan() {
+				if err := scanner.Err(); err != nil {
+					return "", err
+				}
+				return "", io.EOF
+			}
+			return scanner.Text(), nil
+		}
+	}
+	term := terminal.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, "")
+	term.AutoCompleteCallback = s.complete
+	return func() (string, error) {
+		oldState, err := terminal.MakeRaw(fd)
+		if err != nil {
+			return "", err
+		}
+		defer terminal.Restore(fd, oldState)
+		term.SetPrompt(s.prompt())
+		return term.ReadLine()
+	}
+}
+
+func (s *shell) prompt() string {
+	return fmt.Sprintf("%s:%s%s> ", s.folder.ComputerName, strings.TrimSuffix(s.snapshot.Path, "/"), s.cwd)
+}
+
+func (s *shell) run(ctx context.Context, args []string) error {
+	switch args[0] {
+	case "help":
+		fmt.Println(SHELL_HELP)
+	case "pwd":
+		fmt.Println(s.cwd)
+	case "cd":
+		return s.cd(ctx, args[1:])
+	case "ls":
+		return s.ls(ctx, args[1:])
+	case "find":
+		return s.find(ctx, args[1:])
+	case "cat":
+		return s.cat(ctx, args[1:])
+	case "get":
+		return s.get(ctx, args[1:])
+	case "commits":
+		return s.listCommits(ctx)
+	case "checkout":
+		if len(args) != 2 {
+			return errors.New("usage: checkout <commit|latest>")
+		}
+		snapshot, err := s.findSnapshot(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		return s.checkout(ctx, snapshot)
+	default:
+		return errors.New("unknown command, try 'help'")
+	}
+	return nil
+}
+
+func (s *shell) checkout(ctx context.Context, snapshot *arq.Snapshot) error {
+	if _, err := snapshot.Stat(ctx, "/"); err != nil {
+		log.Debugf("shell checkout failed to read snapshot %s: %s", snapshot.ID, err)
+		return err
+	}
+	s.snapshot = snapshot
+	// Stay in the same directory if it was backed up by this snapshot too.
+	if s.cwd == "" {
+		s.cwd = "/"
+	} else if file, err := snapshot.Stat(ctx, s.cwd); err != nil || !file.IsDir() {
+		s.cwd = "/"
+	}
+	return nil
+}
+
+func (s *shell) resolve(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		p = path.Join(s.cwd, p)
+	}
+	return path.Clean("/" + p)
+}
+
+func (s *shell) cd(ctx context.Context, args []string) error {
+	target := "/"
+	if len(args) > 0 {
+		target = args[0]
+	}
+	file, err := s.snapshot.Stat(ctx, s.resolve(target))
+	if err != nil {
+		return err
+	}
+	if !file.IsDir() {
+		return errors.New(fmt.Sprintf("%s: not a directory", target))
+	}
+	s.cwd = file.Path
+	return nil
+}
+
+func (s *shell) ls(ctx context.Context, args []string) error {
+	isLong := false
+	target := "."
+	for _, arg := range args {
+		if arg == "-l" {
+			isLong = true
+		} else {
+			target = arg
+		}
+	}
+	file, err := s.snapshot.Stat(ctx, s.resolve(target))
+	if err != nil {
+		return err
+	}
+	files := []*arq.File{file}
+	if file.IsDir() {
+		if files, err = s.snapshot.ReadDir(ctx, file.Path); err != nil {
+			return err
+		}
+	}
+	if isLong {
+		printFiles(files)
+		return nil
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			fmt.Printf("%s/\n", f.Name)
+		} else {
+			fmt.Printf("%s\n", f.Name)
+		}
+	}
+	return nil
+}
+
+func (s *shell) find(ctx context.Context, args []string) error {
+	target := "."
+	pattern := ""
+	if len(args) > 0 {
+		target = args[0]
+	}
+	if len(args) > 1 {
+		pattern = args[1]
+		if _, err := path.Match(pattern, ""); err != nil {
+			return err
+		}
+	}
+	root := s.resolve(target)
+	return s.snapshot.Walk(ctx, root, func(file *arq.File, err error) error {
+		if err != nil {
+			if file.Path == root {
+				return err
+			}
+			fmt.Printf("find: %s: %s\n", file.Path, err)
+			return nil
+		}
+		if file.Path == root {
+			if !file.IsDir() {
+				return errors.New(fmt.Sprintf("%s: not a directory", target))
+			}
+			return nil
+		}
+		if matched, _ := path.Match(pattern, file.Name); pattern == "" || matched {
+			fmt.Println(file.Path)
+		}
+		return nil
+	})
+}
+
+func (s *shell) cacheBlobPackSets(ctx context.Context) error {
+	if s.hasCachedBlobPackSets {
+		return nil
+	}
+	log.Printf("Caching blob pack sets. If this is your first run, will take a few minutes...")
+	reporter := progress.StartReporter(progress.NewTracker("Caching blob pack sets"))
+	err := s.folder.CacheBlobs(ctx)
+	reporter.Stop()
+	if err != nil {
+		return err
+	}
+	s.hasCachedBlobPackSets = true
+	return nil
+}
+
+func (s *shell) cat(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: cat <path>")
+	}
+	r, err := s.snapshot.Open(ctx, s.resolve(args[0]))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(os.Stdout, r)
+	return err
+}
+
+func (s *shell) get(ctx context.Context, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: get <path> [destination]")
+	}
+	sourcePath := s.resolve(args[0])
+	destinationPath := path.Base(sourcePath)
+	if sourcePath == "/" {
+		destinationPath = path.Base(s.snapshot.Path)
+	}
+	if len(args) == 2 {
+		destinationPath = args[1]
+	}
+	if _, err := os.Stat(destinationPath); err == nil {
+		return errors.New(fmt.Sprintf("Destination path %s already exists, won't overwrite.", destinationPath))
+	}
+	file, err := s.snapshot.Stat(ctx, sourcePath)
+	if err != nil {
+		return err
+	}
+	// A single file's blobs are found as they're needed, a directory usually needs most of them.
+	if file.IsDir() {
+		if err := s.cacheBlobPackSets(ctx); err != nil {
+			return err
+		}
+	}
+	if err := restore(ctx, s.snapshot, sourcePath, destinationPath); err != nil {
+		return err
+	}
+	fmt.Printf("Restored %s to %s\n", sourcePath, destinationPath)
+	return nil
+}
+
+func (s *shell) loadSnapshots(ctx context.Context) error {
+	if s.snapshots != nil {
+		return nil
+	}
+	snapshots, err := s.folder.Snapshots(ctx)
+	if err != nil {
+		return err
+	}
+	s.snapshots = snapshots
+	return nil
+}
+
+func (s *shell) listCommits(ctx context.Context) error {
+	if err := s.loadSnapshots(ctx); err != nil {
+		return err
+	}
+	for _, snapshot := range s.snapshots {
+		current := " "
+		if snapshot.ID == s.snapshot.ID {
+			current = "*"
+		}
+		incomplete := ""
+		if !snapshot.IsComplete {
+			incomplete = " (incomplete)"
+		}
+		fmt.Printf("%s %s %s%s\n", current, snapshot.ID, snapshot.CreationDate.Format("2006-01-02 15:04:05 MST"), incomplete)
+	}
+	return nil
+}
+
+func (s *shell) findSnapshot(ctx context.Context, query string) (*arq.Snapshot, error) {
+	if query == "latest" {
+		return s.folder.Latest(ctx)
+	}
+	if err := s.loadSnapshots(ctx); err != nil {
+		return nil, err
+	}
+	matches := make([]*arq.Snapshot, 0)
+	for _, snapshot := range s.snapshots {
+		if snapshot.ID == query {
+			return snapshot, nil
+		}
+		if strings.HasPrefix(snapshot.ID, query) {
+			matches = append(matches, snapshot)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, errors.New(fmt.Sprintf("no commit %s, see 'commits'", query))
+	case 1:
+		return matches[0], nil
+	}
+	return nil, errors.New(fmt.Sprintf("%s matches %d commits, be more specific", query, len(matches)))
+}
+
+/*
+Complete the word before the cursor on tab, as a command name if it's the first word and otherwise as
+a path.
+*/
+func (s *shell) complete(line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' {
+		return "", 0, false
+	}
+	head := line[:pos]
+	start := 0
+	for i := 0; i < len(head); i++ {
+		if head[i] == '\\' {
+			i++
+		} else if head[i] == ' ' {
+			start = i + 1
+		}
+	}
+	word := unescapeShellWord(head[start:])
+
+	var candidates []string
+	suffixes := make(map[string]string)
+	dir := ""
+	if strings.TrimSpace(head[:start]) == "" {
+		candidates = shellCommands
+	} else {
+		var prefix string
+		dir, prefix = path.Split(word)
+		lookupDir := dir
+		if lookupDir == "" {
+			lookupDir = "."
+		}
+		files, err := s.snapshot.ReadDir(context.Background(), s.resolve(lookupDir))
+		if err != nil {
+			return "", 0, false
+		}
+		for _, file := range files {
+			if strings.HasPrefix(file.Name, prefix) {
+				candidates = append(candidates, file.Name)
+				if file.IsDir() {
+					suffixes[file.Name] = "/"
+				}
+			}
+		}
+	}
+	matches := make([]string, 0)
+	for _, candidate := range candidates {
+		if strings.HasPrefix(dir+candidate, word) {
+			matches = append(matches, candidate)
+		}
+	}
+	if len(matches) == 0 {
+		return "", 0, false
+	}
+	sort.Strings(matches)
+	completion := commonPrefix(matches)
+	if len(matches) == 1 {
+		if suffix, ok := suffixes[completion]; ok {
+			completion += suffix
+		} else {
+			completion += " "
+		}
+	}
+	newHead := head[:start] + escapeShellWord(dir+strings.TrimSuffix(completion, " "))
+	if strings.HasSuffix(completion, " ") {
+		newHead += " "
+	}
+	return newHead + line[pos:], len(newHead), true
+}
+
+func commonPrefix(words []string) string {
+	prefix := words[0]
+	for _, word := range words[1:] {
+		for !strings.HasPrefix(word, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
+
+func escapeShellWord(word string) string {
+	word = strings.Replace(word, "\\", "\\\\", -1)
+	return strings.Replace(word, " ", "\\ ", -1)
+}
+
+func unescapeShellWord(word string) string {
+	var result []byte
+	for i := 0; i < len(word); i++ {
+		if word[i] == '\\' && i+1 < len(word) {
+			i++
+		}
+		result = append(result, word[i])
+	}
+	return string(result)
+}
+
+/*
+Split a line into words on spaces, except within single or double quotes or after a backslash.
+*/
+func splitShellArgs(line string) ([]string, error) {
+	args := make([]string, 0)
+	var current []byte
+	inWord := false
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		b := line[i]
+		switch {
+		case quote != 0 && b == quote:
+			quote = 0
+		case quote != 0:
+			current = append(current, b)
+		case b == '\\' && i+1 < len(line):
+			i++
+			current = append(current, line[i])
+			inWord = true
+		case b == '\'' || b == '"':
+			quote = b
+			inWord = true
+		case b == ' ' || b == '\t':
+			if inWord {
+				args = append(args, string(current))
+				current = current[:0]
+				inWord = false
+			}
+		default:
+			current = append(current, b)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, errors.New("unterminated quote")
+	}
+	if inWord {
+		args = append(args, string(current))
+	}
+	return args, nil
+}
@@ -0,0 +1,414 @@
+/*
+arqinator: webdav.go
+Implements serving a backup set as a read-only WebDAV share.
+
+Copyright 2016 Asim Ihsan
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+/*
+The share has a directory per folder of the backup set, named after the last element of its local path.
+Each has a directory per commit, named by its creation time, plus 'latest'. Below a commit are the
+directories and files it backed up:
+
+	/Documents/latest/notes.txt
+	/Documents/2016-05-01 12.30.00/notes.txt
+
+Directory listings only need the tree of the directory being listed, so that clients that stat every
+entry don't read every tree below it.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	"golang.org/x/net/webdav"
+
+	"github.com/asimihsan/arqinator/arq"
+	"github.com/asimihsan/arqinator/connector"
+)
+
+const (
+	WEBDAV_LATEST_COMMIT       = "latest"
+	WEBDAV_COMMIT_TIME_FORMAT  = "2006-01-02 15.04.05"
+	WEBDAV_READ_ONLY_FILE_MODE = os.FileMode(0444)
+	WEBDAV_READ_ONLY_DIR_MODE  = os.ModeDir | os.FileMode(0555)
+)
+
+type webdavFileSystem struct {
+	startTime time.Time
+
+	// Keyed by directory name. Set up front and not changed after, so it needs no lock.
+	folders map[string]*arq.Folder
+
+	// Guards snapshots. Snapshots and the files they open are safe for concurrent use, so reads from the
+	// backup don't hold it.
+	mutex sync.Mutex
+
+	// Keyed by folder UUID, then by directory name. Loaded when a folder is first listed, and kept along
+	// with the trees read from them.
+	snapshots map[string]map[string]*arq.Snapshot
+}
+
+func runWebDAV(ctx context.Context, c *cli.Context, connection connector.Connection) error {
+	repository, err := openRepository(ctx, c, connection)
+	if err != nil {
+		log.Errorf("Failed to get backup sets: %s", err)
+		return err
+	}
+	selector := getBucketSelector(c)
+	folders := selectFolders(repository.Folders(), selector)
+	if len(folders) == 0 {
+		err := errors.New(fmt.Sprintf("Couldn't find %s. Use 'list-backup-sets' to see what's available.", selector))
+		log.Errorf("%s", err)
+		return err
+	}
+	backupSet := folders[0].BackupSet
+	for _, folder := range folders {
+		if folder.BackupSet != backupSet {
+			err := errors.New(fmt.Sprintf("%s matches more than one backup set, use --backup-set-uuid or --computer. "+
+				"Use 'list-backup-sets' to see what's available.", selector))
+			log.Errorf("%s", err)
+			return err
+		}
+	}
+
+	handler := &webdav.Handler{
+		FileSystem: newWebDAVFileSystem(folders),
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				log.Debugf("webdav %s %s: %s", r.Method, r.URL, err)
+			}
+		},
+	}
+	listen := c.String("listen")
+	log.Printf("Serving backup set %s of %s as WebDAV on http://%s/", backupSet.UUID,
+		backupSet.ComputerInfo.ComputerName, listen)
+	return listenAndServe(ctx, listen, handler)
+}
+
+/*
+Folders whose local paths end in the same name are told apart by their UUIDs.
+*/
+func newWebDAVFileSystem(folders []*arq.Folder) *webdavFileSystem {
+	fs := &webdavFileSystem{
+		startTime: time.Now(),
+		folders:   make(map[string]*arq.Folder),
+		snapshots: make(map[string]map[string]*arq.Snapshot),
+	}
+	counts := make(map[string]int)
+	for _, folder := range folders {
+		counts[path.Base(folder.LocalPath)]++
+	}
+	for _, folder := range folders {
+		name := path.Base(folder.LocalPath)
+		if counts[name] > 1 || name == "/" {
+			name = fmt.Sprintf("%s (%s)", name, folder.UUID)
+		}
+		fs.folders[name] = folder
+	}
+	return fs
+}
+
+func (fs *webdavFileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (fs *webdavFileSystem) RemoveAll(ctx context.Context, name string) error {
+	return os.ErrPermission
+}
+
+func (fs *webdavFileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	return os.ErrPermission
+}
+
+func (fs *webdavFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 {
+		return nil, os.ErrPermission
+	}
+	return fs.resolve(ctx, name)
+}
+
+func (fs *webdavFileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	f, err := fs.resolve(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return f.info, nil
+}
+
+/*
+The file keeps ctx, the context of the request that opened it, for reading.
+*/
+func (fs *webdavFileSystem) resolve(ctx context.Context, name string) (*webdavFile, error) {
+	name = path.Clean("/" + name)
+	parts := strings.SplitN(strings.TrimPrefix(name, "/"), "/", 3)
+	if parts[0] == "" {
+		return &webdavFile{ctx: ctx, fs: fs, info: newDirInfo("/", fs.startTime)}, nil
+	}
+	folder, ok := fs.folders[parts[0]]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	if len(parts) == 1 {
+		return &webdavFile{ctx: ctx, fs: fs, info: newDirInfo(parts[0], fs.startTime), folder: folder}, nil
+	}
+	snapshot, err := fs.findSnapshot(ctx, folder, parts[1])
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) == 2 {
+		return &webdavFile{ctx: ctx, fs: fs, info: newDirInfo(parts[1], snapshot.CreationDate), folder: folder,
+			snapshot: snapshot, path: "/"}, nil
+	}
+	file, err := snapshot.Stat(ctx, "/"+parts[2])
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	return &webdavFile{ctx: ctx, fs: fs, info: newFileInfo(file), folder: folder, snapshot: snapshot, path: file.Path}, nil
+}
+
+/*
+Requests that ask at once may both list the snapshots, but only the first list is kept, so that every
+request sees the same snapshots and the trees read from them.
+*/
+func (fs *webdavFileSystem) loadSnapshots(ctx context.Context, folder *arq.Folder) (map[string]*arq.Snapshot, error) {
+	fs.mutex.Lock()
+	snapshots, ok := fs.snapshots[folder.UUID]
+	fs.mutex.Unlock()
+	if ok {
+		return snapshots, nil
+	}
+	list, err := folder.Snapshots(ctx)
+	if err != nil {
+		log.Debugf("webdav failed to list snapshots of %s: %s", folder.LocalPath, err)
+		return nil, err
+	}
+	counts := make(map[string]int)
+	for _, snapshot := range list {
+		counts[snapshot.CreationDate.Format(WEBDAV_COMMIT_TIME_FORMAT)]++
+	}
+	snapshots = make(map[string]*arq.Snapshot)
+	for _, snapshot := range list {
+		name := snapshot.CreationDate.Format(WEBDAV_COMMIT_TIME_FORMAT)
+		if counts[name] > 1 {
+			name = fmt.Sprintf("%s (%s)", name, snapshot.ID)
+		}
+		snapshots[name] = snapshot
+	}
+	if len(list) > 0 {
+		snapshots[WEBDAV_LATEST_COMMIT] = list[0]
+	}
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if kept, ok := fs.snapshots[folder.UUID]; ok {
+		return kept, nil
+	}
+	fs.snapshots[folder.UUID] = snapshots
+	return snapshots, nil
+}
+
+func (fs *webdavFileSystem) findSnapshot(ctx context.Context, folder *arq.Folder, name string) (*arq.Snapshot, error) {
+	snapshots, err := fs.loadSnapshots(ctx, folder)
+	if err != nil {
+		return nil, err
+	}
+	snapshot, ok := snapshots[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return snapshot, nil
+}
+
+func newDirInfo(name string, modTime time.Time) *webdavFileInfo {
+	return &webdavFileInfo{name: name, mode: WEBDAV_READ_ONLY_DIR_MODE, modTime: modTime}
+}
+
+func newFileInfo(file *arq.File) *webdavFileInfo {
+	info := &webdavFileInfo{
+		name:    file.Name,
+		size:    file.Size,
+		mode:    file.Mode & WEBDAV_READ_ONLY_FILE_MODE,
+		modTime: file.ModTime,
+	}
+	if file.IsDir() {
+		info.mode = os.ModeDir | file.Mode&WEBDAV_READ_ONLY_DIR_MODE.Perm()
+	}
+	return info
+}
+
+type webdavFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (fi *webdavFileInfo) Name() string       { return fi.name }
+func (fi *webdavFileInfo) Size() int64        { return fi.size }
+func (fi *webdavFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *webdavFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *webdavFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *webdavFileInfo) Sys() interface{}   { return nil }
+
+/*
+Guess the content type from the file name, rather than have the webdav package read the start of every
+file in a listing.
+*/
+func (fi *webdavFileInfo) ContentType(ctx context.Context) (string, error) {
+	if contentType := mime.TypeByExtension(path.Ext(fi.name)); contentType != "" {
+		return contentType, nil
+	}
+	return "application/octet-stream", nil
+}
+
+/*
+A directory or file of the share. The root directory has no folder, and folder directories have no
+snapshot.
+*/
+type webdavFile struct {
+	ctx      context.Context
+	fs       *webdavFileSystem
+	info     *webdavFileInfo
+	folder   *arq.Folder
+	snapshot *arq.Snapshot
+	path     string
+
+	// Directories
+	children      []os.FileInfo
+	readdirOffset int
+
+	// Files, opened by the first Read or Seek
+	reader *arq.FileReader
+}
+
+func (f *webdavFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *webdavFile) Close() error {
+	return nil
+}
+
+func (f *webdavFile) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (f *webdavFile) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.info.IsDir() {
+		return nil, os.ErrInvalid
+	}
+	if f.children == nil {
+		children, err := f.listChildren()
+		if err != nil {
+			return nil, err
+		}
+		f.children = children
+	}
+	remaining := f.children[f.readdirOffset:]
+	if count <= 0 {
+		f.readdirOffset = len(f.children)
+		return remaining, nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(remaining) {
+		count = len(remaining)
+	}
+	f.readdirOffset += count
+	return remaining[:count], nil
+}
+
+func (f *webdavFile) listChildren() ([]os.FileInfo, error) {
+	children := make([]os.FileInfo, 0)
+	switch {
+	case f.folder == nil:
+		for name := range f.fs.folders {
+			children = append(children, newDirInfo(name, f.fs.startTime))
+		}
+	case f.snapshot == nil:
+		snapshots, err := f.fs.loadSnapshots(f.ctx, f.folder)
+		if err != nil {
+			return nil, err
+		}
+		for name, snapshot := range snapshots {
+			children = append(children, newDirInfo(name, snapshot.CreationDate))
+		}
+	default:
+		files, err := f.snapshot.ReadDir(f.ctx, f.path)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			children = append(children, newFileInfo(file))
+		}
+	}
+	sort.Sort(fileInfosByName(children))
+	return children, nil
+}
+
+type fileInfosByName []os.FileInfo
+
+func (a fileInfosByName) Len() int           { return len(a) }
+func (a fileInfosByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a fileInfosByName) Less(i, j int) bool { return a[i].Name() < a[j].Name() }
+
+func (f *webdavFile) getReader() (*arq.FileReader, error) {
+	if f.info.IsDir() {
+		return nil, os.ErrInvalid
+	}
+	if f.reader == nil {
+		reader, err := f.snapshot.Open(f.ctx, f.path)
+		if err != nil {
+			return nil, err
+		}
+		f.reader = reader
+	}
+	return f.reader, nil
+}
+
+func (f *webdavFile) Seek(offset int64, whence int) (int64, error) {
+	reader, err := f.getReader()
+	if err != nil {
+		return 0, err
+	}
+	return reader.Seek(offset, whence)
+}
+
+func (f *webdavFile) Read(p []byte) (int, error) {
+	reader, err := f.getReader()
+	if err != nil {
+		return 0, err
+	}
+	return reader.Read(p)
+}